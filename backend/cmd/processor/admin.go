@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// requireAdminToken guards the processor's /admin/ endpoints with a static
+// bearer token (PROCESSOR_ADMIN_TOKEN). Without a token they are disabled.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeJSONError(w, http.StatusNotFound, "admin_disabled", nil)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdentityAdmin serves the identity-graph admin endpoints.
+type IdentityAdmin struct {
+	graph *IdentityGraph
+}
+
+// identityNodeRequest names a node by visitor_id or user_id.
+type identityNodeRequest struct {
+	VisitorID string `json:"visitor_id"`
+	UserID    string `json:"user_id"`
+}
+
+func (req identityNodeRequest) node() string {
+	if req.VisitorID != "" {
+		return visitorNode(req.VisitorID)
+	}
+	if req.UserID != "" {
+		return userNode(req.UserID)
+	}
+	return ""
+}
+
+// HandleCluster returns the cluster of ?visitor_id= or ?user_id=.
+func (a *IdentityAdmin) HandleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", nil)
+		return
+	}
+	node := identityNodeRequest{
+		VisitorID: r.URL.Query().Get("visitor_id"),
+		UserID:    r.URL.Query().Get("user_id"),
+	}.node()
+	if node == "" {
+		writeJSONError(w, http.StatusBadRequest, "visitor_id_or_user_id_required", nil)
+		return
+	}
+
+	cluster, err := a.graph.Cluster(node)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "identity_graph_error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cluster)
+}
+
+// HandleSplit detaches the node in the JSON body ({"visitor_id": ...} or
+// {"user_id": ...}) from its cluster and returns the resulting clusters.
+func (a *IdentityAdmin) HandleSplit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", nil)
+		return
+	}
+	var req identityNodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", err)
+		return
+	}
+	node := req.node()
+	if node == "" {
+		writeJSONError(w, http.StatusBadRequest, "visitor_id_or_user_id_required", nil)
+		return
+	}
+
+	clusters, err := a.graph.Split(node)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "identity_graph_error", err)
+		return
+	}
+	log.Printf("Identity graph: split %s into %d clusters", node, len(clusters))
+	writeJSON(w, http.StatusOK, map[string]any{"clusters": clusters})
+}
+
+// PrivacyAdmin serves the erasure endpoint used by the backend's privacy API.
+type PrivacyAdmin struct {
+	fingerprints *FingerprintService
+	sessions     *SessionEnricher
+	graph        *IdentityGraph
+	buffer       *IngestBuffer
+}
+
+// eraseRequest lists the identifiers of one data subject.
+type eraseRequest struct {
+	VisitorIDs []string `json:"visitor_ids"`
+	UserIDs    []string `json:"user_ids"`
+}
+
+// HandleErase purges the fingerprint, session and identity-graph state of
+// the visitor_ids and user_ids in the JSON body, and their events still in
+// the spool, and returns what was deleted.
+func (a *PrivacyAdmin) HandleErase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", nil)
+		return
+	}
+	var req eraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", err)
+		return
+	}
+	visitorIDs := nonEmpty(req.VisitorIDs)
+	userIDs := nonEmpty(req.UserIDs)
+	if len(visitorIDs) == 0 && len(userIDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "visitor_ids_or_user_ids_required", nil)
+		return
+	}
+
+	fpKeys, err := a.fingerprints.Erase(visitorIDs)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "fingerprint_erase_failed", err)
+		return
+	}
+	sessions, err := a.sessions.Erase(visitorIDs)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "session_erase_failed", err)
+		return
+	}
+	nodes := 0
+	for _, node := range identityNodes(visitorIDs, userIDs) {
+		erased, err := a.graph.Erase(node)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "identity_erase_failed", err)
+			return
+		}
+		if erased {
+			nodes++
+		}
+	}
+
+	spooled, err := a.buffer.Purge(subjectEvents(visitorIDs, userIDs))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "spool_erase_failed", err)
+		return
+	}
+
+	log.Printf("Privacy: erased %d visitor_ids, %d user_ids (%d fingerprint keys, %d sessions, %d identity nodes, %d spooled events)",
+		len(visitorIDs), len(userIDs), fpKeys, sessions, nodes, spooled)
+	writeJSON(w, http.StatusOK, map[string]int{
+		"fingerprint_keys": fpKeys,
+		"sessions":         sessions,
+		"identity_nodes":   nodes,
+		"spool_events":     spooled,
+	})
+}
+
+// subjectEvents matches the events of a data subject as the backend selects
+// them in ClickHouse: with user_ids, events of one of them plus events of the
+// visitor_ids that carry no user_id; otherwise all events of the visitor_ids.
+func subjectEvents(visitorIDs, userIDs []string) func(*Event) bool {
+	visitors := make(map[string]bool, len(visitorIDs))
+	for _, v := range visitorIDs {
+		visitors[v] = true
+	}
+	users := make(map[string]bool, len(userIDs))
+	for _, u := range userIDs {
+		users[u] = true
+	}
+	return func(e *Event) bool {
+		userID := e.IDs["user_id"]
+		if users[userID] {
+			return true
+		}
+		if len(users) > 0 && userID != "" {
+			return false // Shared device, logged in as someone else
+		}
+		return visitors[e.IDs["visitor_id"]] || visitors[e.IDs["original_visitor_id"]]
+	}
+}
+
+func identityNodes(visitorIDs, userIDs []string) []string {
+	nodes := make([]string, 0, len(visitorIDs)+len(userIDs))
+	for _, v := range visitorIDs {
+		nodes = append(nodes, visitorNode(v))
+	}
+	for _, u := range userIDs {
+		nodes = append(nodes, userNode(u))
+	}
+	return nodes
+}
+
+func nonEmpty(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("writeJSON encode failed: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code string, err error) {
+	if err != nil {
+		log.Printf("%s: %v", code, err)
+	}
+	writeJSON(w, status, map[string]any{
+		"error":  code,
+		"detail": safeErrorString(err),
+	})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot signals: keys of the weights map and values of device.bot_reasons.
+const (
+	botUASignature   = "ua_signature"
+	botEmptyUA       = "empty_ua"
+	botWebdriver     = "webdriver"
+	botHeadlessUA    = "headless_ua"
+	botNoFingerprint = "no_fingerprint"
+	botZeroScreen    = "zero_screen"
+	botIPRate        = "ip_rate"
+	botFastEvents    = "fast_events"
+	botDatacenter    = "datacenter_asn"
+)
+
+// defaultBotRulesJSON is the bundled scoring config, used unless BOT_RULES is set.
+//
+//go:embed bots.json
+var defaultBotRulesJSON []byte
+
+// BotRulesFile is the bot-scoring config. Every signal that fires adds its
+// weight to the score (capped at 100); device.is_bot is score >= threshold.
+//
+//   - ua_patterns / headless_patterns: case-insensitive substrings of the UA.
+//   - rate: more than max_requests events from one ip_hash within window.
+//   - timing: more than max_fast_streak consecutive events of a visitor less
+//     than min_interval apart (by event timestamp).
+//   - datacenter_asns: ASNs ("16509") or ranges ("396982-396990") matched
+//     against geo.asn.
+type BotRulesFile struct {
+	Threshold        int            `json:"threshold"`
+	Weights          map[string]int `json:"weights"`
+	UAPatterns       []string       `json:"ua_patterns"`
+	HeadlessPatterns []string       `json:"headless_patterns"`
+	Rate             struct {
+		Window      string `json:"window"`
+		MaxRequests int    `json:"max_requests"`
+	} `json:"rate"`
+	Timing struct {
+		MinInterval   string `json:"min_interval"`
+		MaxFastStreak int    `json:"max_fast_streak"`
+	} `json:"timing"`
+	DatacenterASNs []string `json:"datacenter_asns"`
+}
+
+type asnRange struct{ from, to uint64 }
+
+// BotScorer scores events with the bot rules. Rate and timing state is kept
+// in memory, per processor instance.
+type BotScorer struct {
+	threshold        int
+	weights          map[string]int
+	uaPatterns       []string
+	headlessPatterns []string
+	rateWindow       time.Duration
+	rateMax          int
+	minInterval      time.Duration
+	maxFastStreak    int
+	asns             []asnRange
+
+	mu       sync.Mutex
+	ipRates  map[string]*rateCounter
+	visitors map[string]*visitorTiming
+	swept    time.Time
+}
+
+// rateCounter approximates a sliding window with the current and previous
+// fixed windows.
+type rateCounter struct {
+	start     time.Time
+	cur, prev int
+}
+
+type visitorTiming struct {
+	last   time.Time
+	streak int
+	seen   time.Time // Wall clock, for expiry
+}
+
+// ParseBotRules compiles a bot-scoring config.
+func ParseBotRules(data []byte) (*BotScorer, error) {
+	var file BotRulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Threshold <= 0 || file.Threshold > 100 {
+		return nil, fmt.Errorf("threshold must be in 1..100, got %d", file.Threshold)
+	}
+	for signal := range file.Weights {
+		switch signal {
+		case botUASignature, botEmptyUA, botWebdriver, botHeadlessUA, botNoFingerprint,
+			botZeroScreen, botIPRate, botFastEvents, botDatacenter:
+		default:
+			return nil, fmt.Errorf("unknown signal %q in weights", signal)
+		}
+	}
+
+	s := &BotScorer{
+		threshold:        file.Threshold,
+		weights:          file.Weights,
+		uaPatterns:       lowerAll(file.UAPatterns),
+		headlessPatterns: lowerAll(file.HeadlessPatterns),
+		rateMax:          file.Rate.MaxRequests,
+		maxFastStreak:    file.Timing.MaxFastStreak,
+		ipRates:          make(map[string]*rateCounter),
+		visitors:         make(map[string]*visitorTiming),
+	}
+	var err error
+	if s.rateWindow, err = parseOptionalDuration(file.Rate.Window); err != nil {
+		return nil, fmt.Errorf("rate.window: %w", err)
+	}
+	if s.minInterval, err = parseOptionalDuration(file.Timing.MinInterval); err != nil {
+		return nil, fmt.Errorf("timing.min_interval: %w", err)
+	}
+	for _, entry := range file.DatacenterASNs {
+		r, err := parseASNRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		s.asns = append(s.asns, r)
+	}
+	return s, nil
+}
+
+// LoadBotRules reads a bot-scoring config file.
+func LoadBotRules(path string) (*BotScorer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseBotRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func parseASNRange(entry string) (asnRange, error) {
+	from, to, isRange := strings.Cut(strings.TrimPrefix(strings.ToUpper(entry), "AS"), "-")
+	lo, err := strconv.ParseUint(strings.TrimSpace(from), 10, 32)
+	if err != nil {
+		return asnRange{}, fmt.Errorf("invalid ASN %q", entry)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.ParseUint(strings.TrimSpace(to), 10, 32); err != nil || hi < lo {
+			return asnRange{}, fmt.Errorf("invalid ASN range %q", entry)
+		}
+	}
+	return asnRange{from: lo, to: hi}, nil
+}
+
+// Score returns the bot score (0..100) and the signals that fired.
+func (s *BotScorer) Score(in *EnrichInput, e *Event) (int, []string) {
+	var reasons []string
+	fire := func(signal string) {
+		if s.weights[signal] > 0 {
+			reasons = append(reasons, signal)
+		}
+	}
+
+	// 1. User agent
+	ua := strings.ToLower(in.UserAgent)
+	switch {
+	case ua == "":
+		fire(botEmptyUA)
+	case containsAny(ua, s.headlessPatterns):
+		fire(botHeadlessUA)
+	case e.Device["model"] == "Spider" || containsAny(ua, s.uaPatterns):
+		fire(botUASignature)
+	}
+
+	// 2. Headless markers; only for events sent by the browser tracker
+	if device, ok := in.Raw["device"].(map[string]interface{}); ok {
+		if wd := toString(device["webdriver"]); wd == "true" || wd == "1" {
+			fire(botWebdriver)
+		}
+		if in.Consent.Fingerprinting && extractHeavyFingerprint(in.Raw, device) == nil {
+			fire(botNoFingerprint)
+		}
+		if getFloat(device["screenWidth"]) == 0 || getFloat(device["screenHeight"]) == 0 {
+			fire(botZeroScreen)
+		}
+	}
+
+	// 3. Datacenter networks
+	if asn, err := strconv.ParseUint(e.Geo["asn"], 10, 32); err == nil && s.isDatacenter(asn) {
+		fire(botDatacenter)
+	}
+
+	// 4. Rate and timing; they track IPs and visitors, so only with analytics consent
+	if in.Consent.Analytics {
+		now := time.Now()
+		s.mu.Lock()
+		if s.rateMax > 0 && s.rateWindow > 0 && in.IPHash != "" && s.countRequest(in.IPHash, now) > s.rateMax {
+			fire(botIPRate)
+		}
+		if s.maxFastStreak > 0 && s.minInterval > 0 && e.IDs["visitor_id"] != "" && s.fastStreak(e.IDs["visitor_id"], e.Timestamp, now) > s.maxFastStreak {
+			fire(botFastEvents)
+		}
+		s.sweep(now)
+		s.mu.Unlock()
+	}
+
+	score := 0
+	for _, r := range reasons {
+		score += s.weights[r]
+	}
+	if score > 100 {
+		score = 100
+	}
+	sort.Strings(reasons)
+	return score, reasons
+}
+
+func (s *BotScorer) isDatacenter(asn uint64) bool {
+	for _, r := range s.asns {
+		if asn >= r.from && asn <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// countRequest records a request and returns the estimated count in the
+// sliding window. Caller holds mu.
+func (s *BotScorer) countRequest(ipHash string, now time.Time) int {
+	c, ok := s.ipRates[ipHash]
+	if !ok {
+		c = &rateCounter{start: now}
+		s.ipRates[ipHash] = c
+	}
+	if elapsed := now.Sub(c.start); elapsed >= s.rateWindow {
+		if elapsed < 2*s.rateWindow {
+			c.prev = c.cur
+		} else {
+			c.prev = 0
+		}
+		c.cur = 0
+		c.start = now.Truncate(s.rateWindow)
+	}
+	c.cur++
+
+	weight := 1 - float64(now.Sub(c.start))/float64(s.rateWindow)
+	if weight < 0 {
+		weight = 0
+	}
+	return c.cur + int(float64(c.prev)*weight)
+}
+
+// fastStreak records an event timestamp and returns the visitor's current
+// streak of events closer than minInterval. Caller holds mu.
+func (s *BotScorer) fastStreak(visitorID string, ts, now time.Time) int {
+	v, ok := s.visitors[visitorID]
+	if !ok {
+		s.visitors[visitorID] = &visitorTiming{last: ts, seen: now}
+		return 0
+	}
+	gap := ts.Sub(v.last)
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap < s.minInterval {
+		v.streak++
+	} else {
+		v.streak = 0
+	}
+	v.last = ts
+	v.seen = now
+	return v.streak
+}
+
+// sweep drops idle rate and timing state about once per minute. Caller holds mu.
+func (s *BotScorer) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for ip, c := range s.ipRates {
+		if now.Sub(c.start) >= 2*s.rateWindow {
+			delete(s.ipRates, ip)
+		}
+	}
+	for vid, v := range s.visitors {
+		if now.Sub(v.seen) >= 10*time.Minute {
+			delete(s.visitors, vid)
+		}
+	}
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if sub != "" && strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// BotEnricher writes device.bot_score, device.bot_reasons and device.is_bot.
+// Registered as "bot".
+type BotEnricher struct {
+	scorer *BotScorer
+}
+
+// NewBotEnricher creates the bot enricher with the given rules. The registered
+// one uses the bundled rules.
+func NewBotEnricher(scorer *BotScorer) *BotEnricher {
+	return &BotEnricher{scorer: scorer}
+}
+
+func mustParseBotRules(data []byte) *BotScorer {
+	s, err := ParseBotRules(data)
+	if err != nil {
+		panic(fmt.Sprintf("bundled bot rules: %v", err))
+	}
+	return s
+}
+
+func (b *BotEnricher) Name() string { return "bot" }
+
+func (b *BotEnricher) Enrich(in *EnrichInput, e *Event) error {
+	score, reasons := b.scorer.Score(in, e)
+	for _, r := range reasons {
+		metricBotSignals.WithLabelValues(r).Inc()
+	}
+	isBot := score >= b.scorer.threshold
+	if isBot {
+		metricBotEvents.Inc()
+	}
+
+	e.Device["bot_score"] = strconv.Itoa(score)
+	e.Device["bot_reasons"] = strings.Join(reasons, ",")
+	e.Device["is_bot"] = strconv.FormatBool(isBot)
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testBotRulesJSON = `{
+  "threshold": 50,
+  "weights": {
+    "ua_signature": 60, "empty_ua": 40, "webdriver": 70, "headless_ua": 80, "no_fingerprint": 10,
+    "zero_screen": 20, "ip_rate": 30, "fast_events": 25, "datacenter_asn": 35
+  },
+  "ua_patterns": ["Bot", "curl/"],
+  "headless_patterns": ["HeadlessChrome"],
+  "rate": {"window": "1m", "max_requests": 3},
+  "timing": {"min_interval": "500ms", "max_fast_streak": 2},
+  "datacenter_asns": ["AS16509", "396982-396990"]
+}`
+
+const testBrowserUA = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 Chrome/130.0 Safari/537.36"
+
+func newBotEvent() *Event {
+	return &Event{
+		Timestamp: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		IDs:       make(map[string]string),
+		Device:    make(map[string]string),
+		Geo:       make(map[string]string),
+	}
+}
+
+func TestBotEnricherSignals(t *testing.T) {
+	b := NewBotEnricher(mustParseBotRules([]byte(testBotRulesJSON)))
+	browser := map[string]interface{}{"screenWidth": 1920.0, "screenHeight": 1080.0, "fingerprint": map[string]interface{}{"canvas": "c1"}}
+	tests := []struct {
+		name    string
+		ua      string
+		device  map[string]interface{} // raw device of the browser tracker
+		asn     string
+		consent Consent
+		score   string
+		reasons string
+		isBot   bool
+	}{
+		{"browser", testBrowserUA, browser, "3320", Consent{Fingerprinting: true}, "0", "", false},
+		{"server-side event", testBrowserUA, nil, "", Consent{}, "0", "", false},
+		{"empty UA", "", nil, "", Consent{}, "40", "empty_ua", false},
+		{"UA signature", "Mozilla/5.0 (compatible; Googlebot/2.1)", nil, "", Consent{}, "60", "ua_signature", true},
+		{"headless before signature", "HeadlessChrome/130.0 bot", nil, "", Consent{}, "80", "headless_ua", true},
+		{"webdriver", testBrowserUA, map[string]interface{}{"webdriver": "true", "screenWidth": 1920.0, "screenHeight": 1080.0}, "", Consent{}, "70", "webdriver", true},
+		{"zero screen", testBrowserUA, map[string]interface{}{"screenWidth": 1920.0}, "", Consent{}, "20", "zero_screen", false},
+		{"no fingerprint needs consent", testBrowserUA, map[string]interface{}{"screenWidth": 1.0, "screenHeight": 1.0}, "", Consent{}, "0", "", false},
+		{"no fingerprint", testBrowserUA, map[string]interface{}{"screenWidth": 1.0, "screenHeight": 1.0}, "", Consent{Fingerprinting: true}, "10", "no_fingerprint", false},
+		{"datacenter ASN", testBrowserUA, nil, "16509", Consent{}, "35", "datacenter_asn", false},
+		{"datacenter ASN range", testBrowserUA, nil, "396990", Consent{}, "35", "datacenter_asn", false},
+		{"at the threshold", "", map[string]interface{}{"screenWidth": 1.0, "screenHeight": 1.0}, "", Consent{Fingerprinting: true}, "50", "empty_ua,no_fingerprint", true},
+		{"capped", "HeadlessChrome", map[string]interface{}{"webdriver": true, "screenWidth": 0.0}, "16509", Consent{}, "100", "datacenter_asn,headless_ua,webdriver,zero_screen", true},
+	}
+	for _, tt := range tests {
+		raw := map[string]interface{}{}
+		if tt.device != nil {
+			raw["device"] = tt.device
+		}
+		e := newBotEvent()
+		e.Geo["asn"] = tt.asn
+		if err := b.Enrich(&EnrichInput{Raw: raw, UserAgent: tt.ua, Consent: tt.consent}, e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Device["bot_score"] != tt.score || e.Device["bot_reasons"] != tt.reasons || e.Device["is_bot"] != strconv.FormatBool(tt.isBot) {
+			t.Errorf("%s: score %s, reasons %q, is_bot %s; want %s, %q, %v",
+				tt.name, e.Device["bot_score"], e.Device["bot_reasons"], e.Device["is_bot"], tt.score, tt.reasons, tt.isBot)
+		}
+	}
+}
+
+func TestBotScoreWeights(t *testing.T) {
+	// A signal without a weight does not fire
+	s, err := ParseBotRules([]byte(`{"threshold": 10, "weights": {"headless_ua": 15}, "ua_patterns": ["bot"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score, reasons := s.Score(&EnrichInput{UserAgent: "Googlebot"}, newBotEvent()); score != 0 || len(reasons) != 0 {
+		t.Errorf("unweighted signal: score %d, reasons %v", score, reasons)
+	}
+	if score, reasons := s.Score(&EnrichInput{}, newBotEvent()); score != 0 || len(reasons) != 0 {
+		t.Errorf("unweighted empty UA: score %d, reasons %v", score, reasons)
+	}
+
+	for _, bad := range []string{
+		`{"threshold": 0}`,
+		`{"threshold": 101}`,
+		`{"threshold": 50, "weights": {"referrer_spam": 10}}`,
+		`{"threshold": 50, "rate": {"window": "soon"}}`,
+		`{"threshold": 50, "timing": {"min_interval": "fast"}}`,
+		`{"threshold": 50, "datacenter_asns": ["AS-1"]}`,
+		`{"threshold": 50, "datacenter_asns": ["20-10"]}`,
+	} {
+		if _, err := ParseBotRules([]byte(bad)); err == nil {
+			t.Errorf("ParseBotRules accepted %s", bad)
+		}
+	}
+}
+
+// scoreReasons scores an event of one IP and visitor and returns the signals.
+func scoreReasons(s *BotScorer, consent Consent, ts time.Time) []string {
+	e := newBotEvent()
+	e.Timestamp = ts
+	e.IDs["visitor_id"] = "v1"
+	_, reasons := s.Score(&EnrichInput{UserAgent: testBrowserUA, IPHash: "ip1", Consent: consent}, e)
+	return reasons
+}
+
+func TestBotScoreRate(t *testing.T) {
+	s := mustParseBotRules([]byte(testBotRulesJSON))
+	granted := Consent{Analytics: true}
+	ts := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	// Without analytics consent requests are neither counted nor scored
+	for i := 0; i < 10; i++ {
+		if reasons := scoreReasons(s, Consent{}, ts.Add(time.Duration(i)*time.Minute)); len(reasons) != 0 {
+			t.Fatalf("request %d without consent: %v", i+1, reasons)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		reasons := scoreReasons(s, granted, ts.Add(time.Duration(i)*time.Minute))
+		if got, want := slices.Contains(reasons, botIPRate), i > 3; got != want {
+			t.Errorf("request %d: reasons %v, want ip_rate %v", i, reasons, want)
+		}
+	}
+}
+
+func TestBotScoreTiming(t *testing.T) {
+	s := mustParseBotRules([]byte(testBotRulesJSON))
+	s.rateMax = 0 // Timing only
+	granted := Consent{Analytics: true}
+	ts := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 10; i++ {
+		if reasons := scoreReasons(s, Consent{}, ts.Add(time.Duration(i)*time.Millisecond)); len(reasons) != 0 {
+			t.Fatalf("event %d without consent: %v", i+1, reasons)
+		}
+	}
+
+	steps := []struct {
+		gap  time.Duration
+		fast bool
+	}{
+		{0, false}, // First event
+		{100 * time.Millisecond, false},
+		{100 * time.Millisecond, false},
+		{100 * time.Millisecond, true},  // Streak of 3 > max_fast_streak
+		{-200 * time.Millisecond, true}, // Late events count by their distance
+		{time.Second, false},            // A slow event ends the streak
+		{100 * time.Millisecond, false},
+	}
+	for i, step := range steps {
+		ts = ts.Add(step.gap)
+		reasons := scoreReasons(s, granted, ts)
+		if got := slices.Contains(reasons, botFastEvents); got != step.fast {
+			t.Errorf("event %d: reasons %v, want fast_events %v", i+1, reasons, step.fast)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker stops calls to a failing dependency. After maxFailures
+// consecutive failures it opens for cooldown; then a single probe call is
+// allowed (half-open) and its result closes or re-opens the circuit.
+type CircuitBreaker struct {
+	maxFailures int
+	cooldown    time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// NewCircuitBreaker creates a closed circuit breaker.
+func NewCircuitBreaker(maxFailures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+	}
+}
+
+// Allow reports whether a call may be made now. While open it returns the
+// time left until the next probe.
+func (cb *CircuitBreaker) Allow() (bool, time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.maxFailures {
+		return true, 0
+	}
+	if wait := time.Until(cb.openUntil); wait > 0 {
+		return false, wait
+	}
+	return true, 0 // Half-open: probe
+}
+
+// Success closes the circuit.
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+}
+
+// Failure records a failed call and opens the circuit once the limit is reached.
+// Returns true if the circuit is open.
+func (cb *CircuitBreaker) Failure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	if cb.failures >= cb.maxFailures {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		return true
+	}
+	return false
+}
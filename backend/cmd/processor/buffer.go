@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// ErrBufferFull is returned by Reserve when accepting the events would exceed the buffer capacity.
+var ErrBufferFull = errors.New("ingest buffer is full")
+
+// ErrBufferClosed is returned by Reserve after Close was called.
+var ErrBufferClosed = errors.New("ingest buffer is closed")
+
+const (
+	flushRetryMin = 500 * time.Millisecond
+	flushRetryMax = 30 * time.Second
+)
+
+// BufferedEvent is a mapped event waiting to be inserted into ClickHouse.
+type BufferedEvent struct {
+	Event   *Event
+	EventID string
+	Payload []byte        // Original JSON, dead-lettered if the append fails
+	Link    *IdentityLink // Set when the fingerprint service swapped visitor_id
+}
+
+// IngestBuffer collects events across /ingest requests in the on-disk spool
+// and inserts them into ClickHouse in batches. Events are acknowledged once
+// they are fsynced to the spool, so a ClickHouse outage never makes Vector
+// resend (and re-fingerprint) them.
+//
+// The active spool segment is sealed when it holds flushSize events or is
+// flushInterval old; the drainer inserts sealed segments one per batch,
+// retrying with exponential backoff behind a circuit breaker. Callers Reserve
+// room for a request before mapping it; once maxEvents are spooled or
+// reserved, Reserve fails so the caller can push back on Vector before any
+// state (dedup, fingerprints, sessions) is touched.
+type IngestBuffer struct {
+	ch             clickhouse.Conn
+	dlq            *DeadLetterQueue
+	dedup          *DedupWindow
+	spool          *Spool
+	breaker        *CircuitBreaker
+	flushSize      int
+	flushInterval  time.Duration
+	maxEvents      int
+	poisonAttempts int
+
+	mu       sync.Mutex // Serializes Add against sealing and Close
+	closed   bool
+	reserved int        // Events reserved by requests still being mapped
+	released *sync.Cond // Signaled when reserved drops, see Close
+
+	deliverMu sync.Mutex // Held while a segment is delivered or purged
+
+	ready   <-chan struct{} // Closed once ClickHouse can take inserts
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewIngestBuffer creates the buffer and starts its seal and drain loops.
+func NewIngestBuffer(ch clickhouse.Conn, dlq *DeadLetterQueue, dedup *DedupWindow, spool *Spool, breaker *CircuitBreaker, flushSize int, flushInterval time.Duration, maxEvents, poisonAttempts int, ready <-chan struct{}) *IngestBuffer {
+	if maxEvents < flushSize {
+		maxEvents = flushSize
+	}
+	b := &IngestBuffer{
+		ch:             ch,
+		dlq:            dlq,
+		dedup:          dedup,
+		spool:          spool,
+		breaker:        breaker,
+		flushSize:      flushSize,
+		flushInterval:  flushInterval,
+		maxEvents:      maxEvents,
+		poisonAttempts: max(poisonAttempts, 1),
+		ready:          ready,
+		wake:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	b.released = sync.NewCond(&b.mu)
+	go b.run()
+	return b
+}
+
+// Reserve claims room for n events. Once it succeeds, Add of up to n events
+// cannot fail for lack of space or because the buffer closed; the caller
+// must hand the reservation back through Add.
+func (b *IngestBuffer) Reserve(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBufferClosed
+	}
+	if b.spool.Pending()+b.reserved+n > b.maxEvents {
+		return ErrBufferFull
+	}
+	b.reserved += n
+	return nil
+}
+
+// unreserve drops n reserved events. Caller holds mu.
+func (b *IngestBuffer) unreserve(n int) {
+	b.reserved -= n
+	b.released.Broadcast()
+}
+
+// Add durably spools events within a reservation of reserved events (see
+// Reserve), which it releases. Either all events are accepted or none; only
+// a spool write error can reject them. Accepted event IDs are committed to
+// the dedup window right away: from here on delivery is the drainer's job.
+func (b *IngestBuffer) Add(events []BufferedEvent, reserved int) error {
+	records := make([]SpoolRecord, len(events))
+	for i, be := range events {
+		records[i] = SpoolRecord{EventID: be.EventID, Event: be.Event, Payload: be.Payload, Link: be.Link}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.unreserve(reserved)
+
+	if len(events) == 0 {
+		return nil
+	}
+	if err := b.spool.Append(records); err != nil {
+		return err
+	}
+	metricSpoolPending.Set(float64(b.spool.Pending()))
+
+	if err := b.dedup.Commit(eventIDs(events)); err != nil {
+		log.Printf("Failed to commit %d event IDs to dedup window: %v", len(events), err)
+	}
+
+	if b.spool.ActiveCount() >= b.flushSize {
+		if err := b.spool.Seal(); err != nil {
+			log.Printf("Spool: seal failed: %v", err)
+		}
+		b.notify()
+	}
+	return nil
+}
+
+// Close stops accepting events, stops the drainer and seals the active
+// segment. Undelivered segments stay on disk and are drained after restart.
+func (b *IngestBuffer) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	for b.reserved > 0 { // Requests being mapped still spool their events
+		b.released.Wait()
+	}
+	b.mu.Unlock()
+
+	close(b.done)
+	<-b.stopped
+
+	if err := b.spool.Close(); err != nil {
+		log.Printf("Spool: close failed: %v", err)
+	}
+}
+
+// notify wakes the drainer without blocking.
+func (b *IngestBuffer) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run seals the active segment by age and, once ClickHouse is ready,
+// drains sealed segments.
+func (b *IngestBuffer) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	ready := b.ready
+	for {
+		if ready == nil && !b.drain() {
+			return
+		}
+
+		select {
+		case <-ready:
+			ready = nil
+		case <-b.wake:
+		case <-ticker.C:
+			b.mu.Lock()
+			err := b.spool.Seal()
+			b.mu.Unlock()
+			if err != nil {
+				log.Printf("Spool: seal failed: %v", err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// drain delivers sealed segments until none are left. Returns false on shutdown.
+func (b *IngestBuffer) drain() bool {
+	delay := flushRetryMin
+	var poisonSeq uint64 // Segment ClickHouse keeps rejecting
+	rejections := 0
+	for {
+		seg, ok := b.spool.Oldest()
+		if !ok {
+			return true
+		}
+
+		if allowed, wait := b.breaker.Allow(); !allowed {
+			if !b.sleep(wait) {
+				return false
+			}
+			continue
+		}
+
+		split := seg.Seq == poisonSeq && rejections >= b.poisonAttempts
+		b.deliverMu.Lock()
+		err := b.deliver(seg, split)
+		b.deliverMu.Unlock()
+		metricSpoolPending.Set(float64(b.spool.Pending()))
+		if err == nil {
+			b.breaker.Success()
+			metricBreakerOpen.Set(0)
+			delay = flushRetryMin
+			continue
+		}
+
+		if isRejection(err) {
+			// ClickHouse answered, so the circuit stays closed; after
+			// poisonAttempts the segment is inserted in parts (see deliver)
+			b.breaker.Success()
+			metricBreakerOpen.Set(0)
+			if seg.Seq != poisonSeq {
+				poisonSeq, rejections = seg.Seq, 0
+			}
+			rejections++
+			if rejections == b.poisonAttempts {
+				log.Printf("ClickHouse rejected spool segment %d %d times, isolating the events it rejects", seg.Seq, rejections)
+			}
+		} else if b.breaker.Failure() {
+			metricBreakerOpen.Set(1)
+			log.Printf("Failed to deliver spool segment %d (%d events), circuit open: %v", seg.Seq, seg.Count, err)
+			continue
+		}
+		log.Printf("Failed to deliver spool segment %d (%d events), retry in %s: %v", seg.Seq, seg.Count, delay, err)
+		if !b.sleep(delay) {
+			return false
+		}
+		delay *= 2
+		if delay > flushRetryMax {
+			delay = flushRetryMax
+		}
+	}
+}
+
+// Purge removes the spooled events match selects (privacy erasure) and
+// returns how many were removed. The active segment is sealed first, so every
+// event accepted before the call is checked; a segment being delivered is
+// purged once its delivery ended, so its events are either in ClickHouse or
+// purged.
+func (b *IngestBuffer) Purge(match func(*Event) bool) (int, error) {
+	b.mu.Lock()
+	err := b.spool.Seal()
+	b.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	b.deliverMu.Lock()
+	defer b.deliverMu.Unlock()
+	purged := 0
+	for _, seg := range b.spool.Sealed() {
+		records, bad, err := readSegment(seg.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Delivered since the list was taken
+		}
+		if err != nil {
+			return purged, err
+		}
+		kept := make([]SpoolRecord, 0, len(records))
+		for _, rec := range records {
+			if !match(rec.Event) {
+				kept = append(kept, rec)
+			}
+		}
+		if len(kept) == len(records) {
+			continue
+		}
+		if len(bad) > 0 {
+			// Rewrite drops them; the drainer would have dead-lettered them
+			if seg, err = b.dropUndecodable(seg, records, bad); err != nil {
+				return purged, err
+			}
+		}
+		if _, err := b.spool.Rewrite(seg, kept); err != nil {
+			return purged, err
+		}
+		purged += len(records) - len(kept)
+	}
+	metricSpoolPending.Set(float64(b.spool.Pending()))
+	return purged, nil
+}
+
+// sleep waits for d or until shutdown. Returns false on shutdown.
+func (b *IngestBuffer) sleep(d time.Duration) bool {
+	select {
+	case <-b.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// deliver inserts one sealed segment and removes it from the spool.
+// Undecodable records are dead-lettered first. With split, the segment is
+// inserted in halves down to single events and the events ClickHouse still
+// rejects on their own are dead-lettered; if a later part fails otherwise,
+// the segment is rewritten with the events not yet inserted.
+func (b *IngestBuffer) deliver(seg Segment, split bool) error {
+	records, bad, err := readSegment(seg.Path)
+	if err != nil {
+		return err
+	}
+	if len(bad) > 0 {
+		if seg, err = b.dropUndecodable(seg, records, bad); err != nil {
+			return err
+		}
+	}
+
+	events := make([]BufferedEvent, len(records))
+	for i, rec := range records {
+		events[i] = BufferedEvent{Event: rec.Event, EventID: rec.EventID, Payload: rec.Payload, Link: rec.Link}
+	}
+	if !split {
+		if err := b.flush(events); err != nil {
+			return err
+		}
+		return b.spool.Remove(seg)
+	}
+
+	done, err := b.isolate(events)
+	if err != nil {
+		if done > 0 {
+			if _, rerr := b.spool.Rewrite(seg, records[done:]); rerr != nil {
+				log.Printf("Spool: rewrite of segment %d failed, %d events will be inserted again: %v", seg.Seq, done, rerr)
+			}
+		}
+		return err
+	}
+	return b.spool.Remove(seg)
+}
+
+// dropUndecodable dead-letters records of seg that could not be decoded and
+// rewrites the segment without them.
+func (b *IngestBuffer) dropUndecodable(seg Segment, records []SpoolRecord, bad [][]byte) (Segment, error) {
+	dead := make([]DeadLetter, len(bad))
+	for i, data := range bad {
+		dead[i] = newDeadLetter(StageSpool, data, errors.New("undecodable spool record"))
+	}
+	if err := b.dlq.Write(context.Background(), dead); err != nil {
+		return seg, fmt.Errorf("dead-letter %d undecodable records: %w", len(bad), err)
+	}
+	metricEventsSkipped.WithLabelValues(skipSpool).Add(float64(len(bad)))
+	log.Printf("Spool: dead-lettered %d undecodable records of segment %d", len(bad), seg.Seq)
+	return b.spool.Rewrite(seg, records)
+}
+
+// isolate inserts events, halving the batch on each rejection; a single
+// event that is still rejected is dead-lettered. It stops at the first
+// other error and returns how many leading events were dealt with.
+func (b *IngestBuffer) isolate(events []BufferedEvent) (int, error) {
+	err := b.flush(events)
+	if err == nil {
+		return len(events), nil
+	}
+	if !isRejection(err) {
+		return 0, err
+	}
+	if len(events) == 1 {
+		be := events[0]
+		log.Printf("ClickHouse rejected event %s: %v", be.EventID, err)
+		if dlqErr := b.dlq.Write(context.Background(), []DeadLetter{newDeadLetter(StageInsert, be.Payload, err)}); dlqErr != nil {
+			return 0, dlqErr
+		}
+		metricEventsSkipped.WithLabelValues(skipInsert).Inc()
+		return 1, nil
+	}
+
+	mid := len(events) / 2
+	done, err := b.isolate(events[:mid])
+	if err != nil {
+		return done, err
+	}
+	rest, err := b.isolate(events[mid:])
+	return mid + rest, err
+}
+
+// clickhouseTransientCodes are server error codes that say nothing about
+// the data: limits, timeouts, replication, authentication, and tables or
+// columns missing until migrations ran. Inserts failing with them are
+// retried as they are.
+var clickhouseTransientCodes = map[int32]bool{
+	3:   true, // UNEXPECTED_END_OF_FILE
+	16:  true, // NO_SUCH_COLUMN_IN_TABLE
+	60:  true, // UNKNOWN_TABLE
+	81:  true, // UNKNOWN_DATABASE
+	159: true, // TIMEOUT_EXCEEDED
+	164: true, // READONLY
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	203: true, // NO_FREE_CONNECTION
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	225: true, // NO_ZOOKEEPER
+	236: true, // ABORTED
+	241: true, // MEMORY_LIMIT_EXCEEDED
+	242: true, // TABLE_IS_READ_ONLY
+	252: true, // TOO_MANY_PARTS
+	319: true, // UNKNOWN_STATUS_OF_INSERT
+	394: true, // QUERY_WAS_CANCELLED
+	425: true, // SYSTEM_ERROR
+	439: true, // CANNOT_SCHEDULE_TASK
+	473: true, // DEADLOCK_AVOIDED
+	497: true, // ACCESS_DENIED
+	516: true, // AUTHENTICATION_FAILED
+	999: true, // KEEPER_EXCEPTION
+}
+
+// clickhouseCodePattern finds the error code in an HTTP error body.
+var clickhouseCodePattern = regexp.MustCompile(`Code: (\d+)`)
+
+// isRejection reports whether ClickHouse answered an insert with an error
+// about the data itself, as opposed to being unreachable or overloaded.
+func isRejection(err error) bool {
+	var ex *clickhouse.Exception
+	if errors.As(err, &ex) {
+		return !clickhouseTransientCodes[ex.Code]
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "[HTTP ") {
+		return false
+	}
+	m := clickhouseCodePattern.FindStringSubmatch(msg)
+	if m == nil {
+		return false // Proxy or load balancer error
+	}
+	code, err := strconv.ParseInt(m[1], 10, 32)
+	return err == nil && !clickhouseTransientCodes[int32(code)]
+}
+
+// flush inserts one batch. Events that fail to append are dead-lettered.
+// Identity links and ecommerce items go first: if the event insert fails,
+// the retry re-inserts them, which their tables deduplicate. The events
+// insert is deduplicated by its token (see insertDedupContext).
+func (b *IngestBuffer) flush(batch []BufferedEvent) error {
+	ctx := context.Background()
+
+	if err := insertIdentityLinks(ctx, b.ch, batch); err != nil {
+		return err
+	}
+
+	// A retry carries the same token, so events of an insert that was
+	// committed despite an error are not written twice
+	chBatch, err := b.ch.PrepareBatch(insertDedupContext(ctx, eventIDs(batch)), insertEventsQuery)
+	if err != nil {
+		return err
+	}
+
+	var dead []DeadLetter
+	appended := make([]*Event, 0, len(batch))
+	for _, be := range batch {
+		if err := appendEvent(chBatch, be.Event); err != nil {
+			log.Printf("Failed to append event %s to batch: %v", be.EventID, err)
+			dead = append(dead, newDeadLetter(StageAppend, be.Payload, err))
+			continue
+		}
+		appended = append(appended, be.Event)
+	}
+	sent := len(appended)
+
+	if err := insertEventItems(ctx, b.ch, appended); err != nil {
+		chBatch.Abort()
+		return err
+	}
+
+	if sent > 0 {
+		start := time.Now()
+		if err := chBatch.Send(); err != nil {
+			metricSendSeconds.WithLabelValues("error").Observe(time.Since(start).Seconds())
+			return err
+		}
+		metricSendSeconds.WithLabelValues("ok").Observe(time.Since(start).Seconds())
+		metricBatchSize.Observe(float64(sent))
+		// Counted once the batch is in: a failed flush appends the same events again on retry
+		metricEventsAppended.Add(float64(sent))
+		metricEventsSent.Add(float64(sent))
+	}
+	metricEventsSkipped.WithLabelValues(skipAppend).Add(float64(len(dead)))
+
+	if err := b.dlq.Write(ctx, dead); err != nil {
+		log.Printf("Failed to write %d entries to DLQ: %v", len(dead), err)
+	}
+	return nil
+}
+
+// eventIDs lists the event IDs of buffered events.
+func eventIDs(events []BufferedEvent) []string {
+	ids := make([]string, len(events))
+	for i, be := range events {
+		ids[i] = be.EventID
+	}
+	return ids
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIngestBufferPurge(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ClickHouse never becomes ready, so nothing is drained
+	b := NewIngestBuffer(nil, nil, nil, spool, nil, 100, time.Hour, 1000, 1, make(chan struct{}))
+	defer b.Close()
+
+	record := func(id, visitor, user string) SpoolRecord {
+		return SpoolRecord{EventID: id, Event: &Event{IDs: map[string]string{"visitor_id": visitor, "user_id": user}}}
+	}
+	if err := spool.Append([]SpoolRecord{record("1", "v1", ""), record("2", "v2", "")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	// Still in the active segment
+	if err := spool.Append([]SpoolRecord{record("3", "v1", "u1"), record("4", "v1", "u2"), record("5", "v3", "u1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := b.Purge(subjectEvents([]string{"v1"}, []string{"u1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 3 {
+		t.Errorf("purged %d events, want 3", purged)
+	}
+
+	var left []string
+	for _, seg := range spool.Sealed() {
+		records, _, err := readSegment(seg.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range records {
+			left = append(left, rec.EventID)
+		}
+	}
+	// v1's event logged in as u2 is someone else's
+	if want := []string{"2", "4"}; len(left) != len(want) || left[0] != want[0] || left[1] != want[1] {
+		t.Errorf("left %v, want %v", left, want)
+	}
+	if got := spool.Pending(); got != 2 {
+		t.Errorf("Pending = %d, want 2", got)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultURLRulesJSON is the bundled normalization config, used unless URL_RULES is set.
+//
+//go:embed urls.json
+var defaultURLRulesJSON []byte
+
+// URLRulesFile is the URL normalization config.
+//
+//   - lowercase_host / strip_www: "WWW.Example.com" → "example.com".
+//   - lowercase_path: "/Pricing" → "/pricing".
+//   - strip_trailing_slash: "/pricing/" → "/pricing" (the root stays "/").
+//   - index_files: last path segments folded into their directory
+//     ("/docs/index.html" → "/docs").
+//   - hash_routes: fragments starting with "/" or "!/" are SPA routes and
+//     are appended to the path ("/app/#/settings" → "/app/settings"); other
+//     fragments (anchors) are dropped.
+//   - tracking_params: query params removed; a trailing "*" matches a prefix
+//     ("utm_*").
+//   - allowed_params: if not empty, the only query params kept.
+//   - sites: per-host allowed_params (the host and its subdomains, longest
+//     match wins), replacing the global list.
+type URLRulesFile struct {
+	LowercaseHost      bool                    `json:"lowercase_host"`
+	StripWWW           bool                    `json:"strip_www"`
+	LowercasePath      bool                    `json:"lowercase_path"`
+	StripTrailingSlash bool                    `json:"strip_trailing_slash"`
+	IndexFiles         []string                `json:"index_files"`
+	HashRoutes         bool                    `json:"hash_routes"`
+	TrackingParams     []string                `json:"tracking_params"`
+	AllowedParams      []string                `json:"allowed_params"`
+	Sites              map[string]URLSiteRules `json:"sites"`
+}
+
+// URLSiteRules are the per-site overrides of URLRulesFile.
+type URLSiteRules struct {
+	AllowedParams []string `json:"allowed_params"`
+}
+
+// URLRules is a compiled normalization config.
+type URLRules struct {
+	lowercaseHost      bool
+	stripWWW           bool
+	lowercasePath      bool
+	stripTrailingSlash bool
+	indexFiles         map[string]bool
+	hashRoutes         bool
+	trackingParams     map[string]bool
+	trackingPrefixes   []string
+	allowedParams      map[string]bool // nil keeps every non-tracking param
+	sites              []urlSite       // Longest domain first
+}
+
+type urlSite struct {
+	domain  string
+	allowed map[string]bool
+}
+
+// ParseURLRules compiles a URL normalization config.
+func ParseURLRules(data []byte) (*URLRules, error) {
+	var file URLRulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	r := &URLRules{
+		lowercaseHost:      file.LowercaseHost,
+		stripWWW:           file.StripWWW,
+		lowercasePath:      file.LowercasePath,
+		stripTrailingSlash: file.StripTrailingSlash,
+		indexFiles:         make(map[string]bool, len(file.IndexFiles)),
+		hashRoutes:         file.HashRoutes,
+		trackingParams:     make(map[string]bool, len(file.TrackingParams)),
+		allowedParams:      paramSet(file.AllowedParams),
+	}
+	for _, name := range lowerAll(file.IndexFiles) {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid index file %q", name)
+		}
+		r.indexFiles[name] = true
+	}
+	for _, p := range lowerAll(file.TrackingParams) {
+		switch {
+		case p == "" || p == "*":
+			return nil, fmt.Errorf("invalid tracking param %q", p)
+		case strings.HasSuffix(p, "*"):
+			r.trackingPrefixes = append(r.trackingPrefixes, strings.TrimSuffix(p, "*"))
+		default:
+			r.trackingParams[p] = true
+		}
+	}
+	for domain, site := range file.Sites {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			return nil, fmt.Errorf("empty site domain")
+		}
+		r.sites = append(r.sites, urlSite{domain: domain, allowed: paramSet(site.AllowedParams)})
+	}
+	sort.Slice(r.sites, func(i, j int) bool {
+		if len(r.sites[i].domain) != len(r.sites[j].domain) {
+			return len(r.sites[i].domain) > len(r.sites[j].domain)
+		}
+		return r.sites[i].domain < r.sites[j].domain
+	})
+	return r, nil
+}
+
+// paramSet returns the lowercased names as a set, nil for an empty list.
+func paramSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range lowerAll(names) {
+		set[name] = true
+	}
+	return set
+}
+
+// LoadURLRules reads a URL normalization config from a file.
+func LoadURLRules(path string) (*URLRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ParseURLRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// CanonicalURL is the normalized form of a page URL.
+type CanonicalURL struct {
+	Host string
+	Path string
+	URL  string // scheme://host/path?query, tracking params removed
+}
+
+// Canonicalize normalizes a page URL. ok is false when the URL cannot be
+// parsed or has no host.
+func (r *URLRules) Canonicalize(rawURL string) (c CanonicalURL, ok bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return c, false
+	}
+
+	c.Host = r.canonicalHost(u)
+
+	path, query := u.Path, u.Query()
+	if r.hashRoutes {
+		if route, ok := hashRoute(u.Fragment); ok {
+			routePath, routeQuery, _ := strings.Cut(route, "?")
+			path = strings.TrimSuffix(path, "/") + routePath
+			if values, err := url.ParseQuery(routeQuery); err == nil {
+				for k, v := range values {
+					query[k] = append(query[k], v...)
+				}
+			}
+		}
+	}
+	c.Path = r.CanonicalPath(path)
+
+	allowed := r.allowedParams
+	for _, site := range r.sites {
+		if matchDomain(c.Host, site.domain) {
+			allowed = site.allowed
+			break
+		}
+	}
+	for name := range query {
+		lower := strings.ToLower(name)
+		if r.isTrackingParam(lower) || (allowed != nil && !allowed[lower]) {
+			delete(query, name)
+		}
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" {
+		scheme = "https"
+	}
+	c.URL = scheme + "://" + c.Host + c.Path
+	if len(query) > 0 {
+		c.URL += "?" + query.Encode() // Sorted by key
+	}
+	return c, true
+}
+
+// canonicalHost lowercases the host, drops the default port and "www.".
+func (r *URLRules) canonicalHost(u *url.URL) string {
+	host := u.Host
+	if h, port, err := net.SplitHostPort(host); err == nil && (port == "80" || port == "443") {
+		host = h
+	}
+	if r.lowercaseHost {
+		host = strings.ToLower(host)
+	}
+	if r.stripWWW && len(host) > 4 && strings.EqualFold(host[:4], "www.") {
+		host = host[4:]
+	}
+	return host
+}
+
+// CanonicalPath normalizes a URL path: duplicate slashes, case, index
+// files and the trailing slash.
+func (r *URLRules) CanonicalPath(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if r.lowercasePath {
+		path = strings.ToLower(path)
+	}
+	if i := strings.LastIndexByte(path, '/'); r.indexFiles[strings.ToLower(path[i+1:])] {
+		path = path[:i+1]
+	}
+	if r.stripTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	return path
+}
+
+func (r *URLRules) isTrackingParam(name string) bool {
+	if r.trackingParams[name] {
+		return true
+	}
+	for _, prefix := range r.trackingPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashRoute returns the route of an SPA hash URL ("#/settings", "#!/settings").
+func hashRoute(fragment string) (string, bool) {
+	fragment = strings.TrimPrefix(fragment, "!")
+	if !strings.HasPrefix(fragment, "/") {
+		return "", false
+	}
+	return fragment, true
+}
+
+// CanonicalEnricher adds page.host_canonical, page.path_canonical and
+// page.url_canonical; page.url, host and path keep the raw values. It runs
+// after redact so masked values stay masked.
+type CanonicalEnricher struct {
+	rules *URLRules
+}
+
+// NewCanonicalEnricher creates the canonical enricher with the given rules.
+// The registered one uses the bundled rules.
+func NewCanonicalEnricher(rules *URLRules) *CanonicalEnricher {
+	return &CanonicalEnricher{rules: rules}
+}
+
+func mustParseURLRules(data []byte) *URLRules {
+	r, err := ParseURLRules(data)
+	if err != nil {
+		panic(fmt.Sprintf("bundled URL rules: %v", err))
+	}
+	return r
+}
+
+func (en *CanonicalEnricher) Name() string { return "canonical" }
+
+func (en *CanonicalEnricher) Enrich(in *EnrichInput, e *Event) error {
+	if c, ok := en.rules.Canonicalize(e.Page["url"]); ok {
+		e.Page["host_canonical"] = c.Host
+		e.Page["path_canonical"] = c.Path
+		e.Page["url_canonical"] = c.URL
+		return nil
+	}
+	// Events without a full URL (e.g. server-side) still get a canonical path
+	if path := e.Page["path"]; path != "" {
+		e.Page["path_canonical"] = en.rules.CanonicalPath(path)
+	}
+	return nil
+}
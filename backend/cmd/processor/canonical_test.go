@@ -0,0 +1,140 @@
+package main
+
+import "testing"
+
+func TestCanonicalizeBundledRules(t *testing.T) {
+	r := mustParseURLRules(defaultURLRulesJSON)
+	tests := []struct {
+		name, url        string
+		host, path, want string
+	}{
+		{"lowercase host, strip www", "https://WWW.Example.COM/", "example.com", "/", "https://example.com/"},
+		{"root without slash", "https://example.com", "example.com", "/", "https://example.com/"},
+		{"default port", "https://example.com:443/a", "example.com", "/a", "https://example.com/a"},
+		{"other port kept", "http://example.com:8080/a", "example.com:8080", "/a", "http://example.com:8080/a"},
+		{"lowercase path", "https://example.com/Pricing", "example.com", "/pricing", "https://example.com/pricing"},
+		{"trailing slash", "https://example.com/pricing/", "example.com", "/pricing", "https://example.com/pricing"},
+		{"duplicate slashes", "https://example.com//docs///api//", "example.com", "/docs/api", "https://example.com/docs/api"},
+		{"index file", "https://example.com/Docs/Index.HTML", "example.com", "/docs", "https://example.com/docs"},
+		{"root index file", "https://example.com/index.php", "example.com", "/", "https://example.com/"},
+		{"not an index file", "https://example.com/docs/index.json", "example.com", "/docs/index.json", "https://example.com/docs/index.json"},
+		{"hash route", "https://example.com/app/#/Settings/", "example.com", "/app/settings", "https://example.com/app/settings"},
+		{"hashbang route", "https://example.com/#!/cart", "example.com", "/cart", "https://example.com/cart"},
+		{"hash route query", "https://example.com/app#/search?q=shoes&utm_source=x", "example.com", "/app/search", "https://example.com/app/search?q=shoes"},
+		{"anchor dropped", "https://example.com/docs#install", "example.com", "/docs", "https://example.com/docs"},
+		{"tracking params", "https://example.com/p?utm_source=x&UTM_Medium=y&gclid=1&fbclid=2&hsCtaTracking=3", "example.com", "/p", "https://example.com/p"},
+		{"other params kept, sorted", "https://example.com/p?size=m&color=red&utm_id=7", "example.com", "/p", "https://example.com/p?color=red&size=m"},
+		{"no scheme default", "//example.com/a", "example.com", "/a", "https://example.com/a"},
+	}
+	for _, tt := range tests {
+		c, ok := r.Canonicalize(tt.url)
+		if !ok {
+			t.Errorf("%s: Canonicalize(%q) failed", tt.name, tt.url)
+			continue
+		}
+		if c.Host != tt.host || c.Path != tt.path || c.URL != tt.want {
+			t.Errorf("%s: Canonicalize(%q) = %+v, want host %q, path %q, URL %q", tt.name, tt.url, c, tt.host, tt.path, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "not a url", "/relative/path", "https://exa mple.com/"} {
+		if c, ok := r.Canonicalize(bad); ok {
+			t.Errorf("Canonicalize(%q) = %+v, want failure", bad, c)
+		}
+	}
+}
+
+// TestCanonicalizeCollapses checks that the variants of one page share one
+// canonical form.
+func TestCanonicalizeCollapses(t *testing.T) {
+	r := mustParseURLRules(defaultURLRulesJSON)
+	variants := []string{
+		"https://example.com/pricing",
+		"https://example.com/Pricing",
+		"https://example.com/pricing/",
+		"https://example.com/pricing?utm_source=x&fbclid=y",
+		"https://www.example.com/PRICING/?gclid=1#plans",
+		"https://example.com/pricing/index.html",
+		"https://example.com/#/pricing",
+	}
+	for _, v := range variants {
+		c, ok := r.Canonicalize(v)
+		if !ok || c.Path != "/pricing" || c.URL != "https://example.com/pricing" {
+			t.Errorf("Canonicalize(%q) = %+v, %v; want /pricing", v, c, ok)
+		}
+	}
+}
+
+func TestCanonicalizeCustomRules(t *testing.T) {
+	// Every rule off
+	r, err := ParseURLRules([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := r.Canonicalize("https://WWW.Example.com/Pricing/index.html?utm_source=x#/route"); c.URL != "https://WWW.Example.com/Pricing/index.html?utm_source=x" {
+		t.Errorf("rules off: URL = %q, want it unchanged but for the fragment", c.URL)
+	}
+
+	r, err = ParseURLRules([]byte(`{
+		"tracking_params": ["ref", "ga_*"],
+		"allowed_params": ["q", "page", "ref"],
+		"sites": {
+			"example.com": {"allowed_params": ["page"]},
+			"Shop.Example.com": {"allowed_params": ["SKU"]},
+			"open.example.com": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ url, want string }{
+		{"https://other.org/s?q=1&page=2&x=3&ref=a", "https://other.org/s?page=2&q=1"},
+		{"https://example.com/s?q=1&page=2", "https://example.com/s?page=2"},
+		{"https://blog.example.com/s?q=1&page=2", "https://blog.example.com/s?page=2"},
+		{"https://shop.example.com/p?sku=1&page=2", "https://shop.example.com/p?sku=1"}, // Longest site wins
+		{"https://open.example.com/?a=1&ga_x=2", "https://open.example.com/?a=1"},       // No list: all but tracking
+		{"https://notexample.com/s?q=1&page=2", "https://notexample.com/s?page=2&q=1"},
+	}
+	for _, tt := range tests {
+		if c, _ := r.Canonicalize(tt.url); c.URL != tt.want {
+			t.Errorf("Canonicalize(%q) = %q, want %q", tt.url, c.URL, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"index_files": ["docs/index.html"]}`,
+		`{"index_files": [""]}`,
+		`{"tracking_params": ["*"]}`,
+		`{"tracking_params": [""]}`,
+		`{"sites": {" ": {}}}`,
+		`{"strip_www": "yes"}`,
+	} {
+		if _, err := ParseURLRules([]byte(bad)); err == nil {
+			t.Errorf("ParseURLRules(%s) accepted an invalid config", bad)
+		}
+	}
+}
+
+func TestCanonicalEnricher(t *testing.T) {
+	en := NewCanonicalEnricher(mustParseURLRules(defaultURLRulesJSON))
+
+	e := &Event{Page: map[string]string{"url": "https://www.example.com/Pricing/?utm_source=x", "path": "/Pricing/"}}
+	if err := en.Enrich(nil, e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Page["host_canonical"] != "example.com" || e.Page["path_canonical"] != "/pricing" || e.Page["url_canonical"] != "https://example.com/pricing" {
+		t.Errorf("page = %v", e.Page)
+	}
+	if e.Page["url"] != "https://www.example.com/Pricing/?utm_source=x" || e.Page["path"] != "/Pricing/" {
+		t.Error("raw page fields were rewritten")
+	}
+
+	// Without a full URL only the path is normalized
+	e = &Event{Page: map[string]string{"path": "/Docs/Index.html"}}
+	if err := en.Enrich(nil, e); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Page["url_canonical"]; ok || e.Page["path_canonical"] != "/docs" {
+		t.Errorf("page = %v, want only path_canonical /docs", e.Page)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultChannelRulesJSON is the bundled rule file, used unless CHANNEL_RULES is set.
+//
+//go:embed channels.json
+var defaultChannelRulesJSON []byte
+
+// ChannelRulesFile is the channel-grouping rule file:
+//
+//   - click_ids: URL params and their source name, e.g. {"param": "gclid",
+//     "source": "google"}; an event with a click ID and no explicit source
+//     gets that source and channel "cpc". When a URL has several click IDs,
+//     the first listed wins.
+//   - sources: category → domain → source name. A domain ending with "." matches
+//     any TLD ("google." matches www.google.co.uk); other domains match
+//     themselves and their subdomains. The longest matching domain wins.
+//   - groups: evaluated in order, the first group with a matching condition
+//     wins (this order is the precedence). A condition matches when all of
+//     its fields match; regexes are case-insensitive.
+//   - default_group: used when no group matches.
+type ChannelRulesFile struct {
+	DefaultGroup string                       `json:"default_group"`
+	ClickIDs     []ClickIDRule                `json:"click_ids"`
+	Sources      map[string]map[string]string `json:"sources"`
+	Groups       []struct {
+		Name string             `json:"name"`
+		When []ChannelCondition `json:"when"`
+	} `json:"groups"`
+}
+
+// ClickIDRule maps a click-ID URL param to its source.
+type ClickIDRule struct {
+	Param  string `json:"param"`
+	Source string `json:"source"`
+}
+
+// ChannelCondition matches traffic fields. Empty fields are not checked.
+type ChannelCondition struct {
+	Source   string `json:"source"`   // Regex on traffic.source
+	Medium   string `json:"medium"`   // Regex on traffic.channel (utm_medium)
+	Campaign string `json:"campaign"` // Regex on traffic.campaign
+	Referrer string `json:"referrer"` // Regex on traffic.referrer_host
+	Category string `json:"category"` // Source category from the sources list
+}
+
+// ChannelRules is a compiled rule file.
+type ChannelRules struct {
+	defaultGroup string
+	clickIDs     []clickIDRule
+	domains      []sourceDomain // Longest domain first
+	nameCategory map[string]string
+	groups       []channelGroup
+}
+
+type clickIDRule struct {
+	param  string // url_query_* key
+	source string
+}
+
+type sourceDomain struct {
+	domain   string
+	name     string
+	category string
+}
+
+type channelGroup struct {
+	name string
+	when []compiledCondition
+}
+
+type compiledCondition struct {
+	source, medium, campaign, referrer *regexp.Regexp
+	category                           string
+}
+
+// LoadChannelRules reads a channel rule file.
+func LoadChannelRules(path string) (*ChannelRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := ParseChannelRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// TrafficEnricher parses the referrer and the traffic attribution and assigns
+// the channel group. Registered as "traffic".
+type TrafficEnricher struct {
+	rules *ChannelRules
+}
+
+// NewTrafficEnricher creates the traffic enricher with the given channel
+// rules. The registered one uses the bundled rules.
+func NewTrafficEnricher(rules *ChannelRules) *TrafficEnricher {
+	return &TrafficEnricher{rules: rules}
+}
+
+func (t *TrafficEnricher) Name() string { return "traffic" }
+
+func (t *TrafficEnricher) Enrich(in *EnrichInput, e *Event) error {
+	parseTraffic(in.Raw, in.URLParts, t.rules, e) // Parses traffic AND referrer
+	return nil
+}
+
+func mustParseChannelRules(data []byte) *ChannelRules {
+	rules, err := ParseChannelRules(data)
+	if err != nil {
+		panic(fmt.Sprintf("bundled channel rules: %v", err))
+	}
+	return rules
+}
+
+// ParseChannelRules compiles a rule file.
+func ParseChannelRules(data []byte) (*ChannelRules, error) {
+	var file ChannelRulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field == "click_ids" {
+			return nil, fmt.Errorf("click_ids must be a list of {\"param\", \"source\"} in precedence order: %w", err)
+		}
+		return nil, err
+	}
+
+	rules := &ChannelRules{
+		defaultGroup: file.DefaultGroup,
+		nameCategory: make(map[string]string),
+	}
+
+	seenParams := make(map[string]bool, len(file.ClickIDs))
+	for i, c := range file.ClickIDs {
+		if c.Param == "" || c.Source == "" {
+			return nil, fmt.Errorf("click_ids[%d]: param and source are required", i)
+		}
+		if seenParams[c.Param] {
+			return nil, fmt.Errorf("click_ids: param %q is listed twice", c.Param)
+		}
+		seenParams[c.Param] = true
+		rules.clickIDs = append(rules.clickIDs, clickIDRule{param: "url_query_" + c.Param, source: c.Source})
+	}
+
+	for category, domains := range file.Sources {
+		for domain, name := range domains {
+			key := strings.ToLower(name)
+			if prev, ok := rules.nameCategory[key]; ok && prev != category {
+				return nil, fmt.Errorf("source %q is listed in categories %q and %q", name, prev, category)
+			}
+			rules.nameCategory[key] = category
+			rules.domains = append(rules.domains, sourceDomain{domain: strings.ToLower(domain), name: name, category: category})
+		}
+	}
+	sort.Slice(rules.domains, func(i, j int) bool {
+		a, b := rules.domains[i], rules.domains[j]
+		if len(a.domain) != len(b.domain) {
+			return len(a.domain) > len(b.domain)
+		}
+		return a.domain < b.domain
+	})
+
+	for i, g := range file.Groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("group %d has no name", i)
+		}
+		group := channelGroup{name: g.Name}
+		for _, cond := range g.When {
+			if cond.Category != "" {
+				if _, ok := file.Sources[cond.Category]; !ok {
+					return nil, fmt.Errorf("group %q: unknown category %q", g.Name, cond.Category)
+				}
+			}
+			compiled := compiledCondition{category: cond.Category}
+			var err error
+			for _, f := range []struct {
+				dst **regexp.Regexp
+				src string
+			}{
+				{&compiled.source, cond.Source},
+				{&compiled.medium, cond.Medium},
+				{&compiled.campaign, cond.Campaign},
+				{&compiled.referrer, cond.Referrer},
+			} {
+				if f.src == "" {
+					continue
+				}
+				if *f.dst, err = regexp.Compile("(?i)" + f.src); err != nil {
+					return nil, fmt.Errorf("group %q: %w", g.Name, err)
+				}
+			}
+			group.when = append(group.when, compiled)
+		}
+		rules.groups = append(rules.groups, group)
+	}
+	return rules, nil
+}
+
+// ClickIDSource returns the source of the first listed click ID present in the URL.
+func (r *ChannelRules) ClickIDSource(urlParts map[string]string) string {
+	for _, c := range r.clickIDs {
+		if urlParts[c.param] != "" {
+			return c.source
+		}
+	}
+	return ""
+}
+
+// LookupDomain returns the source name and category of a host, if listed.
+func (r *ChannelRules) LookupDomain(host string) (name, category string) {
+	host = strings.ToLower(host)
+	for _, d := range r.domains {
+		if matchDomain(host, d.domain) {
+			return d.name, d.category
+		}
+	}
+	return "", ""
+}
+
+// Category returns the source category of an event: by source name, then
+// by source as a domain. The referrer host only counts for events without
+// source and medium: UTM params and click IDs take precedence over it.
+func (r *ChannelRules) Category(source, medium, referrerHost string) string {
+	if source != "" {
+		if category, ok := r.nameCategory[strings.ToLower(source)]; ok {
+			return category
+		}
+		_, category := r.LookupDomain(source)
+		return category
+	}
+	if medium == "" && referrerHost != "" {
+		_, category := r.LookupDomain(referrerHost)
+		return category
+	}
+	return ""
+}
+
+// Group returns the channel group of an event's traffic fields.
+func (r *ChannelRules) Group(traffic map[string]string) string {
+	source := traffic["source"]
+	medium := traffic["channel"]
+	campaign := traffic["campaign"]
+	referrer := traffic["referrer_host"]
+	category := r.Category(source, medium, referrer)
+
+	for _, g := range r.groups {
+		for _, c := range g.when {
+			if c.category != "" && c.category != category {
+				continue
+			}
+			if !matchOptional(c.source, source) || !matchOptional(c.medium, medium) ||
+				!matchOptional(c.campaign, campaign) || !matchOptional(c.referrer, referrer) {
+				continue
+			}
+			return g.name
+		}
+	}
+	return r.defaultGroup
+}
+
+func matchOptional(re *regexp.Regexp, val string) bool {
+	return re == nil || re.MatchString(val)
+}
+
+// matchDomain matches a host against a sources list domain (see ChannelRulesFile).
+func matchDomain(host, domain string) bool {
+	if strings.HasSuffix(domain, ".") {
+		return strings.HasPrefix(host, domain) || strings.Contains(host, "."+domain)
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTrafficPrecedence(t *testing.T) {
+	rules := mustParseChannelRules(defaultChannelRulesJSON)
+	tests := []struct {
+		name     string
+		traffic  map[string]interface{} // The tracker's traffic object
+		url      string
+		referrer string
+		source   string
+		channel  string
+		group    string
+	}{
+		{
+			name:   "no attribution",
+			url:    "https://shop.example/",
+			source: "", channel: "", group: "Direct",
+		},
+		{
+			name:    "traffic object beats the URL",
+			traffic: map[string]interface{}{"source": "newsletter", "channel": "email"},
+			url:     "https://shop.example/?utm_source=google&utm_medium=cpc",
+			source:  "newsletter", channel: "email", group: "Email",
+		},
+		{
+			name:   "plain query keys beat utm_*",
+			url:    "https://shop.example/?source=bing&utm_source=google&utm_medium=cpc",
+			source: "bing", channel: "cpc", group: "Paid Search",
+		},
+		{
+			name:     "UTM beats click ID and referrer",
+			url:      "https://shop.example/?utm_source=newsletter&utm_medium=email&gclid=abc",
+			referrer: "https://www.google.com/",
+			source:   "newsletter", channel: "email", group: "Email",
+		},
+		{
+			name:     "UTM medium alone blocks click ID",
+			url:      "https://shop.example/?utm_medium=affiliate&gclid=abc",
+			referrer: "https://www.google.com/",
+			source:   "", channel: "affiliate", group: "Affiliates",
+		},
+		{
+			name:     "click ID beats referrer",
+			url:      "https://shop.example/?gclid=abc",
+			referrer: "https://www.facebook.com/",
+			source:   "google", channel: "cpc", group: "Paid Search",
+		},
+		{
+			name:   "first listed click ID wins",
+			url:    "https://shop.example/?fbclid=a&msclkid=b&gclid=c",
+			source: "google", channel: "cpc", group: "Paid Search",
+		},
+		{
+			name:   "click ID order is the list order, not alphabetical",
+			url:    "https://shop.example/?yclid=a&fbclid=b",
+			source: "yandex", channel: "cpc", group: "Paid Search",
+		},
+		{
+			name:     "search engine referrer",
+			url:      "https://shop.example/",
+			referrer: "https://www.google.co.uk/search?q=shoes",
+			source:   "google", channel: "organic", group: "Organic Search",
+		},
+		{
+			name:     "social referrer",
+			url:      "https://shop.example/",
+			referrer: "https://m.facebook.com/",
+			source:   "m.facebook.com", channel: "referral", group: "Organic Social",
+		},
+		{
+			name:     "unknown referrer",
+			url:      "https://shop.example/",
+			referrer: "https://blog.example.org/post",
+			source:   "blog.example.org", channel: "referral", group: "Referral",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := map[string]interface{}{"referrer": tt.referrer}
+			if tt.traffic != nil {
+				raw["traffic"] = tt.traffic
+			}
+			e := &Event{Traffic: make(map[string]string)}
+			parseTraffic(raw, parseURL(tt.url), rules, e)
+
+			if got := e.Traffic["source"]; got != tt.source {
+				t.Errorf("source = %q, want %q", got, tt.source)
+			}
+			if got := e.Traffic["channel"]; got != tt.channel {
+				t.Errorf("channel = %q, want %q", got, tt.channel)
+			}
+			if got := e.Traffic["channel_group"]; got != tt.group {
+				t.Errorf("channel_group = %q, want %q", got, tt.group)
+			}
+		})
+	}
+}
+
+func TestChannelGroupOrder(t *testing.T) {
+	rules := mustParseChannelRules(defaultChannelRulesJSON)
+	tests := []struct {
+		source, medium, campaign, referrer string
+		want                               string
+	}{
+		{"", "", "", "", "Direct"},
+		{"(direct)", "(none)", "", "", "Direct"},
+		{"google", "cpc", "cross-network", "", "Cross-network"},
+		{"google", "cpc", "fall_shopping", "", "Paid Shopping"}, // Before Paid Search
+		{"amazon", "cpc", "", "", "Paid Shopping"},
+		{"google", "cpc", "", "", "Paid Search"},
+		{"Google", "CPC", "", "", "Paid Search"}, // Case-insensitive
+		{"www.bing.com", "ppc", "", "", "Paid Search"},
+		{"facebook", "paid_social", "", "", "Paid Social"},
+		{"youtube", "cpv", "", "", "Paid Video"},
+		{"partner", "cpm", "", "", "Display"}, // Before Paid Other
+		{"partner", "cpc", "", "", "Paid Other"},
+		{"amazon", "referral", "", "", "Organic Shopping"}, // Before Referral
+		{"facebook", "referral", "", "", "Organic Social"},
+		{"vimeo", "referral", "", "", "Organic Video"},
+		{"google", "organic", "", "", "Organic Search"},
+		{"chatgpt.com", "referral", "", "", "AI Assistants"}, // Before Referral
+		{"newsletter", "email", "", "", "Email"},
+		{"gmail", "referral", "", "", "Email"},
+		{"partner", "affiliate", "", "", "Affiliates"},
+		{"blog.example.org", "referral", "", "", "Referral"},
+		{"podcast", "audio", "", "", "Audio"},
+		{"sms", "text", "", "", "SMS"},
+		{"firebase", "app_open", "", "", "Mobile Push Notifications"},
+		{"partner", "print", "", "", "Unassigned"},
+	}
+
+	for _, tt := range tests {
+		traffic := map[string]string{
+			"source":        tt.source,
+			"channel":       tt.medium,
+			"campaign":      tt.campaign,
+			"referrer_host": tt.referrer,
+		}
+		if got := rules.Group(traffic); got != tt.want {
+			t.Errorf("Group(source=%q medium=%q campaign=%q) = %q, want %q",
+				tt.source, tt.medium, tt.campaign, got, tt.want)
+		}
+	}
+}
+
+func TestParseChannelRulesClickIDOrder(t *testing.T) {
+	rules, err := ParseChannelRules([]byte(`{
+		"click_ids": [
+			{"param": "fbclid", "source": "facebook"},
+			{"param": "gclid", "source": "google"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := parseURL("https://shop.example/?gclid=a&fbclid=b")
+	if got := rules.ClickIDSource(parts); got != "facebook" {
+		t.Errorf("ClickIDSource = %q, want facebook", got)
+	}
+}
+
+func TestParseChannelRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string // Substring of the error
+	}{
+		{
+			name: "click_ids as an object",
+			json: `{"click_ids": {"gclid": "google"}}`,
+			want: "click_ids must be a list",
+		},
+		{
+			name: "duplicate click ID",
+			json: `{"click_ids": [{"param": "gclid", "source": "google"}, {"param": "gclid", "source": "bing"}]}`,
+			want: "listed twice",
+		},
+		{
+			name: "source in two categories",
+			json: `{"sources": {"search": {"google.": "google"}, "social": {"plus.google.com": "google"}}}`,
+			want: "listed in categories",
+		},
+		{
+			name: "source in two categories, different case",
+			json: `{"sources": {"search": {"google.": "Google"}, "social": {"plus.google.com": "google"}}}`,
+			want: "listed in categories",
+		},
+		{
+			name: "unknown category",
+			json: `{"groups": [{"name": "Paid", "when": [{"category": "print"}]}]}`,
+			want: "unknown category",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseChannelRules([]byte(tt.json))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/pamnard/pixel/backend/internal/migrate"
+)
+
+// runCommand dispatches processor subcommands.
+func runCommand(name string, args []string) {
+	switch name {
+	case "replay-dlq":
+		runReplayDLQ(args)
+	case "bench-fingerprint":
+		runBenchFingerprint(args)
+	case "eval-fingerprint":
+		runEvalFingerprint(args)
+	case "migrate":
+		runMigrate(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nCommands:\n"+
+			"  replay-dlq          re-map dead-lettered events and insert them into default.events\n"+
+			"  bench-fingerprint   measure fingerprint index throughput on synthetic data\n"+
+			"  eval-fingerprint    replay labeled events and report fingerprint matching quality\n"+
+			"  migrate             apply, revert or list ClickHouse schema migrations\n", name)
+		os.Exit(2)
+	}
+}
+
+// runMigrate runs the shared `migrate` subcommand (see migrate.Command).
+func runMigrate(args []string) {
+	ch := mustConnectClickHouse(
+		getenv("CLICKHOUSE_HOST", "clickhouse:8123"),
+		getenv("CLICKHOUSE_USER", "default"),
+		getenv("CLICKHOUSE_PASSWORD", ""),
+	)
+	if err := migrate.Command(ch, args); err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+}
+
+// runReplayDLQ re-runs dead-lettered payloads through the current mapping.
+// Entries whose events all map and append successfully are inserted into
+// default.events and removed from the DLQ; the rest are left untouched and
+// listed with their error. Sessions and the identity graph are updated in the
+// processor's Badger DB, so the processor must be stopped while it runs;
+// its dedup window keeps events delivered since from being inserted twice.
+// Fingerprint linking is skipped.
+func runReplayDLQ(args []string) {
+	fs := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	stage := fs.String("stage", "", "only replay entries rejected at this stage (collector, decode, map, append, insert, spool); spool entries are only replayed when named")
+	since := fs.String("since", "", "only replay entries recorded at or after this RFC3339 time")
+	limit := fs.Int("limit", 10000, "maximum number of entries to replay")
+	dryRun := fs.Bool("dry-run", false, "map entries without session and identity state and report the result without writing anything")
+	fs.Parse(args)
+
+	from := time.Unix(0, 0)
+	if *since != "" {
+		parsed, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			log.Fatalf("invalid -since: %v", err)
+		}
+		from = parsed
+	}
+
+	// Replayed events continue their visitors' sessions and identities,
+	// so the state must be the processor's own.
+	var db *badger.DB
+	var dedup *DedupWindow
+	var stateful []Enricher
+	if !*dryRun {
+		badgerPath := getenv("BADGER_PATH", "./badger-data")
+		var err error
+		if db, err = openBadger(badgerPath); err != nil {
+			log.Fatalf("replay-dlq needs the processor's state in BADGER_PATH (%s); stop the processor first: %v", badgerPath, err)
+		}
+		sessions, identityGraph := mustConfigureState(db)
+		stateful = []Enricher{sessions, NewIdentityEnricher(identityGraph)}
+		dedup = NewDedupWindow(db, getenvDuration("DEDUP_WINDOW", 24*time.Hour))
+	}
+	mustConfigureEnrichers(stateful...)
+
+	ch := mustConnectClickHouse(
+		getenv("CLICKHOUSE_HOST", "clickhouse:8123"),
+		getenv("CLICKHOUSE_USER", "default"),
+		getenv("CLICKHOUSE_PASSWORD", ""),
+	)
+
+	err := replayDLQ(context.Background(), ch, dedup, from, *stage, *limit, *dryRun)
+	if db != nil {
+		if cerr := db.Close(); cerr != nil {
+			log.Printf("Failed to close badger: %v", cerr)
+		}
+	}
+	if err != nil {
+		log.Printf("replay-dlq: %v", err)
+		os.Exit(1)
+	}
+}
+
+// dlqEntry is a dead-lettered entry being replayed.
+type dlqEntry struct {
+	id, stage string
+	payload   []byte
+	events    []*Event
+	reserved  []string // Event IDs reserved in the dedup window
+}
+
+// replayDLQ replays the selected entries. Events already delivered within the
+// dedup window are left out, and the replayed ones are committed to it (dedup
+// is nil on a dry run). Entries that still fail to map or append are logged
+// and left in the DLQ; the returned error reports entries that mapped but
+// could not be written or removed.
+func replayDLQ(ctx context.Context, ch clickhouse.Conn, dedup *DedupWindow, from time.Time, stage string, limit int, dryRun bool) error {
+	entries, err := readDeadLetters(ctx, ch, from, stage, limit)
+	if err != nil {
+		return err
+	}
+
+	var ready []*dlqEntry
+	events, failing, duplicates := 0, 0, 0
+	for _, entry := range entries {
+		mapped, err := mapDeadLetter(entry.payload)
+		if err != nil {
+			log.Printf("Entry %s (%s) still fails: %v", entry.id, entry.stage, err)
+			failing++
+			continue
+		}
+		entry.events = mapped
+		duplicates += reserveEntry(dedup, entry)
+		ready = append(ready, entry)
+		events += len(entry.events)
+	}
+	// Reservations not committed below are released
+	if dedup != nil {
+		defer func() {
+			for _, entry := range ready {
+				dedup.Release(entry.reserved)
+			}
+		}()
+	}
+
+	if dryRun {
+		log.Printf("Dry run: %d entries read, %d would be replayed (%d events), %d still failing", len(entries), len(ready), events, failing)
+		return nil
+	}
+
+	batch, batched, err := batchEntries(func() (driver.Batch, error) {
+		return ch.PrepareBatch(ctx, insertEventsQuery)
+	}, ready)
+	if err != nil {
+		return err
+	}
+	failing += len(ready) - len(batched)
+
+	if len(batched) > 0 {
+		var replayedEvents []*Event
+		ids := make([]string, len(batched))
+		for i, entry := range batched {
+			replayedEvents = append(replayedEvents, entry.events...)
+			ids[i] = entry.id
+		}
+		events = len(replayedEvents)
+		if err := insertEventItems(ctx, ch, replayedEvents); err != nil {
+			return fmt.Errorf("insert event items, no events were written: %w", err)
+		}
+		if err := batch.Send(); err != nil {
+			return fmt.Errorf("send batch, no events were written: %w", err)
+		}
+		if dedup != nil {
+			if err := dedup.Commit(eventIDsOf(replayedEvents)); err != nil {
+				log.Printf("Failed to commit %d replayed events to the dedup window: %v", len(replayedEvents), err)
+			}
+		}
+		if err := ch.Exec(ctx, "DELETE FROM default.events_dlq WHERE has(?, id)", ids); err != nil {
+			// A second replay of these entries would insert their events again.
+			return fmt.Errorf("%d entries were inserted but not removed from the DLQ, delete them before replaying again (ids: %s): %w",
+				len(ids), strings.Join(ids, ","), err)
+		}
+	} else {
+		batch.Abort()
+		events = 0
+	}
+
+	log.Printf("Replay: %d entries read, %d replayed (%d events, %d duplicates left out), %d still failing", len(entries), len(batched), events, duplicates, failing)
+	return nil
+}
+
+// reserveEntry reserves the entry's event IDs in the dedup window and leaves
+// out the events already delivered, such as map-stage events whose retry was
+// accepted later. Events of the append, insert and spool stages were committed
+// to the window when they were spooled, so they are not checked. Returns the
+// number of events left out. A nil dedup reserves nothing.
+func reserveEntry(dedup *DedupWindow, entry *dlqEntry) int {
+	if dedup == nil {
+		return 0
+	}
+	switch entry.stage {
+	case StageAppend, StageInsert, StageSpool:
+		return 0
+	}
+	kept := entry.events[:0]
+	for _, e := range entry.events {
+		id := e.IDs["event_id"]
+		if !dedup.Reserve(id) {
+			continue
+		}
+		entry.reserved = append(entry.reserved, id)
+		kept = append(kept, e)
+	}
+	left := len(entry.events) - len(kept)
+	entry.events = kept
+	return left
+}
+
+// batchEntries appends the entries' events to a batch from prepare. An entry
+// whose events fail to append is logged and left out: the batch may hold part
+// of it, so it is rebuilt from the entries before. Returns the batch and the
+// entries it holds.
+func batchEntries(prepare func() (driver.Batch, error), entries []*dlqEntry) (driver.Batch, []*dlqEntry, error) {
+	batch, err := prepare()
+	if err != nil {
+		return nil, nil, fmt.Errorf("prepare batch: %w", err)
+	}
+	var batched []*dlqEntry
+	for _, entry := range entries {
+		err := appendEntry(batch, entry)
+		if err == nil {
+			batched = append(batched, entry)
+			continue
+		}
+		log.Printf("Entry %s (%s) still fails: append: %v", entry.id, entry.stage, err)
+
+		batch.Abort()
+		if batch, err = prepare(); err != nil {
+			return nil, nil, fmt.Errorf("prepare batch: %w", err)
+		}
+		for _, prev := range batched {
+			if err := appendEntry(batch, prev); err != nil {
+				batch.Abort()
+				return nil, nil, fmt.Errorf("entry %s: append failed on the rebuilt batch, nothing was written: %w", prev.id, err)
+			}
+		}
+	}
+	return batch, batched, nil
+}
+
+// eventIDsOf returns the event IDs of mapped events.
+func eventIDsOf(events []*Event) []string {
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.IDs["event_id"]
+	}
+	return ids
+}
+
+// readDeadLetters reads the selected DLQ entries in the order they were
+// recorded. Without a stage, spool entries are left out: their records were
+// damaged on disk and are only replayed when asked for by name.
+func readDeadLetters(ctx context.Context, ch clickhouse.Conn, from time.Time, stage string, limit int) ([]*dlqEntry, error) {
+	rows, err := ch.Query(ctx, `SELECT id, stage, payload FROM default.events_dlq
+		WHERE timestamp >= ? AND ((? = '' AND stage != 'spool') OR stage = ?)
+		ORDER BY timestamp
+		LIMIT ?`, from, stage, stage, limit)
+	if err != nil {
+		return nil, fmt.Errorf("dlq query: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*dlqEntry
+	for rows.Next() {
+		var entry dlqEntry
+		var payload string
+		if err := rows.Scan(&entry.id, &entry.stage, &payload); err != nil {
+			return nil, fmt.Errorf("dlq scan: %w", err)
+		}
+		entry.payload = []byte(payload)
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("dlq rows: %w", err)
+	}
+	return entries, nil
+}
+
+// appendEntry appends an entry's events to the batch.
+func appendEntry(batch driver.Batch, entry *dlqEntry) error {
+	for _, event := range entry.events {
+		if err := appendEvent(batch, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapDeadLetter decodes and maps a dead-lettered payload. It fails if any
+// part of the payload still cannot be processed; filtered events are left out.
+func mapDeadLetter(payload []byte) ([]*Event, error) {
+	rawEvents, elemErrs, err := decodeLine(payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if len(elemErrs) > 0 {
+		return nil, fmt.Errorf("decode: %w", elemErrs[0])
+	}
+
+	events := make([]*Event, 0, len(rawEvents))
+	for _, raw := range rawEvents {
+		event, err := MapToEvent(raw.Data)
+		if errors.Is(err, ErrDropEvent) {
+			continue // Filtered out: nothing to insert
+		}
+		if err != nil {
+			return nil, fmt.Errorf("map: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
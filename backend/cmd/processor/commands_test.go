@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// useReplayChain runs the default chain with a filter dropping the referrer
+// spam.example and a tracking plan rejecting events other than page_view.
+func useReplayChain(t *testing.T) {
+	t.Helper()
+	filter, err := NewFilterEnricher(writePlan(t, "filter.json", `{"blocked_referrers": ["spam.example"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := mustLoadPlan(t, "plan.json", `{"allow_unplanned_events": false, "events": {"page_view": {}}}`)
+	trackingPlan, err := NewTrackingPlanEnricher(plan, PlanModeReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureEnrichers("", filter, trackingPlan); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ConfigureEnrichers("") })
+}
+
+func TestMapDeadLetter(t *testing.T) {
+	useReplayChain(t)
+
+	tests := []struct {
+		name    string
+		payload string
+		want    []string // Event IDs
+		err     string
+	}{
+		{"event", `{"event_id": "e1", "event_name": "page_view"}`, []string{"e1"}, ""},
+		{"line", `[{"event_id": "e1", "event_name": "page_view"}, {"event_id": "e2", "event_name": "page_view"}]`, []string{"e1", "e2"}, ""},
+		{"filtered", `[{"event_id": "e1", "event_name": "page_view", "referrer": "https://spam.example/"}, {"event_id": "e2", "event_name": "page_view"}]`, []string{"e2"}, ""},
+		{"all filtered", `{"event_id": "e1", "event_name": "page_view", "referrer": "https://spam.example/"}`, []string{}, ""},
+		{"not json", `{"event_id": "e1", `, nil, "decode"},
+		{"bad element", `[{"event_id": "e1", "event_name": "page_view"}, 42]`, nil, "decode"},
+		{"rejected", `[{"event_id": "e1", "event_name": "page_view"}, {"event_id": "e2", "event_name": "signup"}]`, nil, "map"},
+	}
+	for _, tt := range tests {
+		events, err := mapDeadLetter([]byte(tt.payload))
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err+":") {
+				t.Errorf("%s: err = %v, want a %s error", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := eventIDsOf(events); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: events = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReplayReserveEntry(t *testing.T) {
+	db := openScratchBadger("")
+	defer db.Close()
+	dedup := NewDedupWindow(db, time.Hour)
+	if err := dedup.Commit([]string{"delivered"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := func(stage string, ids ...string) *dlqEntry {
+		e := &dlqEntry{id: stage, stage: stage}
+		for _, id := range ids {
+			e.events = append(e.events, &Event{IDs: map[string]string{"event_id": id}})
+		}
+		return e
+	}
+
+	mapped := entry(StageMap, "new", "delivered")
+	if left := reserveEntry(dedup, mapped); left != 1 {
+		t.Errorf("map entry: %d events left out, want 1", left)
+	}
+	if got := eventIDsOf(mapped.events); !slices.Equal(got, []string{"new"}) || !slices.Equal(mapped.reserved, []string{"new"}) {
+		t.Errorf("map entry: events %v, reserved %v; want only the new event", got, mapped.reserved)
+	}
+
+	// The same event in a second entry of the run
+	again := entry(StageDecode, "new")
+	if left := reserveEntry(dedup, again); left != 1 || len(again.events) != 0 {
+		t.Errorf("repeated event: %d left out, events %v", left, eventIDsOf(again.events))
+	}
+
+	// Spooled events were committed when they were accepted
+	for _, stage := range []string{StageAppend, StageInsert, StageSpool} {
+		spooled := entry(stage, "delivered")
+		if left := reserveEntry(dedup, spooled); left != 0 || len(spooled.events) != 1 || spooled.reserved != nil {
+			t.Errorf("%s entry: %d left out, events %v, reserved %v", stage, left, eventIDsOf(spooled.events), spooled.reserved)
+		}
+	}
+
+	dryRun := entry(StageMap, "delivered")
+	if left := reserveEntry(nil, dryRun); left != 0 || len(dryRun.events) != 1 {
+		t.Error("nil dedup window left events out")
+	}
+}
+
+// fakeBatch records appended event IDs. Appending an event named "bad"
+// appends its ID and then fails, as a column conversion error midway.
+type fakeBatch struct {
+	driver.Batch
+	ids     []string
+	aborted bool
+}
+
+func (b *fakeBatch) Append(v ...any) error {
+	ids := v[2].(map[string]string)
+	b.ids = append(b.ids, ids["event_id"])
+	if v[1] == "bad" {
+		return errors.New("bad column")
+	}
+	return nil
+}
+
+func (b *fakeBatch) Abort() error {
+	b.aborted = true
+	return nil
+}
+
+func TestReplayBatchEntries(t *testing.T) {
+	entry := func(id string, names ...string) *dlqEntry {
+		e := &dlqEntry{id: id, stage: StageMap}
+		for i, name := range names {
+			e.events = append(e.events, &Event{EventName: name, IDs: map[string]string{"event_id": fmt.Sprintf("%s-%d", id, i)}})
+		}
+		return e
+	}
+	var prepared []*fakeBatch
+	prepare := func() (driver.Batch, error) {
+		b := &fakeBatch{}
+		prepared = append(prepared, b)
+		return b, nil
+	}
+
+	entries := []*dlqEntry{
+		entry("a", "page_view", "page_view"),
+		entry("b", "page_view", "bad"), // Fails after its first event was appended
+		entry("c", "page_view"),
+	}
+	batch, batched, err := batchEntries(prepare, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared) != 2 || !prepared[0].aborted {
+		t.Fatalf("prepared %d batches, first aborted %v; want the batch rebuilt once", len(prepared), len(prepared) > 0 && prepared[0].aborted)
+	}
+	if batch != prepared[1] {
+		t.Error("returned batch is not the rebuilt one")
+	}
+	if got := prepared[1].ids; !slices.Equal(got, []string{"a-0", "a-1", "c-0"}) {
+		t.Errorf("rebuilt batch holds %v, want entries a and c only", got)
+	}
+	if len(batched) != 2 || batched[0].id != "a" || batched[1].id != "c" {
+		t.Errorf("batched entries = %v", batched)
+	}
+
+	// An entry before the failure that no longer appends: nothing is written
+	flaky := entry("d", "page_view")
+	calls := 0
+	_, _, err = batchEntries(func() (driver.Batch, error) {
+		calls++
+		if calls == 1 {
+			return &fakeBatch{}, nil
+		}
+		flaky.events[0].EventName = "bad"
+		return &fakeBatch{}, nil
+	}, []*dlqEntry{flaky, entry("e", "bad")})
+	if err == nil || !strings.Contains(err.Error(), "rebuilt batch") {
+		t.Errorf("err = %v, want the rebuilt batch to fail", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Consent categories read from the event's "consent" object.
+const (
+	consentAnalytics      = "analytics"
+	consentFingerprinting = "fingerprinting"
+	consentGeo            = "geo"
+)
+
+// Values of the events.consent column.
+const (
+	consentGranted = "granted"
+	consentDenied  = "denied"
+
+	consentSourceEvent   = "event"   // The event carried a consent object
+	consentSourceDefault = "default" // Every category fell back to CONSENT_DEFAULT
+)
+
+// ParseConsentDefault parses CONSENT_DEFAULT: granted or denied.
+func ParseConsentDefault(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", consentGranted:
+		return true, nil
+	case consentDenied:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid consent default %q (want granted or denied)", value)
+}
+
+// Consent is the consent state applied to one event.
+type Consent struct {
+	Analytics      bool // Identifiers, sessions and identity graph; otherwise only anonymous fields are kept
+	Fingerprinting bool // Canvas/audio/WebGL/TLS hashes and fingerprint linking
+	Geo            bool // Geo beyond the country
+	FromEvent      bool // At least one category was set by the event
+}
+
+// parseConsent reads the "consent" object of a raw event. A category is
+// granted by true, 1, "granted", "true", "yes" or "1" and denied by their
+// opposites; anything else (or a missing category) uses defaultGranted.
+func parseConsent(raw map[string]interface{}, defaultGranted bool) Consent {
+	c := Consent{Analytics: defaultGranted, Fingerprinting: defaultGranted, Geo: defaultGranted}
+	obj, ok := raw["consent"].(map[string]interface{})
+	if !ok {
+		return c
+	}
+	for name, dst := range map[string]*bool{
+		consentAnalytics:      &c.Analytics,
+		consentFingerprinting: &c.Fingerprinting,
+		consentGeo:            &c.Geo,
+	} {
+		if v, ok := consentValue(obj[name]); ok {
+			*dst = v
+			c.FromEvent = true
+		}
+	}
+	return c
+}
+
+func consentValue(v interface{}) (bool, bool) {
+	switch strings.ToLower(toString(v)) {
+	case "true", "1", "granted", "yes":
+		return true, true
+	case "false", "0", "denied", "no":
+		return false, true
+	}
+	return false, false
+}
+
+// Map returns the value stored in the events.consent column.
+func (c Consent) Map() map[string]string {
+	state := func(granted bool) string {
+		if granted {
+			return consentGranted
+		}
+		return consentDenied
+	}
+	source := consentSourceDefault
+	if c.FromEvent {
+		source = consentSourceEvent
+	}
+	return map[string]string{
+		consentAnalytics:      state(c.Analytics),
+		consentFingerprinting: state(c.Fingerprinting),
+		consentGeo:            state(c.Geo),
+		"source":              source,
+	}
+}
+
+// payloadFields lists raw event keys by the object holding them ("" for the
+// top level).
+type payloadFields map[string][]string
+
+// Raw event keys removed from the stored payload (spool and DLQ) when a
+// consent category is denied, so it keeps no more than the event does.
+var (
+	fingerprintPayload = payloadFields{"device": {"fingerprint", "gpuRenderer"}, "server": {"tls_fingerprint"}}
+	analyticsPayload   = payloadFields{
+		"":       {"visitor_id", "device_id", "user_id", "uid", "session_id", "ip_hash", "data"},
+		"server": {"ip_hash", "real_ip_hash"},
+	}
+	geoPayload = payloadFields{"server": {"region", "city", "postal_code", "latitude", "longitude", "metro_code", "timezone"}}
+)
+
+// stripPayload removes fields from a raw event. It returns the re-encoded
+// event, or nil if there was nothing to remove.
+func stripPayload(raw map[string]interface{}, fields payloadFields) []byte {
+	stripped := false
+	for object, keys := range fields {
+		m := raw
+		if object != "" {
+			var ok bool
+			if m, ok = raw[object].(map[string]interface{}); !ok {
+				continue
+			}
+		}
+		for _, key := range keys {
+			if _, ok := m[key]; ok {
+				delete(m, key)
+				stripped = true
+			}
+		}
+	}
+	if !stripped {
+		return nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// reducePayload removes what analytics and geo consent cover from a raw
+// event after mapping (the enrichers still need them) and returns the
+// payload to store: the re-encoded event, or payload if nothing was removed.
+func reducePayload(raw map[string]interface{}, c Consent, payload []byte) []byte {
+	if !c.Analytics {
+		if stripped := stripPayload(raw, analyticsPayload); stripped != nil {
+			payload = stripped
+		}
+	}
+	if !c.Geo {
+		if stripped := stripPayload(raw, geoPayload); stripped != nil {
+			payload = stripped
+		}
+	}
+	return payload
+}
+
+// anonymousFields are the fields kept on events without analytics consent:
+// nothing that identifies a visitor or links their events together. Tech
+// (performance timings) is kept as is, params are dropped.
+var anonymousFields = map[string]map[string]bool{
+	"ids":     {"event_id": true},
+	"page":    {"host": true, "path": true, "host_canonical": true, "path_canonical": true},
+	"geo":     {"country": true, "continent": true},
+	"traffic": {"source": true, "channel": true, "channel_group": true, "campaign": true, "referrer_host": true},
+	"device": {
+		"device_type": true, "os_name": true, "browser_name": true, "platform": true, "language": true,
+		"is_webview": true, "is_bot": true, "bot_score": true, "bot_reasons": true,
+	},
+}
+
+// ConsentEnricher applies the event's consent state (see parseConsent) and
+// records it in e.Consent. It runs last, after everything that reads the
+// fields it removes. The identity and session enrichers skip events without
+// analytics consent themselves; the fingerprint hashes are removed from the
+// raw event before mapping and the other denied fields from the stored
+// payload after it (see HandleIngest). It also holds CONSENT_DEFAULT, the
+// consent for categories an event does not set.
+type ConsentEnricher struct {
+	defaultGranted bool
+}
+
+// NewConsentEnricher creates the enricher with the consent applied to
+// categories an event does not set.
+func NewConsentEnricher(defaultGranted bool) *ConsentEnricher {
+	return &ConsentEnricher{defaultGranted: defaultGranted}
+}
+
+// activeConsentEnricher returns the active chain's consent enricher, or nil
+// when it is not in the chain.
+func activeConsentEnricher() *ConsentEnricher {
+	c, _ := activeEnricher("consent").(*ConsentEnricher)
+	return c
+}
+
+// DefaultGranted reports the consent for categories an event does not set.
+// Without the consent enricher nothing is removed, so a nil enricher grants.
+func (c *ConsentEnricher) DefaultGranted() bool {
+	return c == nil || c.defaultGranted
+}
+
+func (c *ConsentEnricher) Name() string { return "consent" }
+
+func (c *ConsentEnricher) Enrich(in *EnrichInput, e *Event) error {
+	e.Consent = in.Consent.Map()
+
+	if !in.Consent.Fingerprinting {
+		delete(e.Device, "gpu_renderer")
+	}
+	if !in.Consent.Geo {
+		keepFields(e.Geo, map[string]bool{"country": true, "continent": true, "ip_hash": true})
+	}
+	if !in.Consent.Analytics {
+		keepFields(e.IDs, anonymousFields["ids"])
+		keepFields(e.Page, anonymousFields["page"])
+		keepFields(e.Geo, anonymousFields["geo"])
+		keepFields(e.Traffic, anonymousFields["traffic"])
+		keepFields(e.Device, anonymousFields["device"])
+		clear(e.Params)
+		clear(e.ParamsNum)
+	}
+	for category, state := range e.Consent {
+		if state == consentDenied {
+			metricConsentDenied.WithLabelValues(category).Inc()
+		}
+	}
+	return nil
+}
+
+// keepFields deletes every key of m that is not in keep.
+func keepFields(m map[string]string, keep map[string]bool) {
+	for k := range m {
+		if !keep[k] {
+			delete(m, k)
+		}
+	}
+}
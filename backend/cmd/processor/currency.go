@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// currencyAmountParams are the params converted to the reporting currency.
+var currencyAmountParams = []string{"value", "revenue"}
+
+// Conversion results, used in tech.currency_error and as metric labels.
+const (
+	currencyConverted     = "converted"
+	currencySame          = "same"             // Already in the reporting currency
+	currencyMissing       = "missing_currency" // Amount without params.currency
+	currencyUnknown       = "unknown_currency" // Currency not in the rate table
+	currencyNoRate        = "no_rate"          // No rates on or before the event's day
+	currencyInvalidAmount = "invalid_amount"
+)
+
+// Keys written by the currency enricher.
+const (
+	currencyErrorKey       = "currency_error"     // tech
+	currencyRateDateKey    = "currency_rate_date" // tech
+	currencyOriginalParam  = "currency_original"  // params
+	currencyOriginalSuffix = "_original"          // params value_original, revenue_original
+)
+
+// currencyRateDateLayout is the day format of the rate table.
+const currencyRateDateLayout = "2006-01-02"
+
+// CurrencyRatesFile is the exchange-rate table (CURRENCY_RATES): per UTC day,
+// the units of each currency worth one unit of base.
+//
+//	{
+//	  "base": "EUR",
+//	  "rates": {
+//	    "2026-10-14": {"USD": 1.0921, "GBP": 0.8612},
+//	    "2026-10-15": {"USD": 1.0934, "GBP": 0.8607}
+//	  }
+//	}
+type CurrencyRatesFile struct {
+	Base  string                        `json:"base"`
+	Rates map[string]map[string]float64 `json:"rates"`
+}
+
+// CurrencyRates is a loaded rate table.
+type CurrencyRates struct {
+	base string
+	days []currencyDay // Oldest first
+}
+
+type currencyDay struct {
+	date  time.Time
+	rates map[string]float64 // Units per unit of base; base itself is 1
+}
+
+// ParseCurrencyRates validates a rate table.
+func ParseCurrencyRates(data []byte) (*CurrencyRates, error) {
+	var file CurrencyRatesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	base := strings.ToUpper(strings.TrimSpace(file.Base))
+	if !currencyPattern.MatchString(base) {
+		return nil, fmt.Errorf("invalid base currency %q", file.Base)
+	}
+	if len(file.Rates) == 0 {
+		return nil, fmt.Errorf("no rates")
+	}
+
+	r := &CurrencyRates{base: base}
+	for day, rates := range file.Rates {
+		date, err := time.Parse(currencyRateDateLayout, day)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q: %w", day, err)
+		}
+		d := currencyDay{date: date, rates: map[string]float64{base: 1}}
+		for code, rate := range rates {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if !currencyPattern.MatchString(code) {
+				return nil, fmt.Errorf("%s: invalid currency %q", day, code)
+			}
+			if !(rate > 0) || math.IsInf(rate, 0) {
+				return nil, fmt.Errorf("%s: invalid rate %v for %s", day, rate, code)
+			}
+			d.rates[code] = rate
+		}
+		r.days = append(r.days, d)
+	}
+	sort.Slice(r.days, func(i, j int) bool { return r.days[i].date.Before(r.days[j].date) })
+	return r, nil
+}
+
+// LoadCurrencyRates reads a rate table file.
+func LoadCurrencyRates(path string) (*CurrencyRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rates, err := ParseCurrencyRates(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return rates, nil
+}
+
+// day returns the rates of the last day on or before t, or nil.
+func (r *CurrencyRates) day(t time.Time) *currencyDay {
+	i := sort.Search(len(r.days), func(i int) bool { return r.days[i].date.After(t) })
+	if i == 0 {
+		return nil
+	}
+	return &r.days[i-1]
+}
+
+// Convert returns the factor from currency to target on t's day and the day
+// used. result is currencyConverted, or why there is no factor.
+func (r *CurrencyRates) Convert(currency, target string, t time.Time) (factor float64, day time.Time, result string) {
+	d := r.day(t.UTC())
+	if d == nil {
+		return 0, time.Time{}, currencyNoRate
+	}
+	from, ok := d.rates[currency]
+	if !ok {
+		return 0, d.date, currencyUnknown
+	}
+	to, ok := d.rates[target]
+	if !ok {
+		return 0, d.date, currencyUnknown
+	}
+	return to / from, d.date, currencyConverted
+}
+
+// CurrencyEnricher converts params.value and params.revenue into the
+// reporting currency (REPORTING_CURRENCY) with the daily rate of the event's
+// UTC day (the latest earlier day when the table has none for it). The
+// amounts and currency as sent are kept in params.value_original,
+// params.revenue_original and params.currency_original, the rate day in
+// tech.currency_rate_date. Amounts that cannot be converted are left as sent
+// and the reason is written to tech.currency_error. Registered as
+// "currency"; a no-op until a rate table is loaded. Runs after the tracking
+// plan, which validates the params as sent.
+type CurrencyEnricher struct {
+	path   string
+	target string
+	rates  atomic.Pointer[CurrencyRates]
+}
+
+// NewCurrencyEnricher creates the enricher for a reporting currency and
+// loads the rate table. Use Reload for refreshes.
+func NewCurrencyEnricher(target, path string) (*CurrencyEnricher, error) {
+	target = strings.ToUpper(strings.TrimSpace(target))
+	if !currencyPattern.MatchString(target) {
+		return nil, fmt.Errorf("invalid reporting currency %q", target)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no rate table (CURRENCY_RATES)")
+	}
+	c := &CurrencyEnricher{target: target, path: path}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the rate table. A table that fails to load keeps the
+// previous rates.
+func (c *CurrencyEnricher) Reload() (*CurrencyRates, error) {
+	if c.path == "" {
+		return nil, fmt.Errorf("currency conversion is not configured")
+	}
+	rates, err := LoadCurrencyRates(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := rates.days[len(rates.days)-1].rates[c.target]; !ok {
+		return nil, fmt.Errorf("reporting currency %s missing from the latest rates", c.target)
+	}
+	c.rates.Store(rates)
+	return rates, nil
+}
+
+func (c *CurrencyEnricher) Name() string { return "currency" }
+
+func (c *CurrencyEnricher) Enrich(in *EnrichInput, e *Event) error {
+	rates := c.rates.Load()
+	if rates == nil {
+		return nil
+	}
+
+	var amounts []string
+	for _, key := range currencyAmountParams {
+		if v, ok := e.Params[key]; ok && v != "" {
+			amounts = append(amounts, key)
+		}
+	}
+	if len(amounts) == 0 {
+		return nil
+	}
+	fail := func(result string) error {
+		e.Tech[currencyErrorKey] = result
+		metricCurrencyConversions.WithLabelValues(result).Inc()
+		return nil
+	}
+
+	currency := strings.ToUpper(strings.TrimSpace(e.Params["currency"]))
+	if currency == "" {
+		return fail(currencyMissing)
+	}
+	if currency == c.target {
+		metricCurrencyConversions.WithLabelValues(currencySame).Inc()
+		return nil
+	}
+
+	values := make(map[string]float64, len(amounts))
+	for _, key := range amounts {
+		f, ok := toNumber(e.Params[key])
+		if !ok {
+			return fail(currencyInvalidAmount)
+		}
+		values[key] = f
+	}
+	factor, day, result := rates.Convert(currency, c.target, e.Timestamp)
+	if result != currencyConverted {
+		return fail(result)
+	}
+
+	for _, key := range amounts {
+		e.Params[key+currencyOriginalSuffix] = e.Params[key]
+		e.ParamsNum[key+currencyOriginalSuffix] = values[key]
+		converted := math.Round(values[key]*factor*1e6) / 1e6
+		e.Params[key] = strconv.FormatFloat(converted, 'f', -1, 64)
+		e.ParamsNum[key] = converted
+	}
+	e.Params[currencyOriginalParam] = currency
+	e.Params["currency"] = c.target
+	e.Tech[currencyRateDateKey] = day.Format(currencyRateDateLayout)
+	metricCurrencyConversions.WithLabelValues(currencyConverted).Inc()
+	return nil
+}
+
+// CurrencyAdmin serves the rate-table admin endpoint.
+type CurrencyAdmin struct {
+	enricher *CurrencyEnricher
+}
+
+// HandleReload re-reads CURRENCY_RATES and returns the loaded table's range.
+func (a *CurrencyAdmin) HandleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", nil)
+		return
+	}
+	rates, err := a.enricher.Reload()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "currency_reload_failed", err)
+		return
+	}
+
+	currencies := make(map[string]bool)
+	for _, d := range rates.days {
+		for code := range d.rates {
+			currencies[code] = true
+		}
+	}
+	first := rates.days[0].date.Format(currencyRateDateLayout)
+	last := rates.days[len(rates.days)-1].date.Format(currencyRateDateLayout)
+	log.Printf("Currency: reloaded %s (%d days, %s to %s)", a.enricher.path, len(rates.days), first, last)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"reporting_currency": a.enricher.target,
+		"base":               rates.base,
+		"days":               len(rates.days),
+		"from":               first,
+		"to":                 last,
+		"currencies":         len(currencies),
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRatesJSON = `{
+  "base": "EUR",
+  "rates": {
+    "2026-10-16": {"USD": 1.2, "GBP": 0.9, "JPY": 160},
+    "2026-10-14": {"usd": 1.1, "GBP": 0.85}
+  }
+}`
+
+func newTestCurrencyEnricher(t *testing.T, target string) (*CurrencyEnricher, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rates.json")
+	if err := os.WriteFile(path, []byte(testRatesJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCurrencyEnricher(target, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, path
+}
+
+func TestCurrencyEnricher(t *testing.T) {
+	c, _ := newTestCurrencyEnricher(t, "usd")
+	day := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		params   map[string]string
+		value    string // params.value after the enricher
+		currency string
+		rateDate string
+		err      string
+	}{
+		{"cross rate", day("2026-10-16T12:00:00Z"), map[string]string{"currency": "GBP", "value": "90"}, "120", "USD", "2026-10-16", ""},
+		{"base currency", day("2026-10-16T12:00:00Z"), map[string]string{"currency": "EUR", "value": "10"}, "12", "USD", "2026-10-16", ""},
+		{"earlier day", day("2026-10-15T12:00:00Z"), map[string]string{"currency": "GBP", "value": "85"}, "110", "USD", "2026-10-14", ""},
+		{"later than the table", day("2026-12-01T00:00:00Z"), map[string]string{"currency": "JPY", "value": "1600"}, "12", "USD", "2026-10-16", ""},
+		{"UTC day", day("2026-10-17T01:00:00+03:00"), map[string]string{"currency": "GBP", "value": "90"}, "120", "USD", "2026-10-16", ""},
+		{"same currency", day("2026-10-16T12:00:00Z"), map[string]string{"currency": "USD", "value": "5"}, "5", "USD", "", ""},
+		{"before the table", day("2026-10-13T23:59:59Z"), map[string]string{"currency": "GBP", "value": "90"}, "90", "GBP", "", currencyNoRate},
+		{"not on that day", day("2026-10-14T12:00:00Z"), map[string]string{"currency": "JPY", "value": "1600"}, "1600", "JPY", "", currencyUnknown},
+		{"unknown currency", day("2026-10-16T12:00:00Z"), map[string]string{"currency": "XYZ", "value": "1"}, "1", "XYZ", "", currencyUnknown},
+		{"missing currency", day("2026-10-16T12:00:00Z"), map[string]string{"value": "1"}, "1", "", "", currencyMissing},
+		{"invalid amount", day("2026-10-16T12:00:00Z"), map[string]string{"currency": "GBP", "value": "lots"}, "lots", "GBP", "", currencyInvalidAmount},
+		{"no amounts", day("2026-10-16T12:00:00Z"), map[string]string{"currency": "GBP"}, "", "GBP", "", ""},
+	}
+	for _, tt := range tests {
+		e := &Event{Timestamp: tt.at, Params: tt.params, ParamsNum: make(map[string]float64), Tech: make(map[string]string)}
+		if err := c.Enrich(nil, e); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if e.Params["value"] != tt.value || e.Params["currency"] != tt.currency {
+			t.Errorf("%s: value %q %s, want %q %s", tt.name, e.Params["value"], e.Params["currency"], tt.value, tt.currency)
+		}
+		if got := e.Tech[currencyRateDateKey]; got != tt.rateDate {
+			t.Errorf("%s: rate date %q, want %q", tt.name, got, tt.rateDate)
+		}
+		if got := e.Tech[currencyErrorKey]; got != tt.err {
+			t.Errorf("%s: currency error %q, want %q", tt.name, got, tt.err)
+		}
+		if _, converted := e.Params[currencyOriginalParam]; converted != (tt.rateDate != "") {
+			t.Errorf("%s: currency_original = %q", tt.name, e.Params[currencyOriginalParam])
+		}
+	}
+}
+
+func TestCurrencyEnricherKeepsOriginals(t *testing.T) {
+	c, _ := newTestCurrencyEnricher(t, "USD")
+	e := &Event{
+		Timestamp: time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC),
+		Params:    map[string]string{"currency": "gbp", "value": "45", "revenue": "9.9", "tax": "3"},
+		ParamsNum: map[string]float64{"value": 45, "revenue": 9.9, "tax": 3},
+		Tech:      make(map[string]string),
+	}
+	if err := c.Enrich(nil, e); err != nil {
+		t.Fatal(err)
+	}
+	wantParams := map[string]string{
+		"currency": "USD", "currency_original": "GBP",
+		"value": "60", "value_original": "45",
+		"revenue": "13.2", "revenue_original": "9.9",
+		"tax": "3", // Not an amount param
+	}
+	for k, want := range wantParams {
+		if got := e.Params[k]; got != want {
+			t.Errorf("params[%s] = %q, want %q", k, got, want)
+		}
+	}
+	wantNum := map[string]float64{"value": 60, "value_original": 45, "revenue": 13.2, "revenue_original": 9.9, "tax": 3}
+	for k, want := range wantNum {
+		if got := e.ParamsNum[k]; got != want {
+			t.Errorf("params_num[%s] = %v, want %v", k, got, want)
+		}
+	}
+}
+
+func TestCurrencyRatesReload(t *testing.T) {
+	c, path := newTestCurrencyEnricher(t, "USD")
+	before := c.rates.Load()
+
+	for _, bad := range []string{
+		`not json`,
+		`{"base": "EUR", "rates": {"2026-10-17": {"GBP": 0.9}}}`, // Target missing from the latest day
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Reload(); err == nil {
+			t.Errorf("Reload accepted %s", bad)
+		}
+		if c.rates.Load() != before {
+			t.Error("failed reload replaced the rates")
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"base": "USD", "rates": {"2026-10-17": {"EUR": 0.8}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	factor, day, result := c.rates.Load().Convert("EUR", "USD", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC))
+	if result != currencyConverted || factor != 1.25 || day.Format(currencyRateDateLayout) != "2026-10-17" {
+		t.Errorf("after reload Convert = %v, %s, %s", factor, day, result)
+	}
+}
+
+func TestParseCurrencyRatesErrors(t *testing.T) {
+	for _, bad := range []string{
+		`{"base": "euro", "rates": {"2026-10-16": {"USD": 1.2}}}`,
+		`{"base": "EUR", "rates": {}}`,
+		`{"base": "EUR", "rates": {"16.10.2026": {"USD": 1.2}}}`,
+		`{"base": "EUR", "rates": {"2026-10-16": {"US": 1.2}}}`,
+		`{"base": "EUR", "rates": {"2026-10-16": {"USD": 0}}}`,
+		`{"base": "EUR", "rates": {"2026-10-16": {"USD": -1}}}`,
+	} {
+		if _, err := ParseCurrencyRates([]byte(bad)); err == nil {
+			t.Errorf("ParseCurrencyRates accepted %s", bad)
+		}
+	}
+
+	if _, err := NewCurrencyEnricher("dollar", "rates.json"); err == nil {
+		t.Error("invalid reporting currency accepted")
+	}
+	if _, err := NewCurrencyEnricher("USD", ""); err == nil {
+		t.Error("missing rate table accepted")
+	}
+	if err := (&CurrencyEnricher{}).Enrich(nil, &Event{Params: map[string]string{"value": "1"}}); err != nil {
+		t.Errorf("unconfigured enricher: %v", err)
+	}
+}
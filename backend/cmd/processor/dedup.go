@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+const dedupKeyPrefix = "dedup/"
+
+// DedupWindow drops events whose event_id was already delivered within the window.
+// An ID is reserved while its request is in flight and committed to Badger only
+// once the event is accepted into the spool, so a request rejected with
+// backpressure and retried by Vector is not mistaken for a duplicate.
+type DedupWindow struct {
+	db     *badger.DB
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+// NewDedupWindow creates a dedup window on top of an open BadgerDB.
+func NewDedupWindow(db *badger.DB, window time.Duration) *DedupWindow {
+	return &DedupWindow{
+		db:      db,
+		window:  window,
+		pending: make(map[string]struct{}),
+	}
+}
+
+// Reserve returns false if the event ID was already delivered or is being
+// delivered by another request. Otherwise the ID is reserved until Commit or Release.
+func (d *DedupWindow) Reserve(eventID string) bool {
+	metricDedupChecked.Inc()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.pending[eventID]; ok {
+		metricDedupHits.Inc()
+		return false
+	}
+
+	err := d.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(dedupKeyPrefix + eventID))
+		return err
+	})
+	if err == nil {
+		metricDedupHits.Inc()
+		return false
+	}
+	// On lookup errors other than "not found" we let the event through:
+	// a rare duplicate is better than a lost event.
+
+	d.pending[eventID] = struct{}{}
+	return true
+}
+
+// Commit marks reserved IDs as delivered for the length of the window.
+func (d *DedupWindow) Commit(eventIDs []string) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+
+	wb := d.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, id := range eventIDs {
+		if err := wb.SetEntry(badger.NewEntry([]byte(dedupKeyPrefix+id), nil).WithTTL(d.window)); err != nil {
+			d.Release(eventIDs)
+			return err
+		}
+	}
+	err := wb.Flush()
+
+	d.Release(eventIDs)
+	return err
+}
+
+// Release drops reservations without marking the IDs as delivered.
+func (d *DedupWindow) Release(eventIDs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range eventIDs {
+		delete(d.pending, id)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+func TestDedupWindow(t *testing.T) {
+	db := openScratchBadger("")
+	defer db.Close()
+	d := NewDedupWindow(db, time.Hour)
+
+	if !d.Reserve("e1") {
+		t.Fatal("new event ID was not reserved")
+	}
+	if d.Reserve("e1") {
+		t.Error("event ID reserved twice while in flight")
+	}
+
+	// Released (request rejected): the retry gets through
+	d.Release([]string{"e1"})
+	if !d.Reserve("e1") {
+		t.Fatal("released event ID was not reserved again")
+	}
+
+	// Committed (accepted into the spool): redeliveries are dropped
+	if err := d.Commit([]string{"e1"}); err != nil {
+		t.Fatal(err)
+	}
+	if d.Reserve("e1") {
+		t.Error("committed event ID was reserved again")
+	}
+	if !d.Reserve("e2") {
+		t.Error("other event ID was not reserved")
+	}
+	if err := d.Commit(nil); err != nil {
+		t.Errorf("Commit(nil) = %v", err)
+	}
+}
+
+func TestDedupWindowTTL(t *testing.T) {
+	db := openScratchBadger("")
+	defer db.Close()
+	const window = 90 * time.Minute
+	d := NewDedupWindow(db, window)
+
+	before := time.Now()
+	d.Reserve("e1")
+	if err := d.Commit([]string{"e1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(dedupKeyPrefix + "e1"))
+		if err != nil {
+			return err
+		}
+		expires := time.Unix(int64(item.ExpiresAt()), 0)
+		if expires.Before(before.Add(window).Add(-time.Second)) || expires.After(time.Now().Add(window).Add(time.Second)) {
+			t.Errorf("entry expires at %s, want %s after the commit", expires, window)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reservations are not written: nothing to expire
+	d.Reserve("e2")
+	err = db.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(dedupKeyPrefix + "e2")); err != badger.ErrKeyNotFound {
+			t.Errorf("reserved ID stored in Badger: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
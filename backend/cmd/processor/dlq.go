@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Dead-letter stages: where in the pipeline a payload was rejected.
+const (
+	StageCollector = "collector" // Raw fallback lines from the Lua collector (events_raw_*.log)
+	StageDecode    = "decode"    // Line or array element is not a valid JSON object
+	StageMap       = "map"       // MapToEvent failed
+	StageAppend    = "append"    // ClickHouse batch.Append failed
+	StageInsert    = "insert"    // ClickHouse rejected the event's insert on its own (see SPOOL_POISON_ATTEMPTS)
+	StageSpool     = "spool"     // Spool record could not be decoded
+)
+
+// DeadLetter is a rejected payload together with the reason it was rejected.
+type DeadLetter struct {
+	Timestamp time.Time
+	Stage     string
+	Error     string
+	Payload   string
+}
+
+// newDeadLetter builds a dead letter. The payload is copied, so it is safe
+// to pass scanner buffers.
+func newDeadLetter(stage string, payload []byte, err error) DeadLetter {
+	return DeadLetter{
+		Timestamp: time.Now(),
+		Stage:     stage,
+		Error:     safeErrorString(err),
+		Payload:   string(payload),
+	}
+}
+
+// DeadLetterQueue persists rejected payloads in the default.events_dlq table.
+type DeadLetterQueue struct {
+	ch clickhouse.Conn
+}
+
+// NewDeadLetterQueue creates a DLQ writer on top of a ClickHouse connection.
+func NewDeadLetterQueue(ch clickhouse.Conn) *DeadLetterQueue {
+	return &DeadLetterQueue{ch: ch}
+}
+
+// Write stores dead letters in a single insert.
+func (q *DeadLetterQueue) Write(ctx context.Context, letters []DeadLetter) error {
+	if len(letters) == 0 {
+		return nil
+	}
+
+	batch, err := q.ch.PrepareBatch(ctx, "INSERT INTO default.events_dlq (timestamp, stage, error, payload)")
+	if err != nil {
+		return fmt.Errorf("prepare dlq batch: %w", err)
+	}
+	for _, dl := range letters {
+		if err := batch.Append(dl.Timestamp, dl.Stage, dl.Error, dl.Payload); err != nil {
+			return fmt.Errorf("append dlq entry: %w", err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return err
+	}
+	for _, dl := range letters {
+		metricDLQWritten.WithLabelValues(dl.Stage).Inc()
+	}
+	return nil
+}
+
+// HandleCollectorFallback accepts raw lines from the collector's events_raw_*.log
+// files (bodies the Lua collector could not parse) and dead-letters them with
+// PII detector matches masked.
+func (q *DeadLetterQueue) HandleCollectorFallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	var letters []DeadLetter
+	redact := activeRedactEnricher()
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		letters = append(letters, newDeadLetter(StageCollector, redact.RedactText(line), fmt.Errorf("collector could not parse request body")))
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("DLQ scanner error: %v", err)
+		http.Error(w, "Stream error", http.StatusBadRequest)
+		return
+	}
+
+	if err := q.Write(r.Context(), letters); err != nil {
+		log.Printf("Failed to write collector fallback to DLQ: %v", err)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// safeErrorString returns the error message or empty string if nil.
+func safeErrorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
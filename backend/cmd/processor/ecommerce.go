@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// ecommerceEvents are the events (GA4 names) whose data.items are validated
+// and stored in default.event_items.
+var ecommerceEvents = map[string]bool{
+	"view_item": true, "view_item_list": true, "select_item": true,
+	"add_to_cart": true, "remove_from_cart": true, "view_cart": true,
+	"begin_checkout": true, "add_shipping_info": true, "add_payment_info": true,
+	"purchase": true, "refund": true,
+}
+
+// maxEventItems caps the items stored per event; the rest are dropped.
+const maxEventItems = 200
+
+// ecommerceErrorsKey is the tech key item and value errors are written to.
+const ecommerceErrorsKey = "ecommerce_errors"
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// EventItem is one valid item of an ecommerce event.
+type EventItem struct {
+	Index    int               `json:"i"` // Position in data.items
+	ItemID   string            `json:"id"`
+	Name     string            `json:"name"`
+	Brand    string            `json:"brand"`
+	Category string            `json:"cat"`
+	Variant  string            `json:"var"`
+	Price    float64           `json:"p"`
+	Quantity float64           `json:"q"`
+	Currency string            `json:"cur"`
+	Params   map[string]string `json:"params"` // Other fields (item_category2, coupon, discount, ...)
+}
+
+// itemFields maps the recognized item keys (GA4 names and short aliases).
+var itemFields = map[string]string{
+	"item_id": "id", "id": "id",
+	"item_name": "name", "name": "name",
+	"item_brand": "brand", "brand": "brand",
+	"item_category": "category", "category": "category",
+	"item_variant": "variant", "variant": "variant",
+	"price": "price", "quantity": "quantity", "qty": "quantity",
+	"currency": "currency",
+}
+
+// EcommerceEnricher parses data.items of ecommerce events into e.Items and
+// normalizes params.currency (ISO 4217, uppercase) and params.value (a
+// number; the sum of price × quantity when missing). Invalid items are left
+// out and, like invalid currency and value, listed in tech.ecommerce_errors
+// (e.g. "items[2].price:type"); the event itself is kept. Items priced in
+// another currency than the event are stored but flagged (currency:mismatch)
+// and left out of the derived value. Runs after params.
+type EcommerceEnricher struct{}
+
+func (en *EcommerceEnricher) Name() string { return "ecommerce" }
+
+func (en *EcommerceEnricher) Enrich(in *EnrichInput, e *Event) error {
+	if !ecommerceEvents[e.EventName] {
+		return nil
+	}
+	data, _ := in.Raw["data"].(map[string]interface{})
+	var errs []string
+	fail := func(field, rule string) {
+		errs = append(errs, field+":"+rule)
+		metricEcommerceErrors.WithLabelValues(e.EventName, rule).Inc()
+	}
+
+	// 1. Currency
+	currency := strings.ToUpper(strings.TrimSpace(e.Params["currency"]))
+	switch {
+	case currency == "":
+	case currencyPattern.MatchString(currency):
+		e.Params["currency"] = currency
+	default:
+		fail("currency", "invalid")
+		delete(e.Params, "currency")
+		currency = ""
+	}
+
+	// 2. Items; the flattened "items" param is replaced by e.Items. Only
+	// items in the currency of the value are summed into it.
+	valueCurrency := currency
+	var valueItems []EventItem
+	delete(e.Params, "items")
+	delete(e.ParamsNum, "items")
+	if raw, ok := data["items"]; ok && raw != nil {
+		list, ok := raw.([]interface{})
+		if !ok {
+			fail("items", "type")
+		}
+		if len(list) > maxEventItems {
+			fail("items", "too_many")
+			list = list[:maxEventItems]
+		}
+		for i, v := range list {
+			item, rule, field := parseItem(i, v, currency)
+			if rule != "" {
+				fail(fmt.Sprintf("items[%d]%s", i, field), rule)
+				metricEcommerceItems.WithLabelValues(e.EventName, "invalid").Inc()
+				continue
+			}
+			// Without an event currency the first stored item sets it
+			if currency == "" && len(e.Items) == 0 {
+				valueCurrency = item.Currency
+			}
+			if item.Currency == valueCurrency {
+				valueItems = append(valueItems, item)
+			} else {
+				fail(fmt.Sprintf("items[%d].currency", i), "mismatch")
+			}
+			e.Items = append(e.Items, item)
+			metricEcommerceItems.WithLabelValues(e.EventName, "stored").Inc()
+		}
+	}
+
+	// 3. Value
+	if v, ok := e.Params["value"]; ok && v != "" {
+		if f, ok := toNumber(v); ok && f >= 0 {
+			e.Params["value"] = strconv.FormatFloat(f, 'f', -1, 64)
+			e.ParamsNum["value"] = f
+		} else {
+			fail("value", "type")
+			delete(e.Params, "value")
+			delete(e.ParamsNum, "value")
+		}
+	} else if len(valueItems) > 0 {
+		sum := 0.0
+		for _, item := range valueItems {
+			sum += item.Price * item.Quantity
+		}
+		sum = math.Round(sum*1e6) / 1e6
+		e.Params["value"] = strconv.FormatFloat(sum, 'f', -1, 64)
+		e.ParamsNum["value"] = sum
+		if currency == "" && valueCurrency != "" {
+			e.Params["currency"] = valueCurrency
+		}
+	}
+
+	if len(errs) > 0 {
+		e.Tech[ecommerceErrorsKey] = Validate(strings.Join(errs, ","), MaxLength(1000))
+	}
+	return nil
+}
+
+// parseItem validates one entry of data.items. On failure it returns the
+// rule (missing_id, type, range) and the offending field (".price", or
+// empty for the item itself).
+func parseItem(index int, v interface{}, currency string) (item EventItem, rule, field string) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return item, "type", ""
+	}
+
+	item = EventItem{Index: index, Quantity: 1, Currency: currency, Params: make(map[string]string)}
+	for key, val := range obj {
+		switch itemFields[key] {
+		case "id":
+			item.ItemID = Validate(toString(val), Sanitize, MaxLength(200))
+		case "name":
+			item.Name = Validate(toString(val), Sanitize, MaxLength(500))
+		case "brand":
+			item.Brand = Validate(toString(val), Sanitize, MaxLength(200))
+		case "category":
+			item.Category = Validate(toString(val), Sanitize, MaxLength(200))
+		case "variant":
+			item.Variant = Validate(toString(val), Sanitize, MaxLength(200))
+		case "price":
+			f, ok := toNumber(val)
+			if !ok {
+				return item, "type", ".price"
+			}
+			if f < 0 {
+				return item, "range", ".price"
+			}
+			item.Price = f
+		case "quantity":
+			f, ok := toNumber(val)
+			if !ok {
+				return item, "type", ".quantity"
+			}
+			if f <= 0 {
+				return item, "range", ".quantity"
+			}
+			item.Quantity = f
+		case "currency":
+			c := strings.ToUpper(strings.TrimSpace(toString(val)))
+			if !currencyPattern.MatchString(c) {
+				return item, "type", ".currency"
+			}
+			item.Currency = c
+		default:
+			flattenWithValidation(key, val, item.Params, 500)
+		}
+	}
+	if item.ItemID == "" && item.Name == "" {
+		return item, "missing_id", ""
+	}
+	return item, "", ""
+}
+
+const insertEventItemsQuery = "INSERT INTO default.event_items (timestamp, event_id, event_name, item_index, item_id, item_name, item_brand, item_category, item_variant, price, quantity, currency, params)"
+
+// insertEventItems stores the items of a batch. event_items is a
+// ReplacingMergeTree keyed by event and item, so a retried batch does not
+// duplicate items.
+func insertEventItems(ctx context.Context, ch clickhouse.Conn, events []*Event) error {
+	n := 0
+	for _, e := range events {
+		n += len(e.Items)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	batch, err := ch.PrepareBatch(ctx, insertEventItemsQuery)
+	if err != nil {
+		return fmt.Errorf("prepare event items batch: %w", err)
+	}
+	for _, e := range events {
+		for _, it := range e.Items {
+			if err := batch.Append(e.Timestamp, e.IDs["event_id"], e.EventName, uint16(it.Index),
+				it.ItemID, it.Name, it.Brand, it.Category, it.Variant, it.Price, it.Quantity, it.Currency, it.Params); err != nil {
+				batch.Abort()
+				return fmt.Errorf("append event item: %w", err)
+			}
+		}
+	}
+	return batch.Send()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// enrichEcommerce maps a raw event through params and the ecommerce enricher.
+func enrichEcommerce(t *testing.T, rawJSON string) *Event {
+	t.Helper()
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(rawJSON), &raw); err != nil {
+		t.Fatal(err)
+	}
+	e := &Event{
+		EventName: toString(raw["event_name"]),
+		Params:    make(map[string]string),
+		ParamsNum: make(map[string]float64),
+		Tech:      make(map[string]string),
+	}
+	parseParams(raw, e)
+	if err := (&EcommerceEnricher{}).Enrich(newEnrichInput(raw), e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func ecommerceErrors(e *Event) []string {
+	if e.Tech[ecommerceErrorsKey] == "" {
+		return nil
+	}
+	return strings.Split(e.Tech[ecommerceErrorsKey], ",")
+}
+
+func itemIndexes(e *Event) []int {
+	out := make([]int, len(e.Items))
+	for i, item := range e.Items {
+		out[i] = item.Index
+	}
+	return out
+}
+
+func TestEcommerceItems(t *testing.T) {
+	e := enrichEcommerce(t, `{"event_name": "purchase", "data": {"currency": "eur", "items": [
+		{"item_id": "A", "price": 10, "quantity": 2, "item_category2": "shoes"},
+		{"name": "B", "price": "5.5"},
+		{"item_id": "C", "price": -1},
+		{"item_id": "D", "price": 3, "quantity": 0},
+		{"item_id": "E", "price": 3, "qty": "lots"},
+		{"item_id": "F", "price": 3, "currency": "euro"},
+		{"price": 3},
+		"G",
+		{"item_id": "H", "price": 1, "currency": "usd"}
+	]}}`)
+
+	if got, want := itemIndexes(e), []int{0, 1, 8}; !slices.Equal(got, want) {
+		t.Errorf("stored items = %v, want %v", got, want)
+	}
+	if got, want := ecommerceErrors(e), []string{
+		"items[2].price:range",
+		"items[3].quantity:range",
+		"items[4].quantity:type",
+		"items[5].currency:type",
+		"items[6]:missing_id",
+		"items[7]:type",
+		"items[8].currency:mismatch",
+	}; !slices.Equal(got, want) {
+		t.Errorf("errors = %v, want %v", got, want)
+	}
+
+	a, b, h := e.Items[0], e.Items[1], e.Items[2]
+	if a.ItemID != "A" || a.Price != 10 || a.Quantity != 2 || a.Currency != "EUR" || a.Params["item_category2"] != "shoes" {
+		t.Errorf("item A = %+v", a)
+	}
+	if b.Name != "B" || b.Price != 5.5 || b.Quantity != 1 || b.Currency != "EUR" {
+		t.Errorf("item B = %+v, want quantity 1 and the event currency", b)
+	}
+	if h.Currency != "USD" {
+		t.Errorf("item H currency = %q, want its own", h.Currency)
+	}
+
+	// The USD item is not summed into the EUR value
+	if e.Params["currency"] != "EUR" || e.Params["value"] != "25.5" || e.ParamsNum["value"] != 25.5 {
+		t.Errorf("currency %q, value %q (%v); want EUR 25.5", e.Params["currency"], e.Params["value"], e.ParamsNum["value"])
+	}
+	if _, ok := e.Params["items"]; ok {
+		t.Error("items param kept in params")
+	}
+}
+
+func TestEcommerceItemsNotArray(t *testing.T) {
+	for _, items := range []string{`"A,B"`, `{"item_id": "A"}`, `3`} {
+		e := enrichEcommerce(t, `{"event_name": "add_to_cart", "data": {"items": `+items+`}}`)
+		if len(e.Items) != 0 || !slices.Equal(ecommerceErrors(e), []string{"items:type"}) {
+			t.Errorf("items %s: stored %d, errors %v", items, len(e.Items), ecommerceErrors(e))
+		}
+		if _, ok := e.Params["value"]; ok {
+			t.Errorf("items %s: value derived", items)
+		}
+	}
+
+	e := enrichEcommerce(t, `{"event_name": "add_to_cart", "data": {"items": null}}`)
+	if len(ecommerceErrors(e)) != 0 {
+		t.Errorf("null items: errors %v", ecommerceErrors(e))
+	}
+}
+
+func TestEcommerceItemsCap(t *testing.T) {
+	items := make([]string, maxEventItems+5)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"item_id": "i%d", "price": 1}`, i)
+	}
+	e := enrichEcommerce(t, `{"event_name": "view_item_list", "data": {"currency": "USD", "items": [`+strings.Join(items, ",")+`]}}`)
+	if len(e.Items) != maxEventItems || e.Items[maxEventItems-1].ItemID != fmt.Sprintf("i%d", maxEventItems-1) {
+		t.Errorf("stored %d items, want the first %d", len(e.Items), maxEventItems)
+	}
+	if !slices.Equal(ecommerceErrors(e), []string{"items:too_many"}) {
+		t.Errorf("errors = %v", ecommerceErrors(e))
+	}
+	if e.Params["value"] != fmt.Sprint(maxEventItems) {
+		t.Errorf("value = %q, want the sum of the stored items", e.Params["value"])
+	}
+}
+
+func TestEcommerceValue(t *testing.T) {
+	tests := []struct {
+		name, data      string
+		value, currency string
+		errs            []string
+	}{
+		{"derived", `{"currency": "USD", "items": [{"item_id": "a", "price": 0.1, "quantity": 3}, {"item_id": "b", "price": 0.2}]}`, "0.5", "USD", nil},
+		{"explicit kept", `{"currency": "USD", "value": "12.50", "items": [{"item_id": "a", "price": 1}]}`, "12.5", "USD", nil},
+		{"negative value", `{"currency": "USD", "value": -3}`, "", "USD", []string{"value:type"}},
+		{"value not a number", `{"currency": "USD", "value": "ten"}`, "", "USD", []string{"value:type"}},
+		{"invalid currency", `{"currency": "dollars", "value": 3}`, "3", "", []string{"currency:invalid"}},
+		{"currency from first item", `{"items": [{"item_id": "a", "price": 2, "currency": "gbp"}, {"item_id": "b", "price": 5, "currency": "EUR"}]}`, "2", "GBP", []string{"items[1].currency:mismatch"}},
+		{"no currency anywhere", `{"items": [{"item_id": "a", "price": 2}, {"item_id": "b", "price": 5, "currency": "EUR"}]}`, "2", "", []string{"items[1].currency:mismatch"}},
+		{"no valid items", `{"currency": "USD", "items": [{"price": 2}]}`, "", "USD", []string{"items[0]:missing_id"}},
+	}
+	for _, tt := range tests {
+		e := enrichEcommerce(t, `{"event_name": "purchase", "data": `+tt.data+`}`)
+		if e.Params["value"] != tt.value || e.Params["currency"] != tt.currency {
+			t.Errorf("%s: value %q, currency %q; want %q, %q", tt.name, e.Params["value"], e.Params["currency"], tt.value, tt.currency)
+		}
+		if _, ok := e.ParamsNum["value"]; ok != (tt.value != "") {
+			t.Errorf("%s: params_num value = %v, %v", tt.name, e.ParamsNum["value"], ok)
+		}
+		if got := ecommerceErrors(e); !slices.Equal(got, tt.errs) {
+			t.Errorf("%s: errors = %v, want %v", tt.name, got, tt.errs)
+		}
+	}
+
+	// Other events are left alone
+	e := enrichEcommerce(t, `{"event_name": "page_view", "data": {"currency": "usd", "items": "x"}}`)
+	if e.Params["currency"] != "usd" || len(ecommerceErrors(e)) != 0 {
+		t.Errorf("page_view changed: %v, %v", e.Params, ecommerceErrors(e))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDropEvent is returned (possibly wrapped) by an enricher to discard the
+// event on purpose. Dropped events are counted but not dead-lettered.
+var ErrDropEvent = errors.New("event dropped by enricher")
+
+// EnrichInput is the raw event plus values extracted once and shared by all
+// enrichers of the chain.
+type EnrichInput struct {
+	Raw       map[string]interface{}
+	UserAgent string            // Validated server.user_agent (or top-level user_agent)
+	IPHash    string            // Validated server.ip_hash (or top-level ip_hash)
+	URLParts  map[string]string // parseURL result for the page URL
+	Consent   Consent           // parseConsent result
+}
+
+// newEnrichInput extracts the values shared by the enrichers from a raw event.
+func newEnrichInput(raw map[string]interface{}) *EnrichInput {
+	in := &EnrichInput{
+		Raw:      raw,
+		URLParts: parseURL(Validate(toString(raw["url"]), Sanitize, MaxLength(2048))),
+		Consent:  parseConsent(raw, activeConsentEnricher().DefaultGranted()),
+	}
+	if server, ok := raw["server"].(map[string]interface{}); ok {
+		in.IPHash = Validate(toString(server["ip_hash"]), Sanitize, MaxLength(64))
+		in.UserAgent = Validate(toString(server["user_agent"]), Sanitize, MaxLength(500))
+	} else {
+		in.IPHash = Validate(toString(raw["ip_hash"]), Sanitize, MaxLength(64))
+		in.UserAgent = Validate(toString(raw["user_agent"]), Sanitize, MaxLength(500))
+	}
+	return in
+}
+
+// Enricher is one step of MapToEvent. Enrichers run in the configured order
+// and may read what earlier steps wrote to the event. An error rejects the
+// event (it is dead-lettered at the map stage), except ErrDropEvent.
+type Enricher interface {
+	Name() string
+	Enrich(in *EnrichInput, e *Event) error
+}
+
+// EnricherFunc adapts a function to the Enricher interface.
+type EnricherFunc struct {
+	name string
+	fn   func(in *EnrichInput, e *Event) error
+}
+
+// NewEnricherFunc creates a named enricher from a function.
+func NewEnricherFunc(name string, fn func(in *EnrichInput, e *Event) error) EnricherFunc {
+	return EnricherFunc{name: name, fn: fn}
+}
+
+func (f EnricherFunc) Name() string { return f.name }
+
+func (f EnricherFunc) Enrich(in *EnrichInput, e *Event) error { return f.fn(in, e) }
+
+// defaultEnricherOrder is the chain used when ENRICHERS is not set. The
+// filter and the tracking plan run before the stateful enrichers (identity,
+// bot, session), so dropped and rejected events leave no state behind.
+var defaultEnricherOrder = []string{"ids", "geo", "device", "page", "traffic", "filter", "tech", "params", "tracking_plan", "identity", "bot", "session", "ecommerce", "redact", "canonical", "currency", "consent"}
+
+var (
+	enricherRegistry = make(map[string]Enricher)
+	enrichers        []Enricher // Active chain, see ConfigureEnrichers
+)
+
+func init() {
+	RegisterEnricher(NewEnricherFunc("ids", func(in *EnrichInput, e *Event) error {
+		parseIDs(in.Raw, e)
+		return nil
+	}))
+	RegisterEnricher(&IdentityEnricher{}) // No-op until created with a graph
+	RegisterEnricher(NewEnricherFunc("geo", func(in *EnrichInput, e *Event) error {
+		e.Geo["ip_hash"] = in.IPHash
+		parseGeo(in.Raw, e)
+		return nil
+	}))
+	RegisterEnricher(NewEnricherFunc("device", func(in *EnrichInput, e *Event) error {
+		e.Device["user_agent"] = in.UserAgent
+		parseDevice(in.Raw, in.UserAgent, e)
+		return nil
+	}))
+	RegisterEnricher(NewBotEnricher(mustParseBotRules(defaultBotRulesJSON)))
+	RegisterEnricher(NewEnricherFunc("page", func(in *EnrichInput, e *Event) error {
+		parsePage(in.Raw, in.URLParts, e)
+		return nil
+	}))
+	RegisterEnricher(NewTrafficEnricher(mustParseChannelRules(defaultChannelRulesJSON)))
+	RegisterEnricher(&FilterEnricher{})  // No-op until FILTER_RULES is set
+	RegisterEnricher(&SessionEnricher{}) // No-op until created with the Badger DB
+	RegisterEnricher(NewEnricherFunc("tech", func(in *EnrichInput, e *Event) error {
+		parseTech(in.Raw, e)
+		return nil
+	}))
+	RegisterEnricher(NewEnricherFunc("params", func(in *EnrichInput, e *Event) error {
+		parseParams(in.Raw, e)
+		return nil
+	}))
+	RegisterEnricher(&EcommerceEnricher{})
+	RegisterEnricher(NewRedactEnricher(mustParsePIIRules(defaultPIIRulesJSON)))
+	RegisterEnricher(NewCanonicalEnricher(mustParseURLRules(defaultURLRulesJSON)))
+	RegisterEnricher(&TrackingPlanEnricher{}) // No-op until TRACKING_PLAN is set
+	RegisterEnricher(&CurrencyEnricher{})     // No-op until REPORTING_CURRENCY is set
+	RegisterEnricher(NewConsentEnricher(true))
+
+	if err := ConfigureEnrichers(""); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterEnricher makes an enricher available to ConfigureEnrichers under
+// its name. Custom enrichers register themselves from an init function (or
+// from main, if they need dependencies) and are enabled via ENRICHERS.
+func RegisterEnricher(en Enricher) {
+	name := en.Name()
+	if _, exists := enricherRegistry[name]; exists {
+		panic(fmt.Sprintf("enricher %q registered twice", name))
+	}
+	enricherRegistry[name] = en
+}
+
+// ConfigureEnrichers sets the chain MapToEvent runs. spec is a comma-separated
+// list of registered enricher names in execution order; empty means the
+// default chain. Listing a subset disables the others. configured enrichers
+// (built by main with their dependencies) replace the registered ones of the
+// same name. Not safe to call while events are being mapped: configure once
+// at startup.
+func ConfigureEnrichers(spec string, configured ...Enricher) error {
+	replace := make(map[string]Enricher, len(configured))
+	for _, en := range configured {
+		if _, ok := enricherRegistry[en.Name()]; !ok {
+			return fmt.Errorf("unknown enricher %q", en.Name())
+		}
+		replace[en.Name()] = en
+	}
+
+	names := defaultEnricherOrder
+	if strings.TrimSpace(spec) != "" {
+		names = nil
+		for _, name := range strings.Split(spec, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	chain := make([]Enricher, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		en, ok := enricherRegistry[name]
+		if !ok {
+			return fmt.Errorf("unknown enricher %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("enricher %q listed twice", name)
+		}
+		seen[name] = true
+		if r, ok := replace[name]; ok {
+			en = r
+		}
+		chain = append(chain, en)
+	}
+
+	enrichers = chain
+	return nil
+}
+
+// activeEnricher returns the named enricher of the active chain, or nil.
+func activeEnricher(name string) Enricher {
+	for _, en := range enrichers {
+		if en.Name() == name {
+			return en
+		}
+	}
+	return nil
+}
+
+// enricherNames lists the names of the active chain.
+func enricherNames() []string {
+	names := make([]string, len(enrichers))
+	for i, en := range enrichers {
+		names[i] = en.Name()
+	}
+	return names
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigureEnrichers(t *testing.T) {
+	t.Cleanup(func() { ConfigureEnrichers("") })
+	if err := ConfigureEnrichers(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := enricherNames(); !slices.Equal(got, defaultEnricherOrder) {
+		t.Fatalf("default chain = %v, want %v", got, defaultEnricherOrder)
+	}
+
+	for _, tt := range []struct {
+		name, spec string
+		configured []Enricher
+		err        string
+	}{
+		{"unknown name", "ids,referrer", nil, `unknown enricher "referrer"`},
+		{"duplicate", "ids,page,ids", nil, `enricher "ids" listed twice`},
+		{"unknown replacement", "", []Enricher{NewEnricherFunc("custom", nil)}, `unknown enricher "custom"`},
+	} {
+		err := ConfigureEnrichers(tt.spec, tt.configured...)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %s", tt.name, err, tt.err)
+		}
+		if got := enricherNames(); !slices.Equal(got, defaultEnricherOrder) {
+			t.Errorf("%s: chain changed to %v", tt.name, got)
+		}
+	}
+
+	// A subset in list order; blanks are ignored
+	if err := ConfigureEnrichers(" params, ids,,traffic "); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := enricherNames(), []string{"params", "ids", "traffic"}; !slices.Equal(got, want) {
+		t.Errorf("subset chain = %v, want %v", got, want)
+	}
+	e, err := MapToEvent(map[string]interface{}{"event_name": "page_view", "data": map[string]interface{}{"plan": "pro"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Params["plan"] != "pro" || e.IDs["event_id"] == "" || e.Traffic["channel_group"] == "" {
+		t.Errorf("subset chain did not run every listed enricher: %+v", e)
+	}
+	if len(e.Device) != 0 || len(e.Consent) != 0 {
+		t.Errorf("disabled enrichers ran: device %v, consent %v", e.Device, e.Consent)
+	}
+
+	// Configured instances replace the registered ones in the chain only
+	rules, err := ParseChannelRules([]byte(`{"default_group": "Everything"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	traffic, consent := NewTrafficEnricher(rules), NewConsentEnricher(false)
+	if err := ConfigureEnrichers("", traffic, consent); err != nil {
+		t.Fatal(err)
+	}
+	if activeEnricher("traffic") != Enricher(traffic) || activeConsentEnricher() != consent {
+		t.Fatal("configured enrichers are not in the chain")
+	}
+	if enricherRegistry["traffic"] == Enricher(traffic) {
+		t.Error("configured enricher replaced the registered one")
+	}
+	e, err = MapToEvent(map[string]interface{}{"event_name": "page_view", "visitor_id": "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Traffic["channel_group"]; got != "Everything" {
+		t.Errorf("channel_group = %q, want the configured rules' default", got)
+	}
+	if got := e.Consent[consentAnalytics]; got != consentDenied || e.IDs["visitor_id"] != "" {
+		t.Errorf("consent = %v, visitor_id %q; want the configured default (denied)", e.Consent, e.IDs["visitor_id"])
+	}
+
+	// Back to the registered instances
+	if err := ConfigureEnrichers(""); err != nil {
+		t.Fatal(err)
+	}
+	if !activeConsentEnricher().DefaultGranted() {
+		t.Error("registered consent enricher does not grant by default")
+	}
+	if err := ConfigureEnrichers("ids"); err != nil {
+		t.Fatal(err)
+	}
+	if c := activeConsentEnricher(); c != nil || !c.DefaultGranted() {
+		t.Error("a chain without the consent enricher does not grant by default")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Filter rules, used as metric labels.
+const (
+	filterHostNotAllowed  = "host_not_allowed"
+	filterBlockedReferrer = "blocked_referrer"
+	filterInternalIP      = "internal_ip"
+	filterInternalQuery   = "internal_query"
+	filterInternalCookie  = "internal_cookie"
+)
+
+// FilterRules is the filter file (FILTER_RULES):
+//
+//	{
+//	  "allowed_hosts": ["example.com"],
+//	  "blocked_referrers": ["semalt.com", "buttons-for-website.com"],
+//	  "internal": {
+//	    "action": "tag",
+//	    "ip_hashes": ["5d41402abc4b2a76b9719d911017c592"],
+//	    "query_param": "internal",
+//	    "cookie": true
+//	  }
+//	}
+//
+// Hosts and referrers match the domain and its subdomains (see matchDomain).
+// An empty allowed_hosts list allows every host.
+type FilterRules struct {
+	AllowedHosts     []string `json:"allowed_hosts"`
+	BlockedReferrers []string `json:"blocked_referrers"`
+	Internal         struct {
+		Action     string   `json:"action"`      // "tag" (default): traffic.traffic_type = internal; "drop"
+		IPHashes   []string `json:"ip_hashes"`   // Matched against server.ip_hash and server.real_ip_hash
+		QueryParam string   `json:"query_param"` // Page URL param marking internal hits (any non-empty value)
+		Cookie     bool     `json:"cookie"`      // Honor the collector's internal cookie marker (server.internal)
+	} `json:"internal"`
+}
+
+// compiledFilter is a loaded filter file.
+type compiledFilter struct {
+	allowedHosts     []string
+	blockedReferrers []string
+	internalDrop     bool
+	ipHashes         map[string]bool
+	queryKey         string // url_query_* key
+	cookie           bool
+}
+
+// FilterEnricher drops referrer spam and traffic to untracked hosts, and drops
+// or tags internal traffic. Registered as "filter"; a no-op until a filter
+// file is loaded. The file is re-read when it changes (see Watch). Its
+// decision depends on the raw event only; it runs ahead of the stateful
+// enrichers, and dropped events are caught before fingerprinting (Prefilter).
+type FilterEnricher struct {
+	path    string
+	modTime time.Time
+	rules   atomic.Pointer[compiledFilter]
+}
+
+// NewFilterEnricher creates a filter enricher from the filter file at path.
+// Use Watch for reloads.
+func NewFilterEnricher(path string) (*FilterEnricher, error) {
+	f := &FilterEnricher{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// activeFilterEnricher returns the active chain's filter enricher, or nil
+// (which drops nothing) when it is not in the chain.
+func activeFilterEnricher() *FilterEnricher {
+	f, _ := activeEnricher("filter").(*FilterEnricher)
+	return f
+}
+
+// Watch polls the filter file every interval and reloads it when its
+// modification time changes. A file that fails to load keeps the previous rules.
+func (f *FilterEnricher) Watch(interval time.Duration) {
+	if f.path == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(f.path)
+			if err != nil {
+				log.Printf("Filter: failed to stat %s: %v", f.path, err)
+				continue
+			}
+			if info.ModTime().Equal(f.modTime) {
+				continue
+			}
+			if err := f.reload(); err != nil {
+				log.Printf("Filter: failed to reload %s, keeping previous rules: %v", f.path, err)
+				continue
+			}
+			log.Printf("Filter: reloaded %s", f.path)
+		}
+	}()
+}
+
+func (f *FilterEnricher) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var file FilterRules
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse %s: %w", f.path, err)
+	}
+
+	rules := &compiledFilter{
+		allowedHosts:     lowerAll(file.AllowedHosts),
+		blockedReferrers: lowerAll(file.BlockedReferrers),
+		ipHashes:         make(map[string]bool, len(file.Internal.IPHashes)),
+		cookie:           file.Internal.Cookie,
+	}
+	switch file.Internal.Action {
+	case "", "tag":
+	case "drop":
+		rules.internalDrop = true
+	default:
+		return fmt.Errorf("unknown internal action %q", file.Internal.Action)
+	}
+	for _, h := range file.Internal.IPHashes {
+		rules.ipHashes[strings.ToLower(h)] = true
+	}
+	if file.Internal.QueryParam != "" {
+		rules.queryKey = "url_query_" + file.Internal.QueryParam
+	}
+
+	f.rules.Store(rules)
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func (f *FilterEnricher) Name() string { return "filter" }
+
+func (f *FilterEnricher) Enrich(in *EnrichInput, e *Event) error {
+	rule, drop := f.Check(in)
+	if rule == "" {
+		return nil
+	}
+	if drop {
+		metricEventsFiltered.WithLabelValues(rule, "drop").Inc()
+		return ErrDropEvent
+	}
+	metricEventsFiltered.WithLabelValues(rule, "tag").Inc()
+	e.Traffic["traffic_type"] = "internal"
+	return nil
+}
+
+// Check returns the rule that matches the event, if any, and whether it is
+// dropped (otherwise it is tagged as internal). It only reads the raw event,
+// so HandleIngest can run it before fingerprint linking touches any state.
+func (f *FilterEnricher) Check(in *EnrichInput) (rule string, drop bool) {
+	rules := f.rules.Load()
+	if rules == nil {
+		return "", false
+	}
+
+	if len(rules.allowedHosts) > 0 && !matchAnyDomain(strings.ToLower(in.URLParts["url_host"]), rules.allowedHosts) {
+		return filterHostNotAllowed, true
+	}
+	if len(rules.blockedReferrers) > 0 {
+		if ref := strings.ToLower(referrerHost(in.Raw)); ref != "" && matchAnyDomain(ref, rules.blockedReferrers) {
+			return filterBlockedReferrer, true
+		}
+	}
+
+	rule = rules.internalRule(in)
+	return rule, rule != "" && rules.internalDrop
+}
+
+// Prefilter reports whether the filter drops the raw event; a nil filter
+// drops nothing. Dropped events are counted here and never reach MapToEvent.
+func (f *FilterEnricher) Prefilter(raw map[string]interface{}) bool {
+	if f == nil {
+		return false
+	}
+	rule, drop := f.Check(newEnrichInput(raw))
+	if drop {
+		metricEventsFiltered.WithLabelValues(rule, "drop").Inc()
+	}
+	return drop
+}
+
+// internalRule returns the rule that marks the event as internal traffic, or "".
+func (c *compiledFilter) internalRule(in *EnrichInput) string {
+	if len(c.ipHashes) > 0 {
+		realIPHash := ""
+		if server, ok := in.Raw["server"].(map[string]interface{}); ok {
+			realIPHash = toString(server["real_ip_hash"])
+		}
+		if c.ipHashes[strings.ToLower(in.IPHash)] || c.ipHashes[strings.ToLower(realIPHash)] {
+			return filterInternalIP
+		}
+	}
+	if c.queryKey != "" && in.URLParts[c.queryKey] != "" {
+		return filterInternalQuery
+	}
+	if c.cookie {
+		if server, ok := in.Raw["server"].(map[string]interface{}); ok && toString(server["internal"]) != "" {
+			return filterInternalCookie
+		}
+	}
+	return ""
+}
+
+// referrerHost returns the host of the raw event's referrer, as parseTraffic
+// stores it in traffic.referrer_host.
+func referrerHost(raw map[string]interface{}) string {
+	return parseURL(Validate(toString(raw["referrer"]), Sanitize, MaxLength(2048)))["url_host"]
+}
+
+func matchAnyDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		if matchDomain(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = strings.ToLower(strings.TrimSpace(s))
+	}
+	return out
+}
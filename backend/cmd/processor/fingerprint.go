@@ -2,25 +2,50 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v4"
 )
 
 const (
-	// nGramSize defines the size of n-grams for Jaccard similarity calculation
-	nGramSize = 3
-	// fingerprintSimilarityThreshold defines the minimum Jaccard similarity
-	// for two fingerprints to be considered a match (0.0 to 1.0)
-	fingerprintSimilarityThreshold = 0.75
+	// fpMaxPerBand caps the entries read from one LSH band per lookup
+	fpMaxPerBand = 32
+	// fpMaxCandidates caps the candidates scored per lookup
+	fpMaxCandidates = 16
 )
 
+// Fingerprint index keys, per device bucket (see FingerprintConfig.bucketKey):
+//
+//	fp/v/<bucket>/<visitor_id>                                   → ShortTermIdentity (JSON)
+//	fp/lsh2/<bucket>/<signal>.<band>/<band_hash>/<age>/<visitor_id> → empty; one per LSH band of each signal
+//
+// <bucket> is a hash of the bucket key and the n-gram size. <age> is the
+// inverted time the band keys were written, so a band lists its most recently
+// indexed visitors first. A lookup reads the fingerprint's own bands instead
+// of the whole bucket, and a visitor only ever writes its own keys.
+const (
+	fpIdentityPrefix = "fp/v/"
+	fpBandKeyPrefix  = "fp/lsh2/"
+)
+
+// fpIndexVersion is the band key layout. Records indexed under an older
+// layout (fp/lsh/, without <age>) are reindexed on the visitor's next event.
+const fpIndexVersion = 2
+
 // ShortTermIdentity stores data for identification within a short window
 type ShortTermIdentity struct {
 	VisitorID   string          `json:"vid"`
 	Fingerprint FingerprintData `json:"fp"`
 	SeenAt      time.Time       `json:"t"`
+	IndexedAt   time.Time       `json:"ix"` // When the band keys were last written
+	IndexVer    int             `json:"iv,omitempty"`
 }
 
 type FingerprintData struct {
@@ -32,7 +57,7 @@ type FingerprintData struct {
 
 type FingerprintService struct {
 	db  *badger.DB
-	ttl time.Duration
+	cfg *FingerprintConfig
 }
 
 // jaccardSimilarity computes Jaccard similarity coefficient for two hash strings using n-grams.
@@ -45,20 +70,21 @@ func jaccardSimilarity(hash1, hash2 string, n int) float64 {
 		return 0.0
 	}
 
-	set1 := make(map[string]bool)
-	set2 := make(map[string]bool)
-
-	for i := 0; i <= len(hash1)-n; i++ {
-		set1[hash1[i:i+n]] = true
-	}
-	for i := 0; i <= len(hash2)-n; i++ {
-		set2[hash2[i:i+n]] = true
-	}
+	set1 := ngramSet(hash1, n)
+	set2 := ngramSet(hash2, n)
 
+	// Both sets are sorted: count the intersection in one merge pass
 	intersection := 0
-	for k := range set1 {
-		if set2[k] {
+	for i, j := 0, 0; i < len(set1) && j < len(set2); {
+		switch {
+		case set1[i] < set2[j]:
+			i++
+		case set1[i] > set2[j]:
+			j++
+		default:
 			intersection++
+			i++
+			j++
 		}
 	}
 
@@ -70,102 +96,75 @@ func jaccardSimilarity(hash1, hash2 string, n int) float64 {
 	return float64(intersection) / float64(union)
 }
 
-// fuzzyMatch checks if two hash strings are similar based on Jaccard similarity threshold.
-func fuzzyMatch(hash1, hash2 string, threshold float64) bool {
-	if hash1 == "" || hash2 == "" {
-		return false
+// ngramSet returns the hashed n-grams of s, sorted and deduplicated.
+func ngramSet(s string, n int) []uint64 {
+	set := make([]uint64, 0, len(s)-n+1)
+	for i := 0; i+n <= len(s); i++ {
+		set = append(set, fnv1a(s[i:i+n]))
 	}
-	similarity := jaccardSimilarity(hash1, hash2, nGramSize)
-	return similarity >= threshold
+	slices.Sort(set)
+	return slices.Compact(set)
 }
 
-// NewFingerprintService initializes BadgerDB
-func NewFingerprintService(dbPath string, ttl time.Duration) (*FingerprintService, error) {
-	opts := badger.DefaultOptions(dbPath)
-	opts.Logger = nil // Disable default logger
-
-	db, err := badger.Open(opts)
-	if err != nil {
-		return nil, err
-	}
-
-	// Start GC loop to reclaim disk space
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-		again:
-			err := db.RunValueLogGC(0.7)
-			if err == nil {
-				goto again
-			}
-		}
-	}()
-
+// NewFingerprintService creates the fingerprint cache on top of an open BadgerDB.
+func NewFingerprintService(db *badger.DB, cfg *FingerprintConfig) *FingerprintService {
 	return &FingerprintService{
 		db:  db,
-		ttl: ttl,
-	}, nil
+		cfg: cfg,
+	}
 }
 
-// Close closes the database connection
-func (s *FingerprintService) Close() error {
-	return s.db.Close()
+// FingerprintSighting is a visitor's fingerprint looked up by Identify but
+// not indexed yet; Index records it.
+type FingerprintSighting struct {
+	bucket    string
+	visitorID string
+	fp        FingerprintData
+	bands     map[string][]string
+	own       *ShortTermIdentity // The visitor's current record, if any
+	at        time.Time
 }
 
-// Identify checks if the current visitor matches any recent visitor in the cache.
-// Returns (linkedVisitorID, found).
-func (s *FingerprintService) Identify(rawEvent map[string]interface{}) (string, bool) {
+// Identify checks if the current visitor matches any recent visitor in the
+// cache. It only reads: the caller passes the returned sighting to Index once
+// the event is accepted, so events the filter or the tracking plan reject
+// leave no fingerprint behind. Returns the link evidence (EventID is left to
+// the caller), nil if no match was found, and the sighting, nil if the event
+// carries nothing to index.
+func (s *FingerprintService) Identify(rawEvent map[string]interface{}) (*IdentityLink, *FingerprintSighting) {
+	metricIdentifyCalls.Inc()
+
 	device, ok := rawEvent["device"].(map[string]interface{})
 	if !ok {
-		return "", false
+		return nil, nil
 	}
 
-	bucketKey := buildBucketKey(device)
+	bucketKey := s.cfg.bucketKey(device)
 	if bucketKey == "" {
-		return "", false
+		return nil, nil
 	}
 
 	currentFP := extractHeavyFingerprint(rawEvent, device)
 	if currentFP == nil {
-		return "", false
+		return nil, nil
 	}
 
 	currentVisitorID := extractVisitorID(rawEvent)
 	if currentVisitorID == "" {
-		return "", false
+		return nil, nil
 	}
 
-	return s.processCache(bucketKey, currentVisitorID, *currentFP)
+	return s.lookup(bucketKey, currentVisitorID, *currentFP, time.Now())
 }
 
-// buildBucketKey constructs a stable key for grouping similar users.
-// It uses stable device signals (Timezone, Platform, Language, etc.) and
-// excludes volatile ones (IP, UserAgent versions).
-func buildBucketKey(device map[string]interface{}) string {
-	timezone := toString(device["timezone"])
-	platform := toString(device["platform"])
-	language := toString(device["language"])
-	concurrency := toString(device["hardwareConcurrency"])
-
-	// Protection against empty keys
-	if timezone == "" && platform == "" {
-		return ""
+// Index records a sighting returned by Identify. A nil sighting is a no-op.
+func (s *FingerprintService) Index(sighting *FingerprintSighting) {
+	if sighting == nil {
+		return
 	}
-
-	// Screen Resolution Normalization
-	w := getFloat(device["screenWidth"])
-	h := getFloat(device["screenHeight"])
-	if h > w {
-		w, h = h, w
+	if err := s.index(sighting.bucket, sighting.visitorID, sighting.fp, sighting.bands, sighting.own, sighting.at); err != nil {
+		log.Printf("Failed to index fingerprint: %v", err)
 	}
-	screenRes := fmt.Sprintf("%.0fx%.0f", w, h)
-
-	pixelRatio := getFloat(device["pixelRatio"])
-	colorDepth := getFloat(device["colorDepth"])
-
-	return fmt.Sprintf("%s|%s|%s|%s|%s|%.2f|%.0f",
-		timezone, platform, language, screenRes, concurrency, pixelRatio, colorDepth)
 }
 
 // extractHeavyFingerprint extracts high-entropy fingerprint data (canvas, audio, etc.).
@@ -202,83 +201,312 @@ func extractVisitorID(rawEvent map[string]interface{}) string {
 	return vid
 }
 
-// processCache manages the cache: cleans expired items, finds matches, and adds the current user.
-// Returns the linked VisitorID if a match is found, otherwise empty string.
-func (s *FingerprintService) processCache(bucketKey, currentVisitorID string, currentFP FingerprintData) (string, bool) {
+// processCache looks the fingerprint up and indexes the current visitor as
+// seen at now. Returns the link to the best matching visitor, if any.
+func (s *FingerprintService) processCache(bucketKey, currentVisitorID string, currentFP FingerprintData, now time.Time) (*IdentityLink, bool) {
+	link, sighting := s.lookup(bucketKey, currentVisitorID, currentFP, now)
+	s.Index(sighting)
+	return link, link != nil
+}
+
+// lookup looks the fingerprint up in the bucket's LSH index and scores the
+// candidates that share a band with it. Returns the link to the best matching
+// visitor, if any, and the sighting of the current visitor at now.
+func (s *FingerprintService) lookup(bucketKey, currentVisitorID string, currentFP FingerprintData, now time.Time) (*IdentityLink, *FingerprintSighting) {
 	var bestMatchID string
 	var maxScore float64
-	now := time.Now()
-
-	err := s.db.Update(func(txn *badger.Txn) error {
-		// 1. Get existing candidates
-		var candidates []ShortTermIdentity
-		item, err := txn.Get([]byte(bucketKey))
-		if err == nil {
-			err = item.Value(func(val []byte) error {
-				return json.Unmarshal(val, &candidates)
-			})
-			if err != nil {
-				// If unmarshal fails, we treat it as empty and overwrite
-				candidates = []ShortTermIdentity{}
-			}
-		} else if err != badger.ErrKeyNotFound {
+	var bestScores map[string]float64
+	var own *ShortTermIdentity
+	bucket := fingerprintBucketID(bucketKey, s.cfg.ngramSize)
+	bands := currentFP.lshBands(s.cfg.ngramSize)
+
+	// Read-only, so concurrent events never conflict
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		if own, err = getShortTermIdentity(txn, fpIdentityKey(bucket, currentVisitorID)); err != nil {
 			return err
 		}
 
-		// 2. Filter and Match
-		validCandidates := make([]ShortTermIdentity, 0, len(candidates))
-		for _, cand := range candidates {
-			// TTL logic: even if Badger handles key expiry, the list value might contain old entries
-			// if the key was updated recently. So we filter manually too.
-			if now.Sub(cand.SeenAt) > s.ttl {
+		candidates := lshCandidates(txn, bucket, s.cfg.weighted(bands), currentVisitorID)
+		metricFingerprintCandidates.Observe(float64(len(candidates)))
+		for _, vid := range candidates {
+			cand, err := getShortTermIdentity(txn, fpIdentityKey(bucket, vid))
+			if err != nil {
+				return err
+			}
+			// Band keys outlive their record by up to ttl/2
+			if cand == nil || now.Sub(cand.SeenAt) > s.cfg.ttl {
 				continue
 			}
-			validCandidates = append(validCandidates, cand)
+			scores, score := s.cfg.score(currentFP, cand.Fingerprint)
+			if score > maxScore && s.cfg.accepts(scores, score) {
+				maxScore = score
+				bestMatchID = cand.VisitorID
+				bestScores = scores
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to look up fingerprint: %v", err)
+		return nil, nil
+	}
+
+	sighting := &FingerprintSighting{bucket: bucket, visitorID: currentVisitorID, fp: currentFP, bands: bands, own: own, at: now}
+	if bestMatchID == "" {
+		return nil, sighting
+	}
+	metricIdentifyMatches.Inc()
+	metricMatchScore.Observe(maxScore)
+	return &IdentityLink{
+		Timestamp:  now,
+		OriginalID: currentVisitorID,
+		LinkedID:   bestMatchID,
+		BucketKey:  bucketKey,
+		Scores:     bestScores,
+		Score:      maxScore,
+	}, sighting
+}
+
+// index stores the visitor's record and, when the fingerprint changed or the
+// band keys are getting old, its band keys. A returning visitor with the same
+// fingerprint costs a single small write.
+func (s *FingerprintService) index(bucket, visitorID string, fp FingerprintData, bands map[string][]string, own *ShortTermIdentity, now time.Time) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	if err := s.writeIndex(wb, bucket, visitorID, fp, bands, own, now); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// writeIndex adds the keys written by index to wb.
+func (s *FingerprintService) writeIndex(wb *badger.WriteBatch, bucket, visitorID string, fp FingerprintData, bands map[string][]string, own *ShortTermIdentity, now time.Time) error {
+	record := ShortTermIdentity{VisitorID: visitorID, Fingerprint: fp, SeenAt: now, IndexedAt: now, IndexVer: fpIndexVersion}
+	reindex := own == nil || own.IndexVer != fpIndexVersion || own.Fingerprint != fp || now.Sub(own.IndexedAt) > s.cfg.ttl/2
+	if !reindex {
+		record.IndexedAt = own.IndexedAt
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
 
-			if cand.VisitorID != currentVisitorID {
-				score := calculateSimilarityScore(currentFP, cand.Fingerprint)
-				if score > maxScore && score >= fingerprintSimilarityThreshold {
-					maxScore = score
-					bestMatchID = cand.VisitorID
+	if err := wb.SetEntry(badger.NewEntry([]byte(fpIdentityKey(bucket, visitorID)), data).WithTTL(s.cfg.ttl)); err != nil {
+		return err
+	}
+	if reindex {
+		// Band keys are rewritten at most every ttl/2 and live 1.5*ttl, so they
+		// outlive the record they point to. The keys of the previous write stay
+		// until they expire; lookups count a visitor once per band.
+		age := fpBandAge(now)
+		for signal, hashes := range bands {
+			for band, h := range hashes {
+				key := []byte(fpBandPrefix(bucket, signal, band, h) + age + "/" + visitorID)
+				if err := wb.SetEntry(badger.NewEntry(key, nil).WithTTL(s.cfg.ttl + s.cfg.ttl/2)); err != nil {
+					return err
 				}
 			}
 		}
+	}
+	return nil
+}
 
-		// 3. Add current
-		validCandidates = append(validCandidates, ShortTermIdentity{
-			VisitorID:   currentVisitorID,
-			Fingerprint: currentFP,
-			SeenAt:      now,
-		})
+// Erase deletes the visitors' records and band keys from every bucket.
+// Returns the number of keys deleted.
+func (s *FingerprintService) Erase(visitorIDs []string) (int, error) {
+	if len(visitorIDs) == 0 {
+		return 0, nil
+	}
+	suffixes := make([]string, len(visitorIDs))
+	for i, vid := range visitorIDs {
+		suffixes[i] = "/" + vid
+	}
 
-		// 4. Save
-		data, err := json.Marshal(validCandidates)
-		if err != nil {
-			return err
+	// Keys end with the visitor ID but the bucket is not known: scan them all
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte("fp/")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			for _, suffix := range suffixes {
+				if strings.HasSuffix(key, suffix) {
+					keys = append(keys, it.Item().KeyCopy(nil))
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), wb.Flush()
+}
+
+// lshCandidates returns the visitors sharing at least one band with the
+// fingerprint, most shared bands first (then most recently indexed), at most
+// fpMaxCandidates. Each band is read up to fpMaxPerBand entries, newest
+// first, so signals shared by a large part of the bucket (e.g. the TLS hash
+// of a popular browser) keep lookups bounded and yield the visitors most
+// likely to return rather than an arbitrary slice of the bucket.
+func lshCandidates(txn *badger.Txn, bucket string, bands map[string][]string, exclude string) []string {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	hits := make(map[string]int, fpMaxPerBand)
+	newest := make(map[string]string, fpMaxPerBand) // Smallest <age>: most recent
+	inBand := make(map[string]bool, fpMaxPerBand)
+	for signal, hashes := range bands {
+		for band, h := range hashes {
+			prefix := fpBandPrefix(bucket, signal, band, h)
+			opts.Prefix = []byte(prefix)
+			it := txn.NewIterator(opts)
+			clear(inBand)
+			read := 0
+			for it.Rewind(); it.Valid() && len(inBand) < fpMaxPerBand && read < 4*fpMaxPerBand; it.Next() {
+				read++
+				age, vid, ok := strings.Cut(strings.TrimPrefix(string(it.Item().Key()), prefix), "/")
+				if !ok || inBand[vid] {
+					continue // Older key of a visitor reindexed since
+				}
+				inBand[vid] = true
+				if vid == exclude {
+					continue
+				}
+				hits[vid]++
+				if prev, ok := newest[vid]; !ok || age < prev {
+					newest[vid] = age
+				}
+			}
+			it.Close()
 		}
+	}
 
-		// Set Entry with TTL
-		// Each update refreshes the TTL for the whole bucket
-		return txn.SetEntry(badger.NewEntry([]byte(bucketKey), data).WithTTL(s.ttl))
+	candidates := make([]string, 0, len(hits))
+	for vid := range hits {
+		candidates = append(candidates, vid)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if hits[a] != hits[b] {
+			return hits[a] > hits[b]
+		}
+		if newest[a] != newest[b] {
+			return newest[a] < newest[b]
+		}
+		return a < b
 	})
+	if len(candidates) > fpMaxCandidates {
+		candidates = candidates[:fpMaxCandidates]
+	}
+	return candidates
+}
 
+func getShortTermIdentity(txn *badger.Txn, key string) (*ShortTermIdentity, error) {
+	item, err := txn.Get([]byte(key))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ident ShortTermIdentity
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &ident)
+	})
 	if err != nil {
-		fmt.Printf("Fingerprint DB Error: %v\n", err)
-		return "", false
+		// A corrupt record is treated as missing and overwritten
+		return nil, nil
+	}
+	return &ident, nil
+}
+
+// signal returns the hash of a signal by name (see fingerprintSignals).
+func (fp FingerprintData) signal(name string) string {
+	switch name {
+	case "tls":
+		return fp.TLSHash
+	case "canvas":
+		return fp.CanvasHash
+	case "webgl":
+		return fp.WebGLHash
+	case "audio":
+		return fp.AudioHash
 	}
+	return ""
+}
+
+// lshBands returns the LSH band hashes of each non-empty signal. All signals
+// are indexed, so changing a weight does not require reindexing.
+func (fp FingerprintData) lshBands(ngramSize int) map[string][]string {
+	bands := make(map[string][]string, len(fingerprintSignals))
+	for _, signal := range fingerprintSignals {
+		if sig := minHash(fp.signal(signal), ngramSize); sig != nil {
+			bands[signal] = lshBandHashes(sig)
+		}
+	}
+	return bands
+}
 
-	return bestMatchID, bestMatchID != ""
+// fingerprintBucketID shortens a bucket key for use in index keys (bucket
+// keys contain "/", e.g. in the timezone). Signatures depend on the n-gram
+// size, so changing it starts a fresh index.
+func fingerprintBucketID(bucketKey string, ngramSize int) string {
+	return fmt.Sprintf("%016x", fnv1a(strconv.Itoa(ngramSize)+"|"+bucketKey))
 }
 
-// calculateSimilarityScore sums up Jaccard similarities for all available signals.
-// Higher score means better match.
-func calculateSimilarityScore(fp1, fp2 FingerprintData) float64 {
-	score := 0.0
-	score += jaccardSimilarity(fp1.TLSHash, fp2.TLSHash, nGramSize)
-	score += jaccardSimilarity(fp1.CanvasHash, fp2.CanvasHash, nGramSize)
-	score += jaccardSimilarity(fp1.WebGLHash, fp2.WebGLHash, nGramSize)
-	score += jaccardSimilarity(fp1.AudioHash, fp2.AudioHash, nGramSize)
-	return score
+func fpIdentityKey(bucket, visitorID string) string {
+	return fpIdentityPrefix + bucket + "/" + visitorID
+}
+
+func fpBandPrefix(bucket, signal string, band int, hash string) string {
+	return fmt.Sprintf("%s%s/%s.%d/%s/", fpBandKeyPrefix, bucket, signal, band, hash)
+}
+
+// fpBandAge formats t so that later times sort first.
+func fpBandAge(t time.Time) string {
+	return fmt.Sprintf("%016x", ^uint64(t.UnixNano()))
+}
+
+// score returns the Jaccard similarity of each signal and their weighted sum.
+// Higher score means better match. A signal missing on either side scores 0.
+func (c *FingerprintConfig) score(fp1, fp2 FingerprintData) (map[string]float64, float64) {
+	scores := make(map[string]float64, len(fingerprintSignals))
+	total := 0.0
+	for _, signal := range fingerprintSignals {
+		sim := 0.0
+		if h1, h2 := fp1.signal(signal), fp2.signal(signal); h1 != "" && h2 != "" {
+			sim = jaccardSimilarity(h1, h2, c.ngramSize)
+		}
+		scores[signal] = sim
+		total += c.weights[signal] * sim
+	}
+	return scores, total
+}
+
+// weighted keeps the bands of signals with a positive weight: the others
+// cannot contribute to the score.
+func (c *FingerprintConfig) weighted(bands map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(bands))
+	for signal, hashes := range bands {
+		if c.weights[signal] > 0 {
+			out[signal] = hashes
+		}
+	}
+	return out
 }
 
 // Helper to safely get nested map values
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+const testBucketKey = "Europe/Berlin|iPhone|de-DE|844x390|6|3.00|24"
+
+// fingerprintFixture is a fingerprint service over an in-memory Badger DB and
+// a source of random hashes.
+type fingerprintFixture struct {
+	svc *FingerprintService
+	rng *rand.Rand
+}
+
+func newFingerprintFixture(tb testing.TB, cfg *FingerprintConfig) *fingerprintFixture {
+	tb.Helper()
+	db := openScratchBadger("")
+	tb.Cleanup(func() { db.Close() })
+	return &fingerprintFixture{svc: NewFingerprintService(db, cfg), rng: rand.New(rand.NewSource(1))}
+}
+
+func (f *fingerprintFixture) hash() string {
+	const hexDigits = "0123456789abcdef"
+	b := make([]byte, 64)
+	for i := range b {
+		b[i] = hexDigits[f.rng.Intn(len(hexDigits))]
+	}
+	return string(b)
+}
+
+// fill indexes n visitors v0…v<n-1> in one write batch, seen a second apart
+// before now. TLS hashes come from a pool of tlsPool, the other hashes are
+// random.
+func (f *fingerprintFixture) fill(tb testing.TB, n, tlsPool int, now time.Time) []FingerprintData {
+	tb.Helper()
+	tls := make([]string, tlsPool)
+	for i := range tls {
+		tls[i] = f.hash()
+	}
+	bucket := fingerprintBucketID(testBucketKey, f.svc.cfg.ngramSize)
+	wb := f.svc.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	fps := make([]FingerprintData, n)
+	for i := range fps {
+		fps[i] = FingerprintData{CanvasHash: f.hash(), AudioHash: f.hash(), WebGLHash: f.hash(), TLSHash: tls[i%tlsPool]}
+		seen := now.Add(time.Duration(i-n) * time.Second)
+		if err := f.svc.writeIndex(wb, bucket, fmt.Sprintf("v%d", i), fps[i], fps[i].lshBands(f.svc.cfg.ngramSize), nil, seen); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	return fps
+}
+
+// changeCanvas flips one bit of the canvas hash, as a returning visitor whose
+// rendering changed slightly.
+func (f *fingerprintFixture) changeCanvas(fp FingerprintData) FingerprintData {
+	canvas := []byte(fp.CanvasHash)
+	canvas[f.rng.Intn(len(canvas))] ^= 1
+	fp.CanvasHash = string(canvas)
+	return fp
+}
+
+func TestFingerprintReturningVisitorLinked(t *testing.T) {
+	f := newFingerprintFixture(t, DefaultFingerprintConfig())
+	now := time.Now()
+	fps := f.fill(t, 1000, 5, now)
+
+	for _, i := range []int{0, 500, 999} {
+		link, ok := f.svc.processCache(testBucketKey, fmt.Sprintf("new%d", i), f.changeCanvas(fps[i]), now)
+		if !ok {
+			t.Errorf("v%d with a changed canvas was not linked", i)
+			continue
+		}
+		if want := fmt.Sprintf("v%d", i); link.LinkedID != want {
+			t.Errorf("v%d linked to %s", i, link.LinkedID)
+		}
+	}
+}
+
+// TestFingerprintSharedSignalNotLinked is the precision gate: a visitor that
+// shares only one hash with the bucket (a popular TLS fingerprint, or GPU)
+// is never linked, even with a threshold one shared hash would reach.
+func TestFingerprintSharedSignalNotLinked(t *testing.T) {
+	lenient := *DefaultFingerprintConfig()
+	lenient.threshold = 0.5
+
+	for name, cfg := range map[string]*FingerprintConfig{"default": DefaultFingerprintConfig(), "threshold 0.5": &lenient} {
+		t.Run(name, func(t *testing.T) {
+			f := newFingerprintFixture(t, cfg)
+			now := time.Now()
+			fps := f.fill(t, 2000, 1, now) // Every visitor has the same TLS hash
+
+			links := 0
+			for i := 0; i < 200; i++ {
+				fp := FingerprintData{CanvasHash: f.hash(), AudioHash: f.hash(), WebGLHash: f.hash(), TLSHash: fps[0].TLSHash}
+				if i%2 == 1 {
+					fp.TLSHash = ""
+					fp.WebGLHash = fps[i].WebGLHash // Same GPU as an indexed visitor
+				}
+				if _, ok := f.svc.processCache(testBucketKey, fmt.Sprintf("new%d", i), fp, now); ok {
+					links++
+				}
+			}
+			if links > 0 {
+				t.Errorf("%d of 200 new visitors linked by one shared hash", links)
+			}
+		})
+	}
+}
+
+// TestLSHCandidatesPreferRecent checks that a band holding more than
+// fpMaxPerBand visitors yields the most recently indexed ones, not the first
+// visitor IDs in key order.
+func TestLSHCandidatesPreferRecent(t *testing.T) {
+	f := newFingerprintFixture(t, DefaultFingerprintConfig())
+	now := time.Now()
+	fp := FingerprintData{CanvasHash: f.hash(), AudioHash: f.hash(), WebGLHash: f.hash(), TLSHash: f.hash()}
+
+	// Key order is the reverse of recency: a000 is the oldest
+	const n = 4 * fpMaxPerBand
+	for i := 0; i < n; i++ {
+		f.svc.processCache(testBucketKey, fmt.Sprintf("a%03d", i), fp, now.Add(time.Duration(i)*time.Minute))
+	}
+
+	link, ok := f.svc.processCache(testBucketKey, "returning", fp, now.Add(n*time.Minute))
+	if !ok {
+		t.Fatal("identical fingerprint was not linked")
+	}
+	if want := fmt.Sprintf("a%03d", n-1); link.LinkedID != want {
+		t.Errorf("linked to %s, want the most recent visitor %s", link.LinkedID, want)
+	}
+}
+
+// BenchmarkFingerprintLookup measures lookups in a bucket of 100,000 indexed
+// visitors sharing 20 TLS hashes, so every TLS band is hot.
+func BenchmarkFingerprintLookup(b *testing.B) {
+	f := newFingerprintFixture(b, DefaultFingerprintConfig())
+	now := time.Now()
+	fps := f.fill(b, 100000, 20, now)
+
+	b.Run("new_visitor", func(b *testing.B) {
+		queries := make([]FingerprintData, b.N)
+		for i := range queries {
+			queries[i] = FingerprintData{CanvasHash: f.hash(), AudioHash: f.hash(), WebGLHash: f.hash(), TLSHash: fps[i%len(fps)].TLSHash}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := f.svc.processCache(testBucketKey, fmt.Sprintf("n%d", i), queries[i], now); ok {
+				b.Fatalf("new visitor %d linked", i)
+			}
+		}
+	})
+
+	b.Run("returning_visitor", func(b *testing.B) {
+		queries := make([]FingerprintData, b.N)
+		origins := make([]int, b.N)
+		for i := range queries {
+			origins[i] = len(fps) - 1 - f.rng.Intn(len(fps)/10) // Seen recently
+			queries[i] = f.changeCanvas(fps[origins[i]])
+		}
+		missed := 0
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			link, ok := f.svc.processCache(testBucketKey, fmt.Sprintf("r%d", i), queries[i], now)
+			if !ok || link.LinkedID != fmt.Sprintf("v%d", origins[i]) {
+				missed++
+			}
+		}
+		b.ReportMetric(float64(missed)/float64(b.N), "missed/op")
+	})
+}
+
+// BenchmarkFingerprintIndex measures indexing a new visitor into a bucket
+// of 100,000.
+func BenchmarkFingerprintIndex(b *testing.B) {
+	f := newFingerprintFixture(b, DefaultFingerprintConfig())
+	now := time.Now()
+	f.fill(b, 100000, 20, now)
+	bucket := fingerprintBucketID(testBucketKey, f.svc.cfg.ngramSize)
+
+	queries := make([]FingerprintData, b.N)
+	for i := range queries {
+		queries[i] = FingerprintData{CanvasHash: f.hash(), AudioHash: f.hash(), WebGLHash: f.hash(), TLSHash: f.hash()}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fp := queries[i]
+		if err := f.svc.index(bucket, fmt.Sprintf("n%d", i), fp, fp.lshBands(f.svc.cfg.ngramSize), nil, now); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestFingerprintIndexAfterLookup checks that a lookup writes nothing until
+// its sighting is indexed, so rejected events leave no fingerprint behind.
+func TestFingerprintIndexAfterLookup(t *testing.T) {
+	f := newFingerprintFixture(t, DefaultFingerprintConfig())
+	now := time.Now()
+	fp := FingerprintData{CanvasHash: f.hash(), AudioHash: f.hash(), WebGLHash: f.hash(), TLSHash: f.hash()}
+
+	link, rejected := f.svc.lookup(testBucketKey, "rejected", fp, now)
+	if link != nil || rejected == nil {
+		t.Fatalf("first lookup = %v, %v; want no link and a sighting", link, rejected)
+	}
+	if link, _ := f.svc.lookup(testBucketKey, "next", fp, now); link != nil {
+		t.Fatalf("visitor linked to %s, which was never indexed", link.LinkedID)
+	}
+
+	_, accepted := f.svc.lookup(testBucketKey, "accepted", fp, now)
+	f.svc.Index(accepted)
+	link, _ = f.svc.lookup(testBucketKey, "next", fp, now)
+	if link == nil || link.LinkedID != "accepted" {
+		t.Fatalf("link = %+v, want to the indexed visitor", link)
+	}
+	f.svc.Index(nil)
+}
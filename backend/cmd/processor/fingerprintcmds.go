@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// openScratchBadger opens a throwaway Badger DB: in-memory unless dir is set.
+func openScratchBadger(dir string) *badger.DB {
+	opts := badger.DefaultOptions(dir).WithInMemory(dir == "")
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		log.Fatalf("open badger: %v", err)
+	}
+	return db
+}
+
+// runBenchFingerprint fills one device bucket of a scratch Badger DB with
+// synthetic visitors and measures lookups against it: returning visitors
+// (new visitor_id, canvas hash slightly changed) must be linked to their
+// earlier ID, new visitors must not be linked to anyone.
+func runBenchFingerprint(args []string) {
+	fs := flag.NewFlagSet("bench-fingerprint", flag.ExitOnError)
+	candidates := fs.Int("candidates", 100000, "visitors indexed in the bucket before measuring")
+	lookups := fs.Int("lookups", 10000, "lookups to measure (half returning, half new visitors)")
+	workers := fs.Int("workers", 4, "concurrent lookups")
+	tlsPool := fs.Int("tls-pool", 20, "distinct TLS hashes in the bucket (shared TLS makes hot LSH bands)")
+	dir := fs.String("dir", "", "Badger directory (default: in-memory)")
+	fs.Parse(args)
+
+	db := openScratchBadger(*dir)
+	defer db.Close()
+	svc := NewFingerprintService(db, mustLoadFingerprintConfig())
+
+	rng := rand.New(rand.NewSource(1))
+	randHash := func() string {
+		const hexDigits = "0123456789abcdef"
+		b := make([]byte, 64)
+		for i := range b {
+			b[i] = hexDigits[rng.Intn(len(hexDigits))]
+		}
+		return string(b)
+	}
+	tlsHashes := make([]string, *tlsPool)
+	for i := range tlsHashes {
+		tlsHashes[i] = randHash()
+	}
+	randFP := func() FingerprintData {
+		return FingerprintData{CanvasHash: randHash(), AudioHash: randHash(), WebGLHash: randHash(), TLSHash: tlsHashes[rng.Intn(len(tlsHashes))]}
+	}
+	const bucketKey = "Europe/Berlin|iPhone|de-DE|844x390|6|3.00|24"
+
+	// 1. Index
+	fps := make([]FingerprintData, *candidates)
+	start := time.Now()
+	for i := range fps {
+		fps[i] = randFP()
+		svc.processCache(bucketKey, fmt.Sprintf("v%d", i), fps[i], time.Now())
+	}
+	elapsed := time.Since(start)
+	log.Printf("Indexed %d visitors in %s (%.0f/s)", len(fps), elapsed.Round(time.Millisecond), float64(len(fps))/elapsed.Seconds())
+
+	// 2. Lookups: even ones return with a changed canvas, odd ones are new
+	type query struct {
+		fp        FingerprintData
+		wantMatch string
+	}
+	queries := make([]query, *lookups)
+	returning := rng.Perm(len(fps)) // Each indexed visitor returns at most once
+	for i := range queries {
+		if i%2 == 1 || i/2 >= len(returning) {
+			queries[i] = query{fp: randFP()}
+			continue
+		}
+		orig := returning[i/2]
+		fp := fps[orig]
+		canvas := []byte(fp.CanvasHash)
+		canvas[rng.Intn(len(canvas))] ^= 1
+		fp.CanvasHash = string(canvas)
+		queries[i] = query{fp: fp, wantMatch: fmt.Sprintf("v%d", orig)}
+	}
+
+	latencies := make([]time.Duration, len(queries))
+	var found, missed, wrong, falseLinks int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int)
+	start = time.Now()
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				q := queries[i]
+				t := time.Now()
+				link, ok := svc.processCache(bucketKey, fmt.Sprintf("q%d", i), q.fp, time.Now())
+				latencies[i] = time.Since(t)
+
+				mu.Lock()
+				switch {
+				case q.wantMatch == "" && ok:
+					falseLinks++
+				case q.wantMatch == "":
+				case !ok:
+					missed++
+				case link.LinkedID == q.wantMatch:
+					found++
+				default:
+					wrong++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range queries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed = time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	log.Printf("Lookups: %d in %s (%.0f/s, %d workers), p50 %s, p99 %s",
+		len(queries), elapsed.Round(time.Millisecond), float64(len(queries))/elapsed.Seconds(), *workers, percentile(0.5), percentile(0.99))
+	log.Printf("Returning visitors: %d linked, %d linked to the wrong visitor, %d missed; new visitors falsely linked: %d",
+		found, wrong, missed, falseLinks)
+}
+
+// runEvalFingerprint replays a labeled NDJSON file (events in time order, each
+// with its true identity in a label field) through fingerprint matching on a
+// scratch Badger DB and reports, per score threshold, how many links would be
+// made and how many of them join different identities.
+func runEvalFingerprint(args []string) {
+	fs := flag.NewFlagSet("eval-fingerprint", flag.ExitOnError)
+	input := fs.String("input", "", "labeled NDJSON file (- for stdin)")
+	labelField := fs.String("label", "true_id", "top-level event field holding the true identity")
+	thresholdList := fs.String("thresholds", "", "comma-separated score thresholds (default: steps of 0.25 up to the sum of the weights)")
+	fs.Parse(args)
+	if *input == "" {
+		log.Fatalf("-input is required")
+	}
+
+	cfg := mustLoadFingerprintConfig()
+	thresholds, err := evalThresholds(*thresholdList, cfg)
+	if err != nil {
+		log.Fatalf("invalid -thresholds: %v", err)
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("open input: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db := openScratchBadger("")
+	defer db.Close()
+	// Every best candidate is returned; thresholds are applied below
+	evalCfg := *cfg
+	evalCfg.threshold = 1e-9
+	svc := NewFingerprintService(db, &evalCfg)
+
+	type result struct {
+		score    float64
+		correct  bool // Linked visitor has the same label
+		positive bool // A different visitor with the same label was seen within the TTL
+	}
+	var results []result
+	visitorLabels := make(map[string]string)          // visitor_id → label
+	lastSeen := make(map[string]map[string]time.Time) // label → visitor_id → last event
+	total, unlabeled, unusable, conflicts := 0, 0, 0, 0
+
+	reader := bufio.NewReaderSize(r, 1<<20)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			rawEvents, _, decodeErr := decodeLine(line)
+			if decodeErr != nil {
+				log.Fatalf("line %d: %v", lineNo, decodeErr)
+			}
+			for _, raw := range rawEvents {
+				total++
+				label := toString(raw.Data[*labelField])
+				if label == "" {
+					unlabeled++
+					continue
+				}
+				device, _ := raw.Data["device"].(map[string]interface{})
+				bucketKey := cfg.bucketKey(device)
+				fp := extractHeavyFingerprint(raw.Data, device)
+				vid := extractVisitorID(raw.Data)
+				if device == nil || bucketKey == "" || fp == nil || vid == "" {
+					unusable++
+					continue
+				}
+				ts := time.Now()
+				if v, ok := raw.Data["timestamp"]; ok {
+					ts = parseTimestamp(v)
+				}
+
+				if prev, ok := visitorLabels[vid]; ok && prev != label {
+					conflicts++
+				} else if !ok {
+					visitorLabels[vid] = label
+				}
+				res := result{}
+				for other, seen := range lastSeen[label] {
+					if other != vid && ts.Sub(seen) <= cfg.ttl {
+						res.positive = true
+						break
+					}
+				}
+				if link, ok := svc.processCache(bucketKey, vid, *fp, ts); ok {
+					res.score = link.Score
+					res.correct = visitorLabels[link.LinkedID] == label
+				}
+				results = append(results, res)
+
+				if lastSeen[label] == nil {
+					lastSeen[label] = make(map[string]time.Time)
+				}
+				lastSeen[label][vid] = ts
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Fatalf("read input: %v", err)
+		}
+	}
+
+	positives := 0
+	for _, res := range results {
+		if res.positive {
+			positives++
+		}
+	}
+	fmt.Printf("Events: %d read, %d evaluated, %d unlabeled, %d without fingerprint/bucket/visitor_id\n",
+		total, len(results), unlabeled, unusable)
+	fmt.Printf("Linkable events (a different visitor_id of the same identity seen within %s): %d\n", cfg.ttl, positives)
+	if conflicts > 0 {
+		fmt.Printf("Warning: %d events reuse a visitor_id first seen with another label\n", conflicts)
+	}
+	fmt.Println()
+
+	ratio := func(n, d int) string {
+		if d == 0 {
+			return "-"
+		}
+		return strconv.FormatFloat(float64(n)/float64(d), 'f', 3, 64)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "threshold\tlinks\tcorrect\tfalse\tprecision\trecall\tfalse_merge_rate\t")
+	for _, t := range thresholds {
+		links, correct := 0, 0
+		for _, res := range results {
+			if res.score > 0 && res.score >= t {
+				links++
+				if res.correct {
+					correct++
+				}
+			}
+		}
+		marker := ""
+		if math.Abs(t-cfg.threshold) < 1e-9 {
+			marker = " *"
+		}
+		fmt.Fprintf(tw, "%.2f%s\t%d\t%d\t%d\t%s\t%s\t%s\t\n", t, marker, links, correct, links-correct,
+			ratio(correct, links), ratio(correct, positives), ratio(links-correct, len(results)))
+	}
+	tw.Flush()
+	fmt.Println("\nprecision = correct/links, recall = correct/linkable events, false_merge_rate = false/evaluated events; * = configured threshold")
+}
+
+// evalThresholds parses -thresholds, or returns steps of 0.25 up to the
+// maximum score plus the configured threshold.
+func evalThresholds(list string, cfg *FingerprintConfig) ([]float64, error) {
+	var out []float64
+	if list == "" {
+		for t := 0.25; t <= cfg.maxScore()+1e-9; t += 0.25 {
+			out = append(out, t)
+		}
+		out = append(out, cfg.threshold)
+	} else {
+		for _, part := range strings.Split(list, ",") {
+			t, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || t <= 0 {
+				return nil, fmt.Errorf("%q is not a positive number", part)
+			}
+			out = append(out, t)
+		}
+	}
+	sort.Float64s(out)
+	// Drop duplicates (the configured threshold may be one of the steps)
+	uniq := out[:0]
+	for i, t := range out {
+		if i == 0 || t-out[i-1] > 1e-9 {
+			uniq = append(uniq, t)
+		}
+	}
+	return uniq, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fingerprint signals: keys of the weights map and of identity_links.signal_scores.
+var fingerprintSignals = []string{"tls", "canvas", "webgl", "audio"}
+
+// defaultFingerprintConfigJSON is the bundled matching config, used unless
+// FINGERPRINT_CONFIG is set.
+//
+//go:embed fingerprint.json
+var defaultFingerprintConfigJSON []byte
+
+// FingerprintConfigFile is the fingerprint-matching config. A candidate's
+// score is the weighted sum of the per-signal n-gram Jaccard similarities;
+// the best candidate is linked when its score is at least threshold and at
+// least min_signals weighted signals reach signal_match similarity.
+//
+//   - ttl: how long a visitor stays a candidate after its last event.
+//   - bucket.fields: device fields forming the bucket key; only visitors in
+//     the same bucket are compared. "screen" is the resolution with the
+//     longer side first; other names are keys of the tracker's device object.
+//   - bucket.required_any: events with none of these fields are not bucketed.
+type FingerprintConfigFile struct {
+	TTL         string             `json:"ttl"`
+	NGramSize   int                `json:"ngram_size"`
+	Threshold   float64            `json:"threshold"`
+	MinSignals  int                `json:"min_signals"`  // Default 2
+	SignalMatch float64            `json:"signal_match"` // Default 0.5
+	Weights     map[string]float64 `json:"weights"`
+	Bucket      struct {
+		Fields      []string `json:"fields"`
+		RequiredAny []string `json:"required_any"`
+	} `json:"bucket"`
+}
+
+// FingerprintConfig is a compiled fingerprint-matching config.
+type FingerprintConfig struct {
+	ttl            time.Duration
+	ngramSize      int
+	threshold      float64
+	minSignals     int
+	signalMatch    float64
+	weights        map[string]float64
+	bucketFields   []string
+	bucketRequired []string
+}
+
+// ParseFingerprintConfig compiles a fingerprint-matching config.
+func ParseFingerprintConfig(data []byte) (*FingerprintConfig, error) {
+	var file FingerprintConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	cfg := &FingerprintConfig{
+		ngramSize:      file.NGramSize,
+		threshold:      file.Threshold,
+		minSignals:     file.MinSignals,
+		signalMatch:    file.SignalMatch,
+		weights:        make(map[string]float64, len(fingerprintSignals)),
+		bucketFields:   file.Bucket.Fields,
+		bucketRequired: file.Bucket.RequiredAny,
+	}
+	var err error
+	if cfg.ttl, err = time.ParseDuration(file.TTL); err != nil || cfg.ttl <= 0 {
+		return nil, fmt.Errorf("invalid ttl %q", file.TTL)
+	}
+	if cfg.ngramSize < 1 {
+		return nil, fmt.Errorf("ngram_size must be at least 1, got %d", cfg.ngramSize)
+	}
+	if cfg.threshold <= 0 {
+		return nil, fmt.Errorf("threshold must be positive, got %v", cfg.threshold)
+	}
+	if cfg.minSignals == 0 {
+		cfg.minSignals = 2
+	}
+	if cfg.minSignals < 1 || cfg.minSignals > len(fingerprintSignals) {
+		return nil, fmt.Errorf("min_signals must be between 1 and %d, got %d", len(fingerprintSignals), cfg.minSignals)
+	}
+	if cfg.signalMatch == 0 {
+		cfg.signalMatch = 0.5
+	}
+	if cfg.signalMatch < 0 || cfg.signalMatch > 1 {
+		return nil, fmt.Errorf("signal_match must be between 0 and 1, got %v", cfg.signalMatch)
+	}
+	for signal, w := range file.Weights {
+		if !isFingerprintSignal(signal) {
+			return nil, fmt.Errorf("unknown signal %q in weights (want %s)", signal, strings.Join(fingerprintSignals, ", "))
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("negative weight for %s", signal)
+		}
+		cfg.weights[signal] = w
+	}
+	if len(cfg.bucketFields) == 0 {
+		return nil, fmt.Errorf("bucket.fields is empty")
+	}
+	return cfg, nil
+}
+
+// LoadFingerprintConfig reads a fingerprint-matching config file.
+func LoadFingerprintConfig(path string) (*FingerprintConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseFingerprintConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// DefaultFingerprintConfig returns the bundled config.
+func DefaultFingerprintConfig() *FingerprintConfig {
+	cfg, err := ParseFingerprintConfig(defaultFingerprintConfigJSON)
+	if err != nil {
+		panic(fmt.Sprintf("bundled fingerprint config: %v", err))
+	}
+	return cfg
+}
+
+func isFingerprintSignal(name string) bool {
+	for _, s := range fingerprintSignals {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// maxScore is the score of a candidate identical on every signal.
+func (c *FingerprintConfig) maxScore() float64 {
+	total := 0.0
+	for _, w := range c.weights {
+		total += w
+	}
+	return total
+}
+
+// accepts reports whether a candidate's scores are enough for a link: the
+// total reaches the threshold and enough weighted signals match on their own,
+// so one shared hash (e.g. the TLS fingerprint of a popular browser) is never
+// enough by itself.
+func (c *FingerprintConfig) accepts(scores map[string]float64, total float64) bool {
+	if total < c.threshold {
+		return false
+	}
+	matching := 0
+	for signal, sim := range scores {
+		if c.weights[signal] > 0 && sim >= c.signalMatch {
+			matching++
+		}
+	}
+	return matching >= c.minSignals
+}
+
+// bucketKey builds the bucket key from the configured device fields, or ""
+// when none of the required fields is present.
+func (c *FingerprintConfig) bucketKey(device map[string]interface{}) string {
+	present := len(c.bucketRequired) == 0
+	for _, f := range c.bucketRequired {
+		if _, ok := bucketFieldValue(device, f); ok {
+			present = true
+			break
+		}
+	}
+	if !present {
+		return ""
+	}
+
+	parts := make([]string, len(c.bucketFields))
+	for i, f := range c.bucketFields {
+		parts[i], _ = bucketFieldValue(device, f)
+	}
+	return strings.Join(parts, "|")
+}
+
+// bucketFieldValue formats one bucket-key field and reports whether the
+// device has it. Missing numeric fields format as zero, keeping key positions stable.
+func bucketFieldValue(device map[string]interface{}, field string) (string, bool) {
+	switch field {
+	case "screen":
+		// Screen Resolution Normalization
+		w := getFloat(device["screenWidth"])
+		h := getFloat(device["screenHeight"])
+		if h > w {
+			w, h = h, w
+		}
+		return fmt.Sprintf("%.0fx%.0f", w, h), w > 0
+	case "pixelRatio":
+		v := getFloat(device[field])
+		return fmt.Sprintf("%.2f", v), v != 0
+	case "colorDepth":
+		v := getFloat(device[field])
+		return fmt.Sprintf("%.0f", v), v != 0
+	default:
+		v := toString(device[field])
+		return v, v != ""
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Identity graph keys (all under "idg/"):
+//
+//	idg/root/<node>           → root node of the node's cluster (absent: singleton)
+//	idg/member/<root>/<node>  → member index of clusters with more than one node
+//	idg/edge/<a>/<b>          → observed link, stored in both directions
+//	idg/detached/<node>       → node split off by an admin; never merged automatically
+//	idg/person/<root>         → the cluster's person_id (absent: derived from the root)
+//
+// Nodes are "v:<visitor_id>" and "u:<user_id>".
+const (
+	idgRootPrefix     = "idg/root/"
+	idgMemberPrefix   = "idg/member/"
+	idgEdgePrefix     = "idg/edge/"
+	idgDetachedPrefix = "idg/detached/"
+	idgPersonPrefix   = "idg/person/"
+)
+
+// ErrClusterTooLarge is returned by Link when a merge would exceed the
+// maximum cluster size (usually a shared or test user_id).
+var ErrClusterTooLarge = errors.New("identity cluster too large")
+
+// ErrIdentityConflict is returned by Link when both clusters already hold a
+// user_id (a device shared by two users): users are never merged.
+var ErrIdentityConflict = errors.New("identity clusters belong to different users")
+
+// IdentityGraph is a union-find over visitor_ids and user_ids, persisted in
+// Badger. Every visitor_id seen with a user_id is merged into the user's
+// cluster, unless the visitor already belongs to another user's cluster.
+// Clusters are kept flat (every member points at the root), merging the
+// smaller cluster into the larger one. A cluster's person_id is stable: a
+// singleton's is derived from its node, and merges and splits hand it on to
+// the larger part.
+type IdentityGraph struct {
+	db         *badger.DB
+	maxCluster int
+
+	mu sync.RWMutex // Link and Split write; Find reads
+}
+
+// NewIdentityGraph creates the graph on top of an open BadgerDB.
+func NewIdentityGraph(db *badger.DB, maxCluster int) *IdentityGraph {
+	return &IdentityGraph{db: db, maxCluster: maxCluster}
+}
+
+// Cluster is an identity cluster as returned by the admin API.
+type Cluster struct {
+	PersonID string      `json:"person_id"`
+	Root     string      `json:"root"`
+	Members  []string    `json:"members"`
+	Edges    [][2]string `json:"edges"`
+	Detached []string    `json:"detached,omitempty"`
+}
+
+func visitorNode(visitorID string) string { return "v:" + visitorID }
+
+func userNode(userID string) string { return "u:" + userID }
+
+// personID derives the person ID of a singleton cluster from its node.
+func personID(node string) string {
+	sum := sha256.Sum256([]byte(node))
+	return "p_" + hex.EncodeToString(sum[:12])
+}
+
+// clusterPersonID returns the person_id of a root's cluster.
+func clusterPersonID(txn *badger.Txn, root string) (string, error) {
+	item, err := txn.Get([]byte(idgPersonPrefix + root))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return personID(root), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	val, err := item.ValueCopy(nil)
+	return string(val), err
+}
+
+// PersonID returns the person_id of a node's cluster.
+func (g *IdentityGraph) PersonID(node string) (string, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var pid string
+	err := g.db.View(func(txn *badger.Txn) error {
+		root, err := findRoot(txn, node)
+		if err != nil {
+			return err
+		}
+		pid, err = clusterPersonID(txn, root)
+		return err
+	})
+	return pid, err
+}
+
+// Link merges the clusters of a and b and records the edge. Returns the
+// person_id of b's cluster after the merge. Detached nodes are not merged,
+// and neither are two clusters that each hold a user_id (ErrIdentityConflict).
+func (g *IdentityGraph) Link(a, b string) (string, error) {
+	// Fast path: already linked, or nothing to do
+	g.mu.RLock()
+	var pid string
+	var done bool
+	err := g.db.View(func(txn *badger.Txn) error {
+		done = keyExists(txn, idgEdgePrefix+a+"/"+b) ||
+			keyExists(txn, idgDetachedPrefix+a) || keyExists(txn, idgDetachedPrefix+b)
+		if !done {
+			return nil
+		}
+		rb, err := findRoot(txn, b)
+		if err != nil {
+			return err
+		}
+		pid, err = clusterPersonID(txn, rb)
+		return err
+	})
+	g.mu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	if done {
+		return pid, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err = g.db.Update(func(txn *badger.Txn) error {
+		if keyExists(txn, idgDetachedPrefix+a) || keyExists(txn, idgDetachedPrefix+b) {
+			rb, err := findRoot(txn, b)
+			if err != nil {
+				return err
+			}
+			pid, err = clusterPersonID(txn, rb)
+			return err
+		}
+
+		ra, err := findRoot(txn, a)
+		if err != nil {
+			return err
+		}
+		rb, err := findRoot(txn, b)
+		if err != nil {
+			return err
+		}
+		if ra == rb {
+			if err := setEdge(txn, a, b); err != nil {
+				return err
+			}
+			pid, err = clusterPersonID(txn, ra)
+			return err
+		}
+
+		membersA, err := clusterMembers(txn, ra)
+		if err != nil {
+			return err
+		}
+		membersB, err := clusterMembers(txn, rb)
+		if err != nil {
+			return err
+		}
+		if hasUser(membersA) && hasUser(membersB) {
+			return ErrIdentityConflict
+		}
+		if g.maxCluster > 0 && len(membersA)+len(membersB) > g.maxCluster {
+			return ErrClusterTooLarge
+		}
+		if err := setEdge(txn, a, b); err != nil {
+			return err
+		}
+
+		// Union by size; ties go to the smaller root for determinism
+		big, small, smallMembers := ra, rb, membersB
+		if len(membersB) > len(membersA) || (len(membersB) == len(membersA) && rb < ra) {
+			big, small, smallMembers = rb, ra, membersA
+		}
+		// The person_id follows the larger cluster; between equals, one
+		// that was a cluster before (a stored ID) wins over a singleton
+		holder := big
+		if len(membersA) == len(membersB) && !keyExists(txn, idgPersonPrefix+big) && keyExists(txn, idgPersonPrefix+small) {
+			holder = small
+		}
+		if pid, err = clusterPersonID(txn, holder); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte(idgPersonPrefix+big), []byte(pid)); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(idgPersonPrefix + small)); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte(idgMemberPrefix+big+"/"+big), nil); err != nil {
+			return err
+		}
+		for _, m := range smallMembers {
+			if err := txn.Set([]byte(idgRootPrefix+m), []byte(big)); err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte(idgMemberPrefix + small + "/" + m)); err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(idgMemberPrefix+big+"/"+m), nil); err != nil {
+				return err
+			}
+		}
+		metricIdentityMerges.Inc()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return pid, nil
+}
+
+// setEdge records the observed link between a and b in both directions.
+func setEdge(txn *badger.Txn, a, b string) error {
+	if err := txn.Set([]byte(idgEdgePrefix+a+"/"+b), nil); err != nil {
+		return err
+	}
+	return txn.Set([]byte(idgEdgePrefix+b+"/"+a), nil)
+}
+
+// hasUser reports whether a cluster's members include a user_id node.
+func hasUser(members []string) bool {
+	for _, m := range members {
+		if strings.HasPrefix(m, "u:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Cluster returns the cluster a node belongs to.
+func (g *IdentityGraph) Cluster(node string) (*Cluster, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var c *Cluster
+	err := g.db.View(func(txn *badger.Txn) error {
+		var err error
+		c, err = readCluster(txn, node)
+		return err
+	})
+	return c, err
+}
+
+// Split detaches a node from its cluster: its edges are removed, it is never
+// merged automatically again, and the rest of the cluster is rebuilt from the
+// remaining edges (it may fall apart into several clusters). The largest
+// remaining cluster keeps the person_id; the others, and the detached node,
+// get their own. Returns the resulting clusters, the detached node's first.
+func (g *IdentityGraph) Split(node string) ([]*Cluster, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var roots []string
+	err := g.db.Update(func(txn *badger.Txn) error {
+		root, err := findRoot(txn, node)
+		if err != nil {
+			return err
+		}
+		members, err := clusterMembers(txn, root)
+		if err != nil {
+			return err
+		}
+		pid, err := clusterPersonID(txn, root)
+		if err != nil {
+			return err
+		}
+
+		// 1. Collect the cluster's edges, dropping the detached node's
+		var edges [][2]string
+		for _, m := range members {
+			neighbors, err := prefixSuffixes(txn, idgEdgePrefix+m+"/")
+			if err != nil {
+				return err
+			}
+			for _, n := range neighbors {
+				if m == node || n == node {
+					if err := txn.Delete([]byte(idgEdgePrefix + m + "/" + n)); err != nil {
+						return err
+					}
+					continue
+				}
+				if m < n {
+					edges = append(edges, [2]string{m, n})
+				}
+			}
+		}
+		if err := txn.Set([]byte(idgDetachedPrefix+node), nil); err != nil {
+			return err
+		}
+
+		// 2. Reset the cluster
+		if err := txn.Delete([]byte(idgPersonPrefix + root)); err != nil {
+			return err
+		}
+		for _, m := range members {
+			if err := txn.Delete([]byte(idgRootPrefix + m)); err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte(idgMemberPrefix + root + "/" + m)); err != nil {
+				return err
+			}
+		}
+
+		// 3. Rebuild components from the remaining edges
+		parent := make(map[string]string, len(members))
+		var find func(string) string
+		find = func(x string) string {
+			if p, ok := parent[x]; ok && p != x {
+				parent[x] = find(p)
+				return parent[x]
+			}
+			return x
+		}
+		for _, e := range edges {
+			ra, rb := find(e[0]), find(e[1])
+			if ra != rb {
+				if rb < ra {
+					ra, rb = rb, ra
+				}
+				parent[rb] = ra
+			}
+		}
+		components := make(map[string][]string)
+		for _, m := range members {
+			r := find(m)
+			components[r] = append(components[r], m)
+		}
+
+		// 4. Hand the person_id to the largest remaining cluster (ties: the
+		// smallest root); the others are new people
+		keeper := ""
+		for r, comp := range components {
+			if r == node {
+				continue
+			}
+			if keeper == "" || len(comp) > len(components[keeper]) || (len(comp) == len(components[keeper]) && r < keeper) {
+				keeper = r
+			}
+		}
+		for r := range components {
+			switch {
+			case r == keeper:
+				if err := txn.Set([]byte(idgPersonPrefix+r), []byte(pid)); err != nil {
+					return err
+				}
+			case personID(r) == pid:
+				// r was the root whose derived ID the cluster carried
+				if err := txn.Set([]byte(idgPersonPrefix+r), []byte(newPersonID())); err != nil {
+					return err
+				}
+			}
+		}
+
+		roots = append(roots, node)
+		for r, comp := range components {
+			if r != node {
+				roots = append(roots, r)
+			}
+			if len(comp) < 2 {
+				continue
+			}
+			for _, m := range comp {
+				if m != r {
+					if err := txn.Set([]byte(idgRootPrefix+m), []byte(r)); err != nil {
+						return err
+					}
+				}
+				if err := txn.Set([]byte(idgMemberPrefix+r+"/"+m), nil); err != nil {
+					return err
+				}
+			}
+		}
+		sort.Strings(roots[1:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make([]*Cluster, 0, len(roots))
+	err = g.db.View(func(txn *badger.Txn) error {
+		for _, r := range roots {
+			c, err := readCluster(txn, r)
+			if err != nil {
+				return err
+			}
+			clusters = append(clusters, c)
+		}
+		return nil
+	})
+	return clusters, err
+}
+
+// Erase removes a node from the graph: it is split off its cluster (the rest
+// is rebuilt from the remaining edges) and its keys are deleted, so it may be
+// linked again by new events. Returns false if the graph did not know the node.
+func (g *IdentityGraph) Erase(node string) (bool, error) {
+	var known bool
+	err := g.db.View(func(txn *badger.Txn) error {
+		known = keyExists(txn, idgRootPrefix+node) || keyExists(txn, idgDetachedPrefix+node) ||
+			keyExists(txn, idgMemberPrefix+node+"/"+node)
+		return nil
+	})
+	if err != nil || !known {
+		return false, err
+	}
+
+	if _, err := g.Split(node); err != nil {
+		return false, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	err = g.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte(idgPersonPrefix + node)); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(idgDetachedPrefix + node))
+	})
+	return err == nil, err
+}
+
+// newPersonID returns a random person ID for a cluster split off from another.
+func newPersonID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return "p_" + hex.EncodeToString(b)
+}
+
+// findRoot returns the root of a node (the node itself for singletons).
+func findRoot(txn *badger.Txn, node string) (string, error) {
+	item, err := txn.Get([]byte(idgRootPrefix + node))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return node, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	val, err := item.ValueCopy(nil)
+	return string(val), err
+}
+
+// clusterMembers lists the members of a root's cluster (at least the root).
+func clusterMembers(txn *badger.Txn, root string) ([]string, error) {
+	members, err := prefixSuffixes(txn, idgMemberPrefix+root+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		members = []string{root}
+	}
+	return members, nil
+}
+
+func readCluster(txn *badger.Txn, node string) (*Cluster, error) {
+	root, err := findRoot(txn, node)
+	if err != nil {
+		return nil, err
+	}
+	members, err := clusterMembers(txn, root)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := clusterPersonID(txn, root)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{PersonID: pid, Root: root, Members: members, Edges: [][2]string{}}
+	for _, m := range members {
+		neighbors, err := prefixSuffixes(txn, idgEdgePrefix+m+"/")
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range neighbors {
+			if m < n {
+				c.Edges = append(c.Edges, [2]string{m, n})
+			}
+		}
+		if keyExists(txn, idgDetachedPrefix+m) {
+			c.Detached = append(c.Detached, m)
+		}
+	}
+	return c, nil
+}
+
+// prefixSuffixes lists the key suffixes under a prefix, sorted.
+func prefixSuffixes(txn *badger.Txn, prefix string) ([]string, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(prefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var out []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		out = append(out, strings.TrimPrefix(string(it.Item().Key()), prefix))
+	}
+	return out, nil
+}
+
+func keyExists(txn *badger.Txn, key string) bool {
+	_, err := txn.Get([]byte(key))
+	return err == nil
+}
+
+// IdentityEnricher links visitor_id to user_id in the identity graph and
+// writes ids.person_id. Registered as "identity"; a no-op until created with
+// a graph (replay-dlq -dry-run has none).
+type IdentityEnricher struct {
+	graph *IdentityGraph
+}
+
+// NewIdentityEnricher creates the identity enricher for a graph.
+func NewIdentityEnricher(graph *IdentityGraph) *IdentityEnricher {
+	return &IdentityEnricher{graph: graph}
+}
+
+func (en *IdentityEnricher) Name() string { return "identity" }
+
+func (en *IdentityEnricher) Enrich(in *EnrichInput, e *Event) error {
+	if en.graph == nil || !in.Consent.Analytics {
+		return nil
+	}
+	visitorID, userID := e.IDs["visitor_id"], e.IDs["user_id"]
+
+	var pid string
+	var err error
+	switch {
+	case visitorID != "" && userID != "":
+		pid, err = en.graph.Link(userNode(userID), visitorNode(visitorID))
+		switch {
+		case errors.Is(err, ErrIdentityConflict):
+			// A shared device: the visitor stays with its first user, the
+			// event goes to the user who sent it
+			metricIdentityConflicts.Inc()
+			pid, err = en.graph.PersonID(userNode(userID))
+		case errors.Is(err, ErrClusterTooLarge):
+			metricIdentityMergeRejected.Inc()
+			pid, err = en.graph.PersonID(visitorNode(visitorID))
+		}
+	case visitorID != "":
+		pid, err = en.graph.PersonID(visitorNode(visitorID))
+	case userID != "":
+		pid, err = en.graph.PersonID(userNode(userID))
+	default:
+		return nil
+	}
+	if err != nil {
+		// The event is still useful without a person_id
+		log.Printf("Identity graph: %v", fmt.Errorf("visitor %q user %q: %w", visitorID, userID, err))
+		return nil
+	}
+	e.IDs["person_id"] = pid
+	return nil
+}
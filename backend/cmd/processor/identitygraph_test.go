@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func newTestIdentityGraph(t *testing.T, maxCluster int) *IdentityGraph {
+	t.Helper()
+	db := openScratchBadger("")
+	t.Cleanup(func() { db.Close() })
+	return NewIdentityGraph(db, maxCluster)
+}
+
+// mustLink links a user and a visitor and returns the visitor's person_id.
+func mustLink(t *testing.T, g *IdentityGraph, user, visitor string) string {
+	t.Helper()
+	pid, err := g.Link(userNode(user), visitorNode(visitor))
+	if err != nil {
+		t.Fatalf("Link(%s, %s): %v", user, visitor, err)
+	}
+	return pid
+}
+
+func mustPersonID(t *testing.T, g *IdentityGraph, node string) string {
+	t.Helper()
+	pid, err := g.PersonID(node)
+	if err != nil {
+		t.Fatalf("PersonID(%s): %v", node, err)
+	}
+	return pid
+}
+
+func TestIdentityGraphLink(t *testing.T) {
+	g := newTestIdentityGraph(t, 100)
+
+	if got, want := mustPersonID(t, g, visitorNode("phone")), personID(visitorNode("phone")); got != want {
+		t.Errorf("unknown visitor person_id = %s, want %s", got, want)
+	}
+
+	pid := mustLink(t, g, "alice", "phone")
+	if again := mustLink(t, g, "alice", "phone"); again != pid {
+		t.Errorf("repeated link person_id = %s, want %s", again, pid)
+	}
+	if laptop := mustLink(t, g, "alice", "laptop"); laptop != pid {
+		t.Errorf("second device person_id = %s, want %s", laptop, pid)
+	}
+	for _, node := range []string{userNode("alice"), visitorNode("phone"), visitorNode("laptop")} {
+		if got := mustPersonID(t, g, node); got != pid {
+			t.Errorf("PersonID(%s) = %s, want %s", node, got, pid)
+		}
+	}
+
+	c, err := g.Cluster(visitorNode("laptop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{userNode("alice"), visitorNode("laptop"), visitorNode("phone")}; !slices.Equal(c.Members, want) {
+		t.Errorf("members = %v, want %v", c.Members, want)
+	}
+	if len(c.Edges) != 2 {
+		t.Errorf("edges = %v, want 2", c.Edges)
+	}
+}
+
+// TestIdentityGraphPersonIDStable checks that a person_id survives merges
+// and root changes.
+func TestIdentityGraphPersonIDStable(t *testing.T) {
+	g := newTestIdentityGraph(t, 100)
+
+	pid := mustLink(t, g, "alice", "a1")
+	mustLink(t, g, "alice", "a2")
+	if got := mustLink(t, g, "alice", "0-first"); got != pid {
+		t.Errorf("merged person_id = %s, want %s", got, pid)
+	}
+
+	// After the user is split off, a visitor carries the person_id as the
+	// root of a cluster of one; a new user linking to it does not replace it
+	if _, err := g.Split(userNode("alice")); err != nil {
+		t.Fatal(err)
+	}
+	holder := ""
+	for _, v := range []string{"0-first", "a1", "a2"} {
+		if mustPersonID(t, g, visitorNode(v)) == pid {
+			holder = v
+		}
+	}
+	if holder == "" {
+		t.Fatal("no visitor kept the person_id")
+	}
+	if got := mustLink(t, g, "carol", holder); got != pid {
+		t.Errorf("person_id after linking %s = %s, want %s", holder, got, pid)
+	}
+}
+
+func TestIdentityGraphSharedDevice(t *testing.T) {
+	g := newTestIdentityGraph(t, 100)
+
+	alice := mustLink(t, g, "alice", "tablet")
+	bob := mustLink(t, g, "bob", "phone")
+
+	_, err := g.Link(userNode("bob"), visitorNode("tablet"))
+	if !errors.Is(err, ErrIdentityConflict) {
+		t.Fatalf("Link(bob, tablet) err = %v, want ErrIdentityConflict", err)
+	}
+	if got := mustPersonID(t, g, visitorNode("tablet")); got != alice {
+		t.Errorf("tablet person_id = %s, want alice's %s", got, alice)
+	}
+	if got := mustPersonID(t, g, userNode("bob")); got != bob {
+		t.Errorf("bob person_id = %s, want %s", got, bob)
+	}
+	c, err := g.Cluster(userNode("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(c.Members, userNode("bob")) || len(c.Edges) != 1 {
+		t.Errorf("alice's cluster = %+v, want no trace of bob", c)
+	}
+
+	// A fresh visitor of bob still joins him
+	if got := mustLink(t, g, "bob", "laptop"); got != bob {
+		t.Errorf("bob's new visitor person_id = %s, want %s", got, bob)
+	}
+}
+
+func TestIdentityGraphMaxCluster(t *testing.T) {
+	g := newTestIdentityGraph(t, 2)
+	mustLink(t, g, "shared", "v1")
+	if _, err := g.Link(userNode("shared"), visitorNode("v2")); !errors.Is(err, ErrClusterTooLarge) {
+		t.Fatalf("err = %v, want ErrClusterTooLarge", err)
+	}
+}
+
+func TestIdentityGraphSplit(t *testing.T) {
+	g := newTestIdentityGraph(t, 100)
+	pid := mustLink(t, g, "alice", "phone")
+	mustLink(t, g, "alice", "laptop")
+	mustLink(t, g, "alice", "tablet")
+
+	// Detaching a visitor: the user's cluster keeps its person_id
+	clusters, err := g.Split(visitorNode("tablet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Root != visitorNode("tablet") {
+		t.Fatalf("clusters = %+v", clusters)
+	}
+	if clusters[0].PersonID == pid || clusters[1].PersonID != pid {
+		t.Errorf("person_ids after split = %s, %s; want the rest to keep %s", clusters[0].PersonID, clusters[1].PersonID, pid)
+	}
+	if _, err := g.Link(userNode("alice"), visitorNode("tablet")); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustPersonID(t, g, visitorNode("tablet")); got == pid {
+		t.Error("detached visitor was merged again")
+	}
+
+	// Detaching the user (the root whose ID the cluster carries): the
+	// visitors fall apart, the first keeps the person_id, nobody shares it
+	clusters, err = g.Split(userNode("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]string)
+	for _, c := range clusters {
+		if other, dup := seen[c.PersonID]; dup {
+			t.Errorf("%s and %s share person_id %s", other, c.Root, c.PersonID)
+		}
+		seen[c.PersonID] = c.Root
+	}
+	if got := mustPersonID(t, g, visitorNode("laptop")); got != pid {
+		t.Errorf("laptop person_id = %s, want %s", got, pid)
+	}
+	if mustPersonID(t, g, userNode("alice")) == pid || mustPersonID(t, g, visitorNode("phone")) == pid {
+		t.Error("person_id handed to more than one cluster")
+	}
+}
+
+func TestIdentityGraphErase(t *testing.T) {
+	g := newTestIdentityGraph(t, 100)
+	pid := mustLink(t, g, "alice", "phone")
+	mustLink(t, g, "alice", "laptop")
+
+	erased, err := g.Erase(visitorNode("phone"))
+	if err != nil || !erased {
+		t.Fatalf("Erase = %v, %v", erased, err)
+	}
+	if erased, err := g.Erase(visitorNode("phone")); err != nil || erased {
+		t.Errorf("second Erase = %v, %v, want false", erased, err)
+	}
+	if erased, err := g.Erase(visitorNode("never-seen")); err != nil || erased {
+		t.Errorf("Erase of an unknown node = %v, %v, want false", erased, err)
+	}
+
+	c, err := g.Cluster(visitorNode("phone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Members) != 1 || len(c.Edges) != 0 || len(c.Detached) != 0 {
+		t.Errorf("erased node cluster = %+v, want a fresh singleton", c)
+	}
+	if got := mustPersonID(t, g, visitorNode("laptop")); got != pid {
+		t.Errorf("laptop person_id = %s, want %s", got, pid)
+	}
+
+	// Not detached: new events link it again
+	if got := mustLink(t, g, "alice", "phone"); got != pid {
+		t.Errorf("relinked person_id = %s, want %s", got, pid)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const insertIdentityLinksQuery = "INSERT INTO default.identity_links (timestamp, event_id, original_id, linked_id, bucket_key, signal_scores, score)"
+
+// IdentityLink is the evidence for one visitor_id swap made by the
+// FingerprintService. Links travel with their event through the spool and
+// are stored in default.identity_links, so a bad merge can be audited and
+// rolled back (the event keeps ids.original_visitor_id).
+type IdentityLink struct {
+	Timestamp  time.Time          `json:"t"`
+	EventID    string             `json:"eid"`
+	OriginalID string             `json:"orig"`
+	LinkedID   string             `json:"to"`
+	BucketKey  string             `json:"bkt"`
+	Scores     map[string]float64 `json:"sc"` // Per-signal Jaccard similarity
+	Score      float64            `json:"s"`
+}
+
+// insertIdentityLinks stores the links of a batch. identity_links is a
+// ReplacingMergeTree keyed by event, so a retried batch does not duplicate links.
+func insertIdentityLinks(ctx context.Context, ch clickhouse.Conn, events []BufferedEvent) error {
+	var links []*IdentityLink
+	for _, be := range events {
+		if be.Link != nil {
+			links = append(links, be.Link)
+		}
+	}
+	if len(links) == 0 {
+		return nil
+	}
+
+	batch, err := ch.PrepareBatch(ctx, insertIdentityLinksQuery)
+	if err != nil {
+		return fmt.Errorf("prepare identity links batch: %w", err)
+	}
+	for _, l := range links {
+		if err := batch.Append(l.Timestamp, l.EventID, l.OriginalID, l.LinkedID, l.BucketKey, l.Scores, l.Score); err != nil {
+			return fmt.Errorf("append identity link: %w", err)
+		}
+	}
+	return batch.Send()
+}
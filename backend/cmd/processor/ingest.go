@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// maxLineSize caps a single NDJSON line. The Lua collector writes a whole
+// tracker batch as one JSON array line, so the default bufio.Scanner limit
+// (64KB) is too small.
+const maxLineSize = 16 * 1024 * 1024
+
+// RawEvent is a decoded event together with the JSON it was decoded from.
+// The payload is kept so rejected events can be dead-lettered verbatim.
+type RawEvent struct {
+	Data    map[string]interface{}
+	Payload []byte
+}
+
+// ElementError describes a failure of a single element inside an array line.
+type ElementError struct {
+	Index   int
+	Payload []byte
+	Err     error
+}
+
+func (e ElementError) Error() string {
+	return fmt.Sprintf("element %d: %v", e.Index, e.Err)
+}
+
+// decodeLine parses one NDJSON line into raw events.
+// A line is either a single JSON object or a JSON array of objects.
+// Returns the decoded events, per-element failures (array lines only) and
+// an error if the line itself could not be parsed.
+func decodeLine(line []byte) ([]RawEvent, []ElementError, error) {
+	trimmed := bytes.TrimSpace(line)
+
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(trimmed, &elements); err != nil {
+			return nil, nil, err
+		}
+
+		events := make([]RawEvent, 0, len(elements))
+		var failures []ElementError
+		for i, el := range elements {
+			rawEvent, err := decodeObject(el)
+			if err != nil {
+				failures = append(failures, ElementError{Index: i, Payload: el, Err: err})
+				continue
+			}
+			events = append(events, RawEvent{Data: rawEvent, Payload: el})
+		}
+		return events, failures, nil
+	}
+
+	rawEvent, err := decodeObject(trimmed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []RawEvent{{Data: rawEvent, Payload: trimmed}}, nil, nil
+}
+
+// decodeObject unmarshals a single JSON object. Other JSON values (null,
+// strings, numbers, nested arrays) are rejected.
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	var rawEvent map[string]interface{}
+	if err := json.Unmarshal(data, &rawEvent); err != nil {
+		return nil, err
+	}
+	if rawEvent == nil {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	return rawEvent, nil
+}
+
+// Ingester serves /ingest: decodes NDJSON, drops duplicates, links
+// fingerprints, maps events and hands them to the ingest buffer.
+type Ingester struct {
+	fpService *FingerprintService
+	dedup     *DedupWindow
+	dlq       *DeadLetterQueue
+	buffer    *IngestBuffer
+}
+
+// NewIngester wires the /ingest handler dependencies.
+func NewIngester(fpService *FingerprintService, dedup *DedupWindow, dlq *DeadLetterQueue, buffer *IngestBuffer) *Ingester {
+	return &Ingester{
+		fpService: fpService,
+		dedup:     dedup,
+		dlq:       dlq,
+		buffer:    buffer,
+	}
+}
+
+// lineEvent is a decoded event and its position in the request.
+type lineEvent struct {
+	RawEvent
+	line  int
+	index int // Position in an array line
+}
+
+// HandleIngest accepts an NDJSON batch and answers 200 once its events are
+// spooled. It answers 429 when the spool is full and 503 when shutting down
+// or the spool cannot be written, so Vector keeps the batch and retries.
+//
+// The whole body is decoded and spool room reserved for every event before
+// any state (dedup window, fingerprints, sessions, identity graph) is
+// touched: a rejected request leaves no trace, so the retry is processed as
+// if it were the first delivery.
+func (in *Ingester) HandleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 1. Decode. A line holds either a single event object or a JSON array of events.
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	lineNo := 0
+	failed := 0
+	duplicates := 0
+	filtered := 0
+	var dead []DeadLetter
+	var decoded []lineEvent
+	redact, filter := activeRedactEnricher(), activeFilterEnricher()
+	consentDefault := activeConsentEnricher().DefaultGranted()
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineNo++
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		metricLinesReceived.Inc()
+
+		rawEvents, elemErrs, err := decodeLine(line)
+		if err != nil {
+			log.Printf("Skipping bad NDJSON line %d: %v", lineNo, err)
+			dead = append(dead, newDeadLetter(StageDecode, redact.RedactText(line), err))
+			metricEventsSkipped.WithLabelValues(skipDecode).Inc()
+			failed++
+			continue
+		}
+		for _, elemErr := range elemErrs {
+			log.Printf("Skipping bad event in line %d: %v", lineNo, elemErr)
+			dead = append(dead, newDeadLetter(StageDecode, redact.RedactText(elemErr.Payload), elemErr.Err))
+			metricEventsSkipped.WithLabelValues(skipDecode).Inc()
+			failed++
+		}
+		for i, raw := range rawEvents {
+			raw.Payload = bytes.Clone(raw.Payload) // The scanner reuses its buffer
+			decoded = append(decoded, lineEvent{RawEvent: raw, line: lineNo, index: i})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Scanner error: %v", err)
+		http.Error(w, "Stream error", http.StatusBadRequest)
+		return
+	}
+
+	// 2. Reserve spool room before any state is touched
+	if err := in.buffer.Reserve(len(decoded)); err != nil {
+		writeBackpressure(w, err)
+		return
+	}
+
+	// 3. Filter, dedup, fingerprint linking and mapping
+	var accepted []BufferedEvent
+	for _, le := range decoded {
+		rawEvent := le.Data
+
+		// Filtered events are dropped before they touch any state
+		if filter.Prefilter(rawEvent) {
+			metricEventsSkipped.WithLabelValues(skipFiltered).Inc()
+			filtered++
+			continue
+		}
+
+		// Drop redelivered events before they touch any state
+		eventID := ensureEventID(rawEvent)
+		if !in.dedup.Reserve(eventID) {
+			metricEventsSkipped.WithLabelValues(skipDuplicate).Inc()
+			duplicates++
+			continue
+		}
+
+		// Identify / Link Sessions; only with consent to fingerprinting
+		// (and to analytics, which linking visitors is part of). Without
+		// it the hashes are not kept anywhere, the payload included. The
+		// lookup only reads: the fingerprint is indexed once the event has
+		// passed the filter and the tracking plan.
+		payload := le.Payload
+		var link *IdentityLink
+		var sighting *FingerprintSighting
+		consent := parseConsent(rawEvent, consentDefault)
+		if !consent.Fingerprinting {
+			if stripped := stripPayload(rawEvent, fingerprintPayload); stripped != nil {
+				payload = stripped
+			}
+		} else if consent.Analytics {
+			link, sighting = in.fpService.Identify(rawEvent)
+		}
+		linked := link != nil
+		if linked {
+			// SWAP the ID: Continue the session of the identified user
+			link.EventID = eventID
+			rawEvent["visitor_id"] = link.LinkedID
+		}
+
+		// Map & Enrich
+		event, err := MapToEvent(rawEvent)
+
+		// The stored payload keeps no more than the event: nothing a denied
+		// consent covers, and PII masked. It keeps the visitor_id the event
+		// arrived with.
+		if linked {
+			rawEvent["visitor_id"] = link.OriginalID
+		}
+		payload = reducePayload(rawEvent, consent, payload)
+		if redacted := redact.RedactPayload(rawEvent); redacted != nil {
+			payload = redacted
+		}
+		if errors.Is(err, ErrDropEvent) {
+			in.dedup.Release([]string{eventID})
+			metricEventsSkipped.WithLabelValues(skipFiltered).Inc()
+			filtered++
+			continue
+		}
+		if err != nil {
+			log.Printf("Skipping invalid event %d in line %d: %v", le.index, le.line, err)
+			dead = append(dead, newDeadLetter(StageMap, payload, err))
+			in.dedup.Release([]string{eventID})
+			metricEventsSkipped.WithLabelValues(skipMap).Inc()
+			failed++
+			continue
+		}
+		metricEventsMapped.Inc()
+		in.fpService.Index(sighting)
+		if linked {
+			event.IDs["original_visitor_id"] = link.OriginalID
+		}
+
+		accepted = append(accepted, BufferedEvent{
+			Event:   event,
+			EventID: eventID,
+			Payload: payload,
+			Link:    link,
+		})
+	}
+
+	if failed > 0 || duplicates > 0 || filtered > 0 {
+		log.Printf("Ingest: %d lines, %d events accepted, %d failed, %d duplicates, %d filtered", lineNo, len(accepted), failed, duplicates, filtered)
+	}
+
+	// 4. Spool. Within the reservation only a disk error can fail here.
+	if err := in.buffer.Add(accepted, len(decoded)); err != nil {
+		in.dedup.Release(eventIDs(accepted))
+		writeBackpressure(w, err)
+		return
+	}
+
+	if err := in.dlq.Write(context.Background(), dead); err != nil {
+		log.Printf("Failed to write %d entries to DLQ: %v", len(dead), err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeBackpressure answers a rejected request with a status Vector retries.
+func writeBackpressure(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	switch {
+	case errors.Is(err, ErrBufferFull):
+		http.Error(w, "Buffer full", http.StatusTooManyRequests)
+	case errors.Is(err, ErrBufferClosed):
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+	default:
+		log.Printf("Failed to spool events: %v", err)
+		http.Error(w, "Spool error", http.StatusServiceUnavailable)
+	}
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/pamnard/pixel/backend/internal/migrate"
 )
 
 func main() {
+	// Subcommands (e.g. `processor replay-dlq`) run instead of the server.
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	log.Println("Starting Pixel Processor...")
 
 	// 1. Config
@@ -21,107 +36,248 @@ func main() {
 	chHost := getenv("CLICKHOUSE_HOST", "clickhouse:8123")
 	chUser := getenv("CLICKHOUSE_USER", "default")
 	chPass := getenv("CLICKHOUSE_PASSWORD", "")
+	badgerPath := getenv("BADGER_PATH", "./badger-data")
+	dedupWindow := getenvDuration("DEDUP_WINDOW", 24*time.Hour)
+	spoolDir := getenv("SPOOL_DIR", "./spool")
 
-	// 2. Connect to ClickHouse
-	ch := mustConnectClickHouse(chHost, chUser, chPass)
+	// 2. ClickHouse. The processor starts (and spools) while it is down;
+	// delivery begins once it answers and migrations ran.
+	ch := openClickHouse(chHost, chUser, chPass)
+	chReady := prepareClickHouse(ch)
 
-	// 2.5. Init Fingerprint Service (Session Handoff)
-	// Using BadgerDB for persistence. Path: ./badger-data
-	fpService, err := NewFingerprintService("./badger-data", 7*24*time.Hour)
+	// 2.5. Local state (BadgerDB): fingerprint cache, dedup window, sessions, identity graph
+	db, err := openBadger(badgerPath)
 	if err != nil {
-		log.Fatalf("Failed to init fingerprint service: %v", err)
+		log.Fatalf("Failed to open badger: %v", err)
 	}
-	defer fpService.Close()
+	defer db.Close()
+	registerBadgerMetrics(db)
 
-	// 3. HTTP Handler
-	http.HandleFunc("/ingest", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	// Fingerprint Service (Session Handoff)
+	fpService := NewFingerprintService(db, mustLoadFingerprintConfig())
 
-		// Prepare ClickHouse batch
-		batch, err := ch.PrepareBatch(context.Background(), "INSERT INTO default.events (timestamp, event_name, ids, page, device, geo, traffic, tech, params)")
-		if err != nil {
-			log.Printf("Failed to prepare batch: %v", err)
-			http.Error(w, "Internal error", http.StatusInternalServerError)
-			return
+	// Exactly-once: drop events already delivered within the window
+	dedup := NewDedupWindow(db, dedupWindow)
+
+	// Sessions and the cross-device identity graph
+	sessions, identityGraph := mustConfigureState(db)
+
+	// 2.7. Dead-letter queue for rejected events
+	dlq := NewDeadLetterQueue(ch)
+
+	// 2.8. Enricher chain used by MapToEvent
+	filter, currency := mustConfigureEnrichers(sessions, NewIdentityEnricher(identityGraph))
+	filter.Watch(getenvDuration("FILTER_RELOAD_INTERVAL", 10*time.Second))
+
+	// 3. Ingest buffer: events are spooled to disk (write-ahead) and drained
+	// into ClickHouse in batches, across requests
+	spool, err := OpenSpool(spoolDir)
+	if err != nil {
+		log.Fatalf("Failed to open spool: %v", err)
+	}
+	breaker := NewCircuitBreaker(
+		getenvInt("SPOOL_BREAKER_FAILURES", 5),
+		getenvDuration("SPOOL_BREAKER_COOLDOWN", 30*time.Second),
+	)
+	buffer := NewIngestBuffer(ch, dlq, dedup, spool, breaker,
+		getenvInt("INGEST_FLUSH_SIZE", 5000),
+		getenvDuration("INGEST_FLUSH_INTERVAL", 2*time.Second),
+		getenvInt("INGEST_BUFFER_SIZE", 1000000),
+		getenvInt("SPOOL_POISON_ATTEMPTS", 5),
+		chReady,
+	)
+
+	// 4. HTTP Handlers
+	ingester := NewIngester(fpService, dedup, dlq, buffer)
+	http.HandleFunc("/ingest", ingester.HandleIngest)
+
+	// Raw lines the collector could not parse go straight to the DLQ
+	http.HandleFunc("/dlq", dlq.HandleCollectorFallback)
+
+	// Admin API (PROCESSOR_ADMIN_TOKEN); disabled without a token
+	identityAdmin := &IdentityAdmin{graph: identityGraph}
+	privacyAdmin := &PrivacyAdmin{fingerprints: fpService, sessions: sessions, graph: identityGraph, buffer: buffer}
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/admin/identity", identityAdmin.HandleCluster)
+	adminMux.HandleFunc("/admin/identity/split", identityAdmin.HandleSplit)
+	adminMux.HandleFunc("/admin/erase", privacyAdmin.HandleErase)
+	adminMux.HandleFunc("/admin/currency/reload", (&CurrencyAdmin{enricher: currency}).HandleReload)
+	http.Handle("/admin/", requireAdminToken(getenv("PROCESSOR_ADMIN_TOKEN", ""), adminMux))
+
+	// Prometheus metrics
+	http.Handle("/metrics", promhttp.Handler())
+
+	// 5. Start Server; on SIGINT/SIGTERM stop accepting and flush the buffer
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("Processor listening on port %s", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
+	}()
 
-		// Stream processing: Read line by line (NDJSON) directly from request body
-		scanner := bufio.NewScanner(r.Body)
-		count := 0
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
 
-		for scanner.Scan() {
-			line := scanner.Bytes()
-			if len(bytes.TrimSpace(line)) == 0 {
-				continue
-			}
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	buffer.Close()
+}
 
-			var rawEvent map[string]interface{}
-			if err := json.Unmarshal(line, &rawEvent); err != nil {
-				log.Printf("Skipping bad NDJSON line: %v", err)
-				continue
-			}
+// Backoff between attempts to reach ClickHouse at startup.
+const (
+	clickhouseRetryMin = time.Second
+	clickhouseRetryMax = 30 * time.Second
+)
 
-			// 2.6. Identify / Link Sessions
-			if linkedID, found := fpService.Identify(rawEvent); found {
-				// SWAP the ID: Continue the session of the identified user
-				rawEvent["visitor_id"] = linkedID
+// prepareClickHouse waits in the background until ClickHouse answers and
+// pending migrations are applied (unless MIGRATE_ON_START=false), retrying
+// with backoff. The returned channel is closed once it is done.
+func prepareClickHouse(ch clickhouse.Conn) <-chan struct{} {
+	ready := make(chan struct{})
+	migrateOnStart := getenvBool("MIGRATE_ON_START", true)
+	go func() {
+		delay := clickhouseRetryMin
+		for {
+			err := pingClickHouse(ch)
+			if err == nil && migrateOnStart {
+				if err = migrate.Run(context.Background(), ch); err != nil {
+					err = fmt.Errorf("migrations: %w", err)
+				}
 			}
-
-			// Map & Enrich
-			event, err := MapToEvent(rawEvent)
-			if err != nil {
-				log.Printf("Skipping invalid event: %v", err)
-				continue
+			if err == nil {
+				close(ready)
+				return
 			}
+			log.Printf("ClickHouse not ready, events stay in the spool; retry in %s: %v", delay, err)
+			time.Sleep(delay)
+			delay = min(delay*2, clickhouseRetryMax)
+		}
+	}()
+	return ready
+}
 
-			// 3. Add to batch
-			if err := batch.Append(
-				event.Timestamp,
-				event.EventName,
-				event.IDs,
-				event.Page,
-				event.Device,
-				event.Geo,
-				event.Traffic,
-				event.Tech,
-				event.Params,
-			); err != nil {
-				log.Printf("Failed to append to batch: %v", err)
-			}
-			count++
+// mustConfigureState creates the state kept in the Badger DB for the
+// enrichers: server-side sessions and the identity graph (visitor_ids sharing
+// a user_id → person_id).
+func mustConfigureState(db *badger.DB) (*SessionEnricher, *IdentityGraph) {
+	sessionLoc, err := time.LoadLocation(getenv("SESSION_TIMEZONE", "UTC"))
+	if err != nil {
+		log.Fatalf("Invalid SESSION_TIMEZONE: %v", err)
+	}
+	sessions := NewSessionEnricher(db,
+		getenvDuration("SESSION_TIMEOUT", 30*time.Minute),
+		getenvDuration("SESSION_STATE_TTL", 30*24*time.Hour),
+		sessionLoc,
+	)
+	return sessions, NewIdentityGraph(db, getenvInt("IDENTITY_MAX_CLUSTER", 100))
+}
+
+// mustLoadFingerprintConfig loads FINGERPRINT_CONFIG or the bundled config.
+func mustLoadFingerprintConfig() *FingerprintConfig {
+	path := getenv("FINGERPRINT_CONFIG", "")
+	if path == "" {
+		return DefaultFingerprintConfig()
+	}
+	cfg, err := LoadFingerprintConfig(path)
+	if err != nil {
+		log.Fatalf("Failed to load fingerprint config: %v", err)
+	}
+	log.Printf("Fingerprint config: %s", path)
+	return cfg
+}
+
+// mustConfigureEnrichers builds the enrichers from their env config and
+// applies ENRICHERS. stateful are the Badger-backed enrichers, if any.
+func mustConfigureEnrichers(stateful ...Enricher) (*FilterEnricher, *CurrencyEnricher) {
+	configured := stateful
+
+	if path := getenv("CHANNEL_RULES", ""); path != "" {
+		rules, err := LoadChannelRules(path)
+		if err != nil {
+			log.Fatalf("Failed to load channel rules: %v", err)
 		}
+		configured = append(configured, NewTrafficEnricher(rules))
+		log.Printf("Channel rules: %s", path)
+	}
 
-		if err := scanner.Err(); err != nil {
-			log.Printf("Scanner error: %v", err)
-			http.Error(w, "Stream error", http.StatusBadRequest)
-			return
+	if path := getenv("BOT_RULES", ""); path != "" {
+		scorer, err := LoadBotRules(path)
+		if err != nil {
+			log.Fatalf("Failed to load bot rules: %v", err)
 		}
+		configured = append(configured, NewBotEnricher(scorer))
+		log.Printf("Bot rules: %s", path)
+	}
 
-		if count == 0 {
-			w.WriteHeader(http.StatusOK)
-			return
+	if path := getenv("PII_RULES", ""); path != "" {
+		redactor, err := LoadPIIRules(path)
+		if err != nil {
+			log.Fatalf("Failed to load PII rules: %v", err)
 		}
+		configured = append(configured, NewRedactEnricher(redactor))
+		log.Printf("PII rules: %s", path)
+	}
 
-		// Send to ClickHouse
-		if err := batch.Send(); err != nil {
-			log.Printf("Failed to send batch to ClickHouse: %v", err)
-			http.Error(w, "Upstream error", http.StatusBadGateway)
-			return
+	if path := getenv("URL_RULES", ""); path != "" {
+		rules, err := LoadURLRules(path)
+		if err != nil {
+			log.Fatalf("Failed to load URL rules: %v", err)
 		}
+		configured = append(configured, NewCanonicalEnricher(rules))
+		log.Printf("URL rules: %s", path)
+	}
 
-		w.WriteHeader(http.StatusOK)
-	})
+	filter := &FilterEnricher{}
+	if path := getenv("FILTER_RULES", ""); path != "" {
+		var err error
+		if filter, err = NewFilterEnricher(path); err != nil {
+			log.Fatalf("Failed to load filter rules: %v", err)
+		}
+		log.Printf("Filter rules: %s", path)
+	}
+	configured = append(configured, filter)
 
-	// 4. Start Server
-	log.Printf("Processor listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	var plan *TrackingPlan
+	if path := getenv("TRACKING_PLAN", ""); path != "" {
+		var err error
+		if plan, err = LoadTrackingPlan(path); err != nil {
+			log.Fatalf("Failed to load tracking plan: %v", err)
+		}
+		log.Printf("Tracking plan: %d events from %s", len(plan.Events), path)
 	}
-}
+	trackingPlan, err := NewTrackingPlanEnricher(plan, getenv("TRACKING_PLAN_MODE", PlanModeAnnotate))
+	if err != nil {
+		log.Fatalf("Invalid TRACKING_PLAN_MODE: %v", err)
+	}
+	configured = append(configured, trackingPlan)
 
+	currency := &CurrencyEnricher{}
+	if target := getenv("REPORTING_CURRENCY", ""); target != "" {
+		if currency, err = NewCurrencyEnricher(target, getenv("CURRENCY_RATES", "")); err != nil {
+			log.Fatalf("Failed to load currency rates: %v", err)
+		}
+		log.Printf("Currency: converting to %s with %s", currency.target, currency.path)
+	}
+	configured = append(configured, currency)
+
+	granted, err := ParseConsentDefault(getenv("CONSENT_DEFAULT", consentGranted))
+	if err != nil {
+		log.Fatalf("Invalid CONSENT_DEFAULT: %v", err)
+	}
+	configured = append(configured, NewConsentEnricher(granted))
+
+	if err := ConfigureEnrichers(getenv("ENRICHERS", ""), configured...); err != nil {
+		log.Fatalf("Invalid ENRICHERS: %v", err)
+	}
+	log.Printf("Enrichers: %s", strings.Join(enricherNames(), ", "))
+	return filter, currency
+}
 
 func getenv(key, fallback string) string {
 	v := os.Getenv(key)
@@ -131,7 +287,83 @@ func getenv(key, fallback string) string {
 	return v
 }
 
-func mustConnectClickHouse(host, user, pass string) clickhouse.Conn {
+// getenvInt parses an integer from env or returns the fallback.
+func getenvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Fatalf("invalid %s: %q", key, v)
+	}
+	return n
+}
+
+// getenvBool parses a boolean ("true", "false", "1", "0") from env or returns the fallback.
+func getenvBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %q", key, v)
+	}
+	return b
+}
+
+// getenvDuration parses a duration (e.g. "24h") from env or returns the fallback.
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return d
+}
+
+// insertEventsQuery is the column list shared by every writer of default.events.
+const insertEventsQuery = "INSERT INTO default.events (timestamp, event_name, ids, page, device, geo, traffic, tech, params, consent, params_num, tech_num)"
+
+// insertDedupContext tags an insert of default.events with a token derived
+// from its event IDs. ClickHouse drops a retry of an insert it already
+// committed (e.g. one that timed out after the commit): the events table keeps
+// the tokens of its latest inserts (non_replicated_deduplication_window).
+func insertDedupContext(ctx context.Context, eventIDs []string) context.Context {
+	h := sha256.New()
+	for _, id := range eventIDs {
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_deduplication_token": hex.EncodeToString(h.Sum(nil)),
+	}))
+}
+
+// appendEvent adds a mapped event to a batch prepared with insertEventsQuery.
+func appendEvent(batch driver.Batch, e *Event) error {
+	return batch.Append(
+		e.Timestamp,
+		e.EventName,
+		e.IDs,
+		e.Page,
+		e.Device,
+		e.Geo,
+		e.Traffic,
+		e.Tech,
+		e.Params,
+		e.Consent,
+		e.ParamsNum,
+		e.TechNum,
+	)
+}
+
+// openClickHouse creates the connection pool; no connection is made yet.
+func openClickHouse(host, user, pass string) clickhouse.Conn {
 	opts := &clickhouse.Options{
 		Addr: []string{host},
 		Auth: clickhouse.Auth{
@@ -148,12 +380,22 @@ func mustConnectClickHouse(host, user, pass string) clickhouse.Conn {
 	if err != nil {
 		log.Fatalf("clickhouse: open failed: %v", err)
 	}
+	return conn
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := conn.Ping(ctx); err != nil {
+// mustConnectClickHouse opens the connection and exits if ClickHouse does
+// not answer. Used by the subcommands.
+func mustConnectClickHouse(host, user, pass string) clickhouse.Conn {
+	conn := openClickHouse(host, user, pass)
+	if err := pingClickHouse(conn); err != nil {
 		log.Fatalf("clickhouse: ping failed: %v", err)
 	}
-
 	return conn
 }
+
+// pingClickHouse checks that ClickHouse answers.
+func pingClickHouse(conn clickhouse.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return conn.Ping(ctx)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Pipeline metrics, served on /metrics.
+var (
+	metricLinesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_lines_received_total",
+		Help: "Non-empty NDJSON lines received on /ingest.",
+	})
+	metricEventsMapped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_events_mapped_total",
+		Help: "Events successfully mapped by MapToEvent.",
+	})
+	metricEventsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_events_skipped_total",
+		Help: "Events (or lines) not ingested, by reason.",
+	}, []string{"reason"})
+	metricEventsAppended = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_events_appended_total",
+		Help: "Events appended to a ClickHouse batch, counted once the batch is inserted (not per retry).",
+	})
+	metricEventsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_events_sent_total",
+		Help: "Events inserted into ClickHouse.",
+	})
+	metricBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixel_processor_batch_size",
+		Help:    "Events per ClickHouse insert.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9), // 1 .. 65536
+	})
+	metricSendSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pixel_processor_clickhouse_send_seconds",
+		Help:    "ClickHouse batch insert latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	metricSpoolPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pixel_processor_spool_pending_events",
+		Help: "Events spooled on disk and not yet delivered.",
+	})
+	metricBreakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pixel_processor_circuit_open",
+		Help: "1 while the ClickHouse circuit breaker is open.",
+	})
+	metricDLQWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_dlq_written_total",
+		Help: "Entries written to the dead-letter queue, by stage.",
+	}, []string{"stage"})
+
+	metricEventsFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_events_filtered_total",
+		Help: "Events matched by the filter, by rule and action (drop or tag).",
+	}, []string{"rule", "action"})
+	metricBotSignals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_bot_signals_total",
+		Help: "Bot-scoring signals that fired, by signal.",
+	}, []string{"signal"})
+	metricBotEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_bot_events_total",
+		Help: "Events scored at or above the bot threshold.",
+	})
+	metricPlanViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_tracking_plan_violations_total",
+		Help: "Tracking plan violations, by event_name, param and rule (event and param empty when not declared in the plan).",
+	}, []string{"event", "param", "rule"})
+	metricEcommerceItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_ecommerce_items_total",
+		Help: "Items of ecommerce events, by event_name and result (stored or invalid).",
+	}, []string{"event", "result"})
+	metricEcommerceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_ecommerce_errors_total",
+		Help: "Ecommerce validation errors, by event_name and rule (type, range, missing_id, too_many, invalid).",
+	}, []string{"event", "rule"})
+	metricCurrencyConversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_currency_conversions_total",
+		Help: "Events with a value or revenue param seen by the currency enricher, by result (converted, same, missing_currency, unknown_currency, no_rate, invalid_amount).",
+	}, []string{"result"})
+	metricPIIRedactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_pii_redactions_total",
+		Help: "Values masked by the redact enricher, by field (e.g. page.url, params.email) and detector.",
+	}, []string{"field", "detector"})
+	metricConsentDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixel_processor_consent_denied_total",
+		Help: "Events processed without consent, by category (analytics, fingerprinting, geo).",
+	}, []string{"category"})
+
+	metricDedupChecked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_dedup_checked_total",
+		Help: "Event IDs checked against the dedup window.",
+	})
+	metricDedupHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_dedup_hits_total",
+		Help: "Events dropped as duplicates.",
+	})
+
+	metricIdentifyCalls = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_fingerprint_identify_total",
+		Help: "FingerprintService.Identify calls.",
+	})
+	metricIdentifyMatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_fingerprint_matches_total",
+		Help: "Identify calls that linked the event to another visitor.",
+	})
+	metricMatchScore = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixel_processor_fingerprint_match_score",
+		Help:    "Similarity score of accepted fingerprint matches.",
+		Buckets: prometheus.LinearBuckets(0.5, 0.5, 8), // 0.5 .. 4.0
+	})
+	metricFingerprintCandidates = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixel_processor_fingerprint_candidates",
+		Help:    "Candidates scored per fingerprint lookup (visitors sharing an LSH band).",
+		Buckets: []float64{0, 1, 2, 4, 8, 16},
+	})
+
+	metricIdentityMerges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_identity_merges_total",
+		Help: "Identity clusters merged because a user_id was seen on another visitor_id.",
+	})
+	metricIdentityMergeRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_identity_merges_rejected_total",
+		Help: "Identity merges skipped because the cluster would exceed IDENTITY_MAX_CLUSTER.",
+	})
+	metricIdentityConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_identity_conflicts_total",
+		Help: "Identity merges skipped because the visitor already belongs to another user's cluster.",
+	})
+
+	metricBadgerGCRuns = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixel_processor_badger_gc_runs_total",
+		Help: "Badger value-log GC runs that rewrote a file.",
+	})
+)
+
+// Skip reasons for metricEventsSkipped.
+const (
+	skipDecode    = "decode"
+	skipMap       = "map"
+	skipDuplicate = "duplicate"
+	skipAppend    = "append"
+	skipInsert    = "insert"
+	skipSpool     = "spool"
+	skipFiltered  = "filtered"
+)
+
+// registerBadgerMetrics exposes the on-disk size of the BadgerDB.
+func registerBadgerMetrics(db *badger.DB) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "pixel_processor_badger_size_bytes",
+		Help:        "BadgerDB size on disk.",
+		ConstLabels: prometheus.Labels{"part": "lsm"},
+	}, func() float64 {
+		lsm, _ := db.Size()
+		return float64(lsm)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "pixel_processor_badger_size_bytes",
+		Help:        "BadgerDB size on disk.",
+		ConstLabels: prometheus.Labels{"part": "vlog"},
+	}, func() float64 {
+		_, vlog := db.Size()
+		return float64(vlog)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MinHash/LSH parameters of the fingerprint index. Every signal gets a
+// signature of lshBands*lshRows MinHash values over its n-grams; two signals
+// with Jaccard similarity J share at least one band with probability
+// 1-(1-J^lshRows)^lshBands: 1.0 for identical hashes, ~0.98 at J=0.6,
+// ~0.35 at J=0.3 and ~0.00002 for unrelated hashes.
+const (
+	lshBands    = 16
+	lshRows     = 3
+	minHashSize = lshBands * lshRows
+)
+
+// minHashSeeds are the seeds of the MinHash hash functions. They are part of
+// the on-disk format: changing them invalidates the index.
+var minHashSeeds = func() [minHashSize]uint64 {
+	var seeds [minHashSize]uint64
+	x := uint64(0x5049584c) // "PIXL"
+	for i := range seeds {
+		x = splitmix64(x)
+		seeds[i] = x
+	}
+	return seeds
+}()
+
+// splitmix64 is a fast 64-bit mixer, used to derive MinHash permutations.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// fnv1a is 64-bit FNV-1a without allocations.
+func fnv1a(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// minHash returns the MinHash signature of the n-grams of s (the same n-grams
+// jaccardSimilarity compares; a hash shorter than n is a single shingle).
+// Returns nil for an empty string.
+func minHash(s string, n int) []uint64 {
+	if s == "" {
+		return nil
+	}
+	var shingles []uint64
+	if len(s) < n {
+		shingles = []uint64{fnv1a(s)}
+	} else {
+		shingles = make([]uint64, 0, len(s)-n+1)
+		for i := 0; i+n <= len(s); i++ {
+			shingles = append(shingles, fnv1a(s[i:i+n]))
+		}
+	}
+
+	sig := make([]uint64, minHashSize)
+	for i, seed := range minHashSeeds {
+		lowest := ^uint64(0)
+		for _, sh := range shingles {
+			if h := splitmix64(sh ^ seed); h < lowest {
+				lowest = h
+			}
+		}
+		sig[i] = lowest
+	}
+	return sig
+}
+
+// lshBandHashes splits a signature into lshBands bands and hashes each of
+// them, formatted for use in Badger keys.
+func lshBandHashes(sig []uint64) []string {
+	if len(sig) != minHashSize {
+		return nil
+	}
+	out := make([]string, lshBands)
+	buf := make([]byte, 8*lshRows)
+	for b := 0; b < lshBands; b++ {
+		for r := 0; r < lshRows; r++ {
+			binary.LittleEndian.PutUint64(buf[8*r:], sig[b*lshRows+r])
+		}
+		out[b] = fmt.Sprintf("%016x", fnv1a(string(buf)))
+	}
+	return out
+}
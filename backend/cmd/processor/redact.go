@@ -0,0 +1,487 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// defaultPIIRulesJSON is the bundled redaction config, used unless PII_RULES is set.
+//
+//go:embed pii.json
+var defaultPIIRulesJSON []byte
+
+// PIIRulesFile is the redaction config.
+//
+//   - detectors: built-in value detectors to run, in order (email, phone,
+//     credit_card, jwt, api_key).
+//   - sensitive_params: query/param names whose values are always masked.
+//     A name matches the last words of a key, case-insensitively: "email"
+//     masks email, user_email, billing.email and userEmail, not email_verified.
+//   - custom_patterns: extra detectors, name → regular expression.
+type PIIRulesFile struct {
+	Detectors       []string          `json:"detectors"`
+	SensitiveParams []string          `json:"sensitive_params"`
+	CustomPatterns  map[string]string `json:"custom_patterns"`
+}
+
+// Values masked because of their param name are replaced with piiMask and
+// counted under the piiSensitiveParam detector.
+const (
+	piiMask           = "[redacted]"
+	piiSensitiveParam = "sensitive_param"
+)
+
+// piiDetector finds one kind of PII in a value. Matches are replaced with
+// "[name]".
+type piiDetector struct {
+	name  string
+	re    *regexp.Regexp
+	hint  func(s string) bool // Cheap precheck; nil runs the regexp on every value
+	valid func(m string) bool // Rejects false positives among matches; nil accepts all
+}
+
+var builtinPIIDetectors = map[string]piiDetector{
+	"email": {
+		re:   regexp.MustCompile(`(?i)[a-z0-9._%+\-]+@[a-z0-9\-]+(?:\.[a-z0-9\-]+)*\.[a-z]{2,}`),
+		hint: func(s string) bool { return strings.Contains(s, "@") },
+	},
+	// International numbers with a leading + and numbers written with
+	// separators; bare digit strings are IDs and timestamps far more often
+	"phone": {
+		re:    regexp.MustCompile(`\+\d{1,3}[ .\-]?(?:\(\d{1,4}\)[ .\-]?)?\d{2,4}(?:[ .\-]?\d{2,4}){1,4}|\(\d{3}\) ?\d{3}[ .\-]\d{4}|\b\d{3}[.\-]\d{3}[.\-]\d{4}\b`),
+		hint:  hasDigits(8),
+		valid: func(m string) bool { n := countDigits(m); return n >= 8 && n <= 15 },
+	},
+	// 13-19 digits (optionally grouped) with a card-network prefix (2-6) and
+	// a valid Luhn checksum
+	"credit_card": {
+		re:    regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`),
+		hint:  hasDigits(13),
+		valid: isCardNumber,
+	},
+	"jwt": {
+		re:   regexp.MustCompile(`eyJ[A-Za-z0-9_\-]{5,}\.eyJ[A-Za-z0-9_\-]{5,}\.[A-Za-z0-9_\-]*`),
+		hint: func(s string) bool { return strings.Contains(s, "eyJ") },
+	},
+	// Well-known key shapes: Stripe, AWS access key IDs, GitHub, Slack, Google
+	// API keys and bearer tokens
+	"api_key": {
+		re: regexp.MustCompile(`\b(?:sk|pk|rk)_(?:live|test)_[0-9A-Za-z]{16,}|\bAKIA[0-9A-Z]{16}\b|\bgh[pousr]_[0-9A-Za-z]{36}\b|\bgithub_pat_[0-9A-Za-z_]{40,}|\bxox[abprs]-[0-9A-Za-z\-]{10,}|\bAIza[0-9A-Za-z_\-]{35}|(?i:bearer)\s+[0-9A-Za-z._~+/\-]{20,}`),
+	},
+}
+
+// Redactor masks PII in event values (see RedactEnricher).
+type Redactor struct {
+	detectors []piiDetector
+	sensitive map[string]bool
+}
+
+// ParsePIIRules compiles a redaction config.
+func ParsePIIRules(data []byte) (*Redactor, error) {
+	var file PIIRulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	r := &Redactor{sensitive: make(map[string]bool, len(file.SensitiveParams))}
+	for _, name := range file.Detectors {
+		d, ok := builtinPIIDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown detector %q", name)
+		}
+		d.name = name
+		r.detectors = append(r.detectors, d)
+	}
+
+	names := make([]string, 0, len(file.CustomPatterns))
+	for name := range file.CustomPatterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := builtinPIIDetectors[name]; ok || name == piiSensitiveParam || name == "" {
+			return nil, fmt.Errorf("custom pattern name %q is reserved", name)
+		}
+		re, err := regexp.Compile(file.CustomPatterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("custom pattern %q: %w", name, err)
+		}
+		r.detectors = append(r.detectors, piiDetector{name: name, re: re})
+	}
+
+	for _, name := range file.SensitiveParams {
+		if words := keyWords(name); len(words) > 0 {
+			r.sensitive[strings.Join(words, "_")] = true
+		}
+	}
+	return r, nil
+}
+
+// LoadPIIRules reads a redaction config from a file.
+func LoadPIIRules(path string) (*Redactor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ParsePIIRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// isSensitive reports whether a param name ends with a name in
+// sensitive_params (see keyWords).
+func (r *Redactor) isSensitive(name string) bool {
+	words := keyWords(name)
+	for i := range words {
+		if r.sensitive[strings.Join(words[i:], "_")] {
+			return true
+		}
+	}
+	return false
+}
+
+// keyWords splits a param name into lowercase words at anything that is not
+// a letter or digit and at camelCase boundaries: "billing.email",
+// "billing_email" and "billingEmail" all give [billing email].
+func keyWords(name string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	prev := rune(0)
+	for _, c := range name {
+		switch {
+		case !unicode.IsLetter(c) && !unicode.IsDigit(c):
+			flush()
+		case unicode.IsUpper(c) && (unicode.IsLower(prev) || unicode.IsDigit(prev)):
+			flush()
+			word = append(word, c)
+		default:
+			word = append(word, c)
+		}
+		prev = c
+	}
+	flush()
+	return words
+}
+
+// redactText replaces every detector match in s. hits lists the detectors
+// that matched (once per match).
+func (r *Redactor) redactText(s string) (out string, hits []string) {
+	out = s
+	for _, d := range r.detectors {
+		if d.hint != nil && !d.hint(out) {
+			continue
+		}
+		out = d.re.ReplaceAllStringFunc(out, func(m string) string {
+			if d.valid != nil && !d.valid(m) {
+				return m
+			}
+			hits = append(hits, d.name)
+			return "[" + d.name + "]"
+		})
+	}
+	return out, hits
+}
+
+// redactQuery masks the values of a raw query string (a=1&b=2): whole values
+// of sensitive params, and values in which a detector matches (checked on
+// the decoded value, so "%40" is an @). Untouched pairs keep their encoding.
+func (r *Redactor) redactQuery(q string) (string, []string) {
+	var hits []string
+	pairs := strings.Split(q, "&")
+	for i, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || value == "" {
+			continue
+		}
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if r.isSensitive(name) {
+			pairs[i] = key + "=" + piiMask
+			hits = append(hits, piiSensitiveParam)
+			continue
+		}
+		decoded, err := url.QueryUnescape(value)
+		if err != nil {
+			decoded = value
+		}
+		if _, found := r.redactText(decoded); len(found) > 0 {
+			pairs[i] = key + "=[" + found[0] + "]"
+			hits = append(hits, found...)
+		}
+	}
+	return strings.Join(pairs, "&"), hits
+}
+
+// redactURL masks the query string and fragment of a URL as query strings
+// (OAuth implicit flows put tokens in the fragment) and detector matches in
+// the rest.
+func (r *Redactor) redactURL(u string) (string, []string) {
+	base, fragment, hasFragment := strings.Cut(u, "#")
+	base, query, hasQuery := strings.Cut(base, "?")
+
+	out, hits := r.redactText(base)
+	if hasQuery {
+		q, h := r.redactQuery(query)
+		out += "?" + q
+		hits = append(hits, h...)
+	}
+	if hasFragment {
+		var f string
+		var h []string
+		if strings.Contains(fragment, "=") {
+			f, h = r.redactQuery(fragment)
+		} else {
+			f, h = r.redactText(fragment)
+		}
+		out += "#" + f
+		hits = append(hits, h...)
+	}
+	return out, hits
+}
+
+// RedactEnricher masks PII in page, traffic and params before they are
+// stored: URLs and query strings param by param, other values by detector.
+// Params whose name is sensitive are masked whole. Redactions are counted
+// per field and detector.
+type RedactEnricher struct {
+	redactor *Redactor
+}
+
+// NewRedactEnricher creates the redact enricher with the given rules. The
+// registered one uses the bundled rules.
+func NewRedactEnricher(redactor *Redactor) *RedactEnricher {
+	return &RedactEnricher{redactor: redactor}
+}
+
+// activeRedactEnricher returns the active chain's redact enricher, or nil
+// (which redacts nothing) when it is not in the chain.
+func activeRedactEnricher() *RedactEnricher {
+	en, _ := activeEnricher("redact").(*RedactEnricher)
+	return en
+}
+
+func mustParsePIIRules(data []byte) *Redactor {
+	r, err := ParsePIIRules(data)
+	if err != nil {
+		panic(fmt.Sprintf("bundled PII rules: %v", err))
+	}
+	return r
+}
+
+func (en *RedactEnricher) Name() string { return "redact" }
+
+func (en *RedactEnricher) Enrich(in *EnrichInput, e *Event) error {
+	r := en.redactor
+	apply := func(section string, m map[string]string, key string, fn func(string) (string, []string)) {
+		v := m[key]
+		if v == "" {
+			return
+		}
+		out, hits := fn(v)
+		if len(hits) == 0 {
+			return
+		}
+		m[key] = out
+		for _, h := range hits {
+			metricPIIRedactions.WithLabelValues(section+"."+key, h).Inc()
+		}
+	}
+
+	apply("page", e.Page, "url", r.redactURL)
+	apply("page", e.Page, "path", r.redactText)
+	apply("page", e.Page, "query", r.redactQuery)
+
+	for key := range e.Traffic {
+		switch key {
+		case "referrer":
+			apply("traffic", e.Traffic, key, r.redactURL)
+		case "referrer_query":
+			apply("traffic", e.Traffic, key, r.redactQuery)
+		default:
+			apply("traffic", e.Traffic, key, r.redactText)
+		}
+	}
+
+	for key, v := range e.Params {
+		if v != "" && r.isSensitive(key) {
+			e.Params[key] = piiMask
+			delete(e.ParamsNum, key)
+			metricPIIRedactions.WithLabelValues("params."+key, piiSensitiveParam).Inc()
+			continue
+		}
+		apply("params", e.Params, key, r.redactText)
+		if e.Params[key] != v {
+			delete(e.ParamsNum, key) // e.g. a card number sent as a JSON number
+		}
+	}
+
+	for i := range e.Items {
+		for key := range e.Items[i].Params {
+			apply("items", e.Items[i].Params, key, r.redactText)
+		}
+	}
+	return nil
+}
+
+// RedactPayload masks PII in the raw event fields the enricher reads (url,
+// referrer, traffic and data), so the payload kept in the spool and the DLQ
+// holds no more than the event. Returns the re-encoded event, or nil if
+// nothing was masked or en is nil.
+func (en *RedactEnricher) RedactPayload(raw map[string]interface{}) []byte {
+	if en == nil {
+		return nil
+	}
+	r := en.redactor
+	changed := false
+	set := func(m map[string]interface{}, key string, fn func(string) (string, []string)) {
+		if v, ok := m[key].(string); ok && v != "" {
+			if out, hits := fn(v); len(hits) > 0 {
+				m[key] = out
+				changed = true
+			}
+		}
+	}
+
+	set(raw, "url", r.redactURL)
+	set(raw, "referrer", r.redactURL)
+	if traffic, ok := raw["traffic"].(map[string]interface{}); ok {
+		for key := range traffic {
+			set(traffic, key, r.redactText)
+		}
+	}
+	if data, ok := raw["data"].(map[string]interface{}); ok && r.redactRaw("", data) {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	out, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// RedactText masks detector matches in a payload dead-lettered without being
+// decoded. Sensitive param names need the decoded keys, so only detectors
+// apply. Returns payload unchanged if nothing matched or en is nil.
+func (en *RedactEnricher) RedactText(payload []byte) []byte {
+	if en == nil {
+		return payload
+	}
+	out, hits := en.redactor.redactText(string(payload))
+	if len(hits) == 0 {
+		return payload
+	}
+	return []byte(out)
+}
+
+// redactRaw masks the values of a decoded data object in place, as the
+// enricher masks the params flattened from it: values under a sensitive
+// flattened key whole, others by detector. Array elements keep the key of
+// the array. Reports whether anything was masked.
+func (r *Redactor) redactRaw(key string, v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			subKey := k
+			if key != "" {
+				subKey = key + "_" + k
+			}
+			if out, ok := r.redactRawValue(subKey, sub); ok {
+				v[k] = out
+				changed = true
+			} else if r.redactRaw(subKey, sub) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for i, sub := range v {
+			if out, ok := r.redactRawValue(key, sub); ok {
+				v[i] = out
+				changed = true
+			} else if r.redactRaw(key, sub) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// redactRawValue masks one scalar value of a data object. ok is false for
+// objects, arrays and values left as they are.
+func (r *Redactor) redactRawValue(key string, v interface{}) (out interface{}, ok bool) {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}, nil:
+		return nil, false
+	}
+	s := toString(v)
+	if s == "" {
+		return nil, false
+	}
+	if r.isSensitive(key) {
+		return piiMask, true
+	}
+	if masked, hits := r.redactText(s); len(hits) > 0 {
+		return masked, true
+	}
+	return nil, false
+}
+
+// hasDigits returns a precheck for values with at least n digits.
+func hasDigits(n int) func(string) bool {
+	return func(s string) bool { return countDigits(s) >= n }
+}
+
+func countDigits(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// isCardNumber checks the length, network prefix and Luhn checksum of a
+// possibly grouped card number.
+func isCardNumber(m string) bool {
+	digits := make([]byte, 0, len(m))
+	for i := 0; i < len(m); i++ {
+		if m[i] >= '0' && m[i] <= '9' {
+			digits = append(digits, m[i]-'0')
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 || digits[0] < 2 || digits[0] > 6 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i])
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedactorSensitiveKeys(t *testing.T) {
+	r := mustParsePIIRules(defaultPIIRulesJSON)
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"email", true},
+		{"EMAIL", true},
+		{"user_email", true},
+		{"billing.email", true},
+		{"billing_email", true}, // data.billing.email flattened
+		{"userEmail", true},
+		{"user[e-mail]", true},
+		{"customer_first_name", true},
+		{"firstName", true},
+		{"oauth_access_token", true},
+		{"email_verified", false},
+		{"emails_sent", false},
+		{"username", false},
+		{"bypass", false},
+		{"page", false},
+	}
+	for _, tt := range tests {
+		if got := r.isSensitive(tt.name); got != tt.want {
+			t.Errorf("isSensitive(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactPayload(t *testing.T) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"event_name": "signup",
+		"url": "https://shop.example/welcome?user_email=a%40b.example&plan=pro",
+		"data": {
+			"plan": "pro",
+			"user_email": "a@b.example",
+			"billing": {"email": "c@d.example", "country": "DE"},
+			"note": "call +49 30 1234 5678",
+			"items": [{"item_id": "sku-1", "comment": "ship to e@f.example"}]
+		}
+	}`), &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	redact := NewRedactEnricher(mustParsePIIRules(defaultPIIRulesJSON))
+	payload := redact.RedactPayload(raw)
+	if payload == nil {
+		t.Fatal("nothing was redacted")
+	}
+	for _, pii := range []string{"a@b.example", "a%40b.example", "c@d.example", "1234 5678", "e@f.example"} {
+		if strings.Contains(string(payload), pii) {
+			t.Errorf("payload still holds %q: %s", pii, payload)
+		}
+	}
+	for _, kept := range []string{`"plan":"pro"`, `"country":"DE"`, `"item_id":"sku-1"`, "plan=pro"} {
+		if !strings.Contains(string(payload), kept) {
+			t.Errorf("payload lost %s: %s", kept, payload)
+		}
+	}
+
+	clean := map[string]interface{}{"url": "https://shop.example/", "data": map[string]interface{}{"plan": "pro"}}
+	if payload := redact.RedactPayload(clean); payload != nil {
+		t.Errorf("clean event re-encoded: %s", payload)
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -73,8 +78,19 @@ type Event struct {
 	Traffic   map[string]string `json:"traffic"`
 	Tech      map[string]string `json:"tech"`
 	Params    map[string]string `json:"params"`
+	Consent   map[string]string `json:"consent"`
+
+	// Numeric and boolean (1/0) values of Params and Tech, typed for
+	// aggregation; the string maps keep every value
+	ParamsNum map[string]float64 `json:"params_num"`
+	TechNum   map[string]float64 `json:"tech_num"`
+
+	// Items of ecommerce events, stored in default.event_items (see EcommerceEnricher)
+	Items []EventItem `json:"items,omitempty"`
 }
 
+// MapToEvent validates a raw event and fills the event maps by running the
+// enricher chain (see ConfigureEnrichers).
 func MapToEvent(raw map[string]interface{}) (*Event, error) {
 	e := &Event{
 		IDs:     make(map[string]string),
@@ -84,6 +100,10 @@ func MapToEvent(raw map[string]interface{}) (*Event, error) {
 		Traffic: make(map[string]string),
 		Tech:    make(map[string]string),
 		Params:  make(map[string]string),
+		Consent: make(map[string]string),
+
+		ParamsNum: make(map[string]float64),
+		TechNum:   make(map[string]float64),
 	}
 
 	// 1. Timestamp and Event Name
@@ -94,41 +114,21 @@ func MapToEvent(raw map[string]interface{}) (*Event, error) {
 	}
 	e.EventName = Validate(toString(raw["event_name"]), Sanitize, MaxLength(100))
 
-	// 2. Parse sections
-	// Common extracted data for reuse
-	var userAgent, ipHash string
-	if server, ok := raw["server"].(map[string]interface{}); ok {
-		ipHash = Validate(toString(server["ip_hash"]), Sanitize, MaxLength(64))
-		userAgent = Validate(toString(server["user_agent"]), Sanitize, MaxLength(500))
-	} else {
-		ipHash = Validate(toString(raw["ip_hash"]), Sanitize, MaxLength(64))
-		userAgent = Validate(toString(raw["user_agent"]), Sanitize, MaxLength(500))
+	// 2. Fill Maps: run the configured enricher chain
+	in := newEnrichInput(raw)
+	for _, en := range enrichers {
+		if err := en.Enrich(in, e); err != nil {
+			return nil, fmt.Errorf("enricher %s: %w", en.Name(), err)
+		}
 	}
 
-	// 3. Fill Maps
-	parseIDs(raw, e)
-	
-	// Geo & IP
-	e.Geo["ip_hash"] = ipHash
-	parseGeo(raw, e)
-	
-	// Device & UserAgent
-	e.Device["user_agent"] = userAgent
-	parseDevice(raw, userAgent, e) // Pass UA explicitly
-	
-	// Page & Traffic (including Referrer)
-	urlParts := parseURL(Validate(toString(raw["url"]), Sanitize, MaxLength(2048)))
-	parsePage(raw, urlParts, e)
-	parseTraffic(raw, urlParts, e) // Parses traffic AND referrer
-	
-	parseTech(raw, e)
-	parseParams(raw, e)
-
 	return e, nil
 }
 
 // parseIDs extracts and validates ID fields.
 func parseIDs(raw map[string]interface{}, e *Event) {
+	e.IDs["event_id"] = ensureEventID(raw)
+
 	e.IDs["user_id"] = Validate(toString(raw["user_id"]), Sanitize, MaxLength(64), IsID)
 	if e.IDs["user_id"] == "" {
 		e.IDs["user_id"] = Validate(toString(raw["uid"]), Sanitize, MaxLength(64), IsID)
@@ -142,6 +142,31 @@ func parseIDs(raw map[string]interface{}, e *Event) {
 	e.IDs["session_id"] = Validate(toString(raw["session_id"]), Sanitize, MaxLength(64), IsID)
 }
 
+// ensureEventID returns the event's stable ID and stores it in raw["event_id"].
+// The tracker sends its own ID; otherwise the ID is a hash of the client payload
+// (everything except the collector's "server" block, which differs on every
+// delivery), so redelivered copies of an event get the same ID.
+func ensureEventID(raw map[string]interface{}) string {
+	if id := Validate(toString(raw["event_id"]), Sanitize, MaxLength(64), IsID); id != "" {
+		raw["event_id"] = id
+		return id
+	}
+
+	content := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		if k == "server" || k == "event_id" {
+			continue
+		}
+		content[k] = v
+	}
+	data, _ := json.Marshal(content) // Map keys are sorted, so the encoding is stable
+
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:16])
+	raw["event_id"] = id
+	return id
+}
+
 // parsePage extracts page information (url, path, query...).
 func parsePage(raw map[string]interface{}, urlParts map[string]string, e *Event) {
 	e.Page["url"] = Validate(toString(raw["url"]), Sanitize, MaxLength(2048))
@@ -162,6 +187,7 @@ func parseGeo(raw map[string]interface{}, e *Event) {
 		e.Geo["continent"] = Validate(toString(server["continent"]), Sanitize, MaxLength(20))
 		e.Geo["metro_code"] = Validate(toString(server["metro_code"]), Sanitize, MaxLength(50))
 		e.Geo["timezone"] = Validate(toString(server["timezone"]), Sanitize, MaxLength(100))
+		e.Geo["asn"] = Validate(toString(server["asn"]), IsNumeric, MaxLength(10))
 	}
 }
 
@@ -219,30 +245,8 @@ func enrichDeviceFromUA(device map[string]interface{}, uaStr string, e *Event) {
 		}
 	}
 
-	// Bot Detection
-	isBot := false
-	// 1. Check uaparser result
-	if ua.Device.Family == "Spider" || ua.UserAgent.Family == "Bot" {
-		isBot = true
-	}
-	// 2. Check webdriver (strong signal)
-	webdriverStr := toString(device["webdriver"])
-	if !isBot && (webdriverStr == "true" || webdriverStr == "1") {
-		isBot = true
-	}
-	// 3. Simple fallback check for common bots
-	if !isBot {
-		lowerUA := strings.ToLower(uaStr)
-		botMarkers := []string{"bot", "crawler", "spider", "slurp", "facebookexternalhit"}
-		for _, m := range botMarkers {
-			if strings.Contains(lowerUA, m) {
-				isBot = true
-				break
-			}
-		}
-	}
-	e.Device["is_bot"] = strconv.FormatBool(isBot)
-	
+	// Bot detection is done by the "bot" enricher (botscore.go)
+
 	frontendWebview := toString(device["webview"])
 	if frontendWebview != "" {
 		e.Device["is_webview"] = "true"
@@ -260,18 +264,22 @@ func parseTech(raw map[string]interface{}, e *Event) {
 	if device, ok := raw["device"].(map[string]interface{}); ok {
 		e.Tech["ad_block"] = toString(device["adBlock"])
 		e.Tech["pdf_viewer"] = toString(device["pdfViewerEnabled"])
+		flattenNumbers("ad_block", device["adBlock"], e.TechNum)
+		flattenNumbers("pdf_viewer", device["pdfViewerEnabled"], e.TechNum)
 
 		if perf, ok := device["performance"].(map[string]interface{}); ok {
 			flatten("", perf, e.Tech)
+			flattenNumbers("", perf, e.TechNum)
 		}
 		if conn, ok := device["connection"].(map[string]interface{}); ok {
 			flatten("", conn, e.Tech)
+			flattenNumbers("", conn, e.TechNum)
 		}
 	}
 }
 
 // parseTraffic extracts traffic attribution including referrer.
-func parseTraffic(raw map[string]interface{}, urlParts map[string]string, e *Event) {
+func parseTraffic(raw map[string]interface{}, urlParts map[string]string, rules *ChannelRules, e *Event) {
 	// 1. Referrer Parsing (moved from Context)
 	referrerStr := Validate(toString(raw["referrer"]), Sanitize, MaxLength(2048))
 	e.Traffic["referrer"] = referrerStr
@@ -294,37 +302,32 @@ func parseTraffic(raw map[string]interface{}, urlParts map[string]string, e *Eve
 		flattenWithValidation("", traffic, e.Traffic, 200)
 	}
 	
-	// 3. Layer 2: From URL query parameters
-	trafficParams := map[string]string{
-		"source":   "url_query_source",
-		"channel":  "url_query_channel",
-		"campaign": "url_query_campaign",
-		"term":     "url_query_term",
-		"content":  "url_query_content",
-	}
-	for trafficKey, urlQueryKey := range trafficParams {
-		if e.Traffic[trafficKey] == "" && urlParts[urlQueryKey] != "" {
-			e.Traffic[trafficKey] = urlParts[urlQueryKey]
+	// 3. Layer 2: From URL query parameters (plain keys first, then utm_*)
+	trafficParams := []struct {
+		key, urlQueryKey, utmKey string
+	}{
+		{"source", "url_query_source", "url_query_utm_source"},
+		{"channel", "url_query_channel", "url_query_utm_medium"},
+		{"campaign", "url_query_campaign", "url_query_utm_campaign"},
+		{"term", "url_query_term", "url_query_utm_term"},
+		{"content", "url_query_content", "url_query_utm_content"},
+	}
+	for _, p := range trafficParams {
+		if e.Traffic[p.key] != "" {
+			continue
+		}
+		if urlParts[p.urlQueryKey] != "" {
+			e.Traffic[p.key] = urlParts[p.urlQueryKey]
+		} else if urlParts[p.utmKey] != "" {
+			e.Traffic[p.key] = urlParts[p.utmKey]
 		}
 	}
-	
-	// 4. Layer 3: From click ID parameters
+
+	// 4. Layer 3: From click ID parameters (click_ids in the channel rules)
 	if e.Traffic["source"] == "" && e.Traffic["channel"] == "" {
-		clickIDMap := map[string]string{
-			"url_query_gclid":   "google",
-			"url_query_fbclid":  "facebook",
-			"url_query_msclkid": "bing",
-			"url_query_ttclid":  "tiktok",
-			"url_query_yclid":    "yandex",
-			"url_query_vk_id":    "vk",
-			"url_query_vk_ref":   "vk",
-		}
-		for urlQueryKey, sourceName := range clickIDMap {
-			if urlParts[urlQueryKey] != "" {
-				e.Traffic["source"] = sourceName
-				e.Traffic["channel"] = "cpc"
-				break
-			}
+		if source := rules.ClickIDSource(urlParts); source != "" {
+			e.Traffic["source"] = source
+			e.Traffic["channel"] = "cpc"
 		}
 	}
 
@@ -333,7 +336,7 @@ func parseTraffic(raw map[string]interface{}, urlParts map[string]string, e *Eve
 	if e.Traffic["source"] == "" && e.Traffic["channel"] == "" {
 		if refHost := e.Traffic["referrer_host"]; refHost != "" {
 			// Check for Organic Search first
-			if engine := getSearchEngine(refHost); engine != "" {
+			if engine, category := rules.LookupDomain(refHost); category == "search" {
 				e.Traffic["source"] = engine
 				e.Traffic["channel"] = "organic"
 			} else {
@@ -343,41 +346,16 @@ func parseTraffic(raw map[string]interface{}, urlParts map[string]string, e *Eve
 			}
 		}
 	}
-}
 
-// getSearchEngine identifies common search engines by referrer host.
-// Returns the engine name (e.g., "google", "yandex") or empty string.
-func getSearchEngine(host string) string {
-	h := strings.ToLower(host)
-	
-	searchEngines := []struct {
-		substr string
-		name   string
-	}{
-		{"google.", "google"},
-		{"yandex.", "yandex"},
-		{"ya.ru", "yandex"},
-		{"bing.com", "bing"},
-		{"yahoo.", "yahoo"},
-		{"duckduckgo.", "duckduckgo"},
-		{"baidu.", "baidu"},
-		{"go.mail.ru", "mail.ru"},
-	}
-
-	for _, se := range searchEngines {
-		if strings.Contains(h, se.substr) {
-			return se.name
-		}
-	}
-	
-	return ""
+	// 5. Channel group from the rule engine (see channels.go)
+	e.Traffic["channel_group"] = rules.Group(e.Traffic)
 }
 
-
 // parseParams extracts custom event parameters.
 func parseParams(raw map[string]interface{}, e *Event) {
 	if data, ok := raw["data"].(map[string]interface{}); ok {
 		flattenWithValidation("", data, e.Params, 1000)
+		flattenNumbers("", data, e.ParamsNum)
 	}
 }
 
@@ -397,11 +375,77 @@ func flattenWithValidation(prefix string, val interface{}, result map[string]str
 		if prefix != "" {
 			// Validate value
 			strVal := toString(v)
+			if b, ok := parseBoolString(strVal); ok {
+				strVal = strconv.FormatBool(b) // "True", "FALSE" → "true", "false"
+			}
 			result[prefix] = Validate(strVal, Sanitize, MaxLength(maxLength))
 		}
 	}
 }
 
+// flattenNumbers writes the numeric values of a nested structure under the
+// keys flattenWithValidation gives them (see toNumber).
+func flattenNumbers(prefix string, val interface{}, result map[string]float64) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, subVal := range v {
+			newKey := k
+			if prefix != "" {
+				newKey = prefix + "_" + k
+			}
+			flattenNumbers(newKey, subVal, result)
+		}
+	default:
+		if prefix == "" {
+			return
+		}
+		if f, ok := toNumber(v); ok {
+			result[prefix] = f
+		}
+	}
+}
+
+// decimalPattern matches strings typed as numbers: plain decimals without
+// leading zeros or exponents, at most 15 integer digits (so "00123" zip codes
+// and long IDs stay strings only).
+var decimalPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]{0,14})(\.[0-9]+)?$`)
+
+// toNumber returns the numeric value of a JSON value: numbers, booleans
+// (true/false in any case → 1/0) and decimal strings.
+func toNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+	case int:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		if b, ok := parseBoolString(v); ok {
+			return toNumber(b)
+		}
+		if decimalPattern.MatchString(v) {
+			f, err := strconv.ParseFloat(v, 64)
+			return f, err == nil
+		}
+	}
+	return 0, false
+}
+
+// parseBoolString recognizes "true" and "false" in any case.
+func parseBoolString(s string) (bool, bool) {
+	switch {
+	case strings.EqualFold(s, "true"):
+		return true, true
+	case strings.EqualFold(s, "false"):
+		return false, true
+	}
+	return false, false
+}
+
 // flatten helper (legacy, replaced by flattenWithValidation but kept if needed)
 func flatten(prefix string, val interface{}, result map[string]string) {
 	flattenWithValidation(prefix, val, result, 500)
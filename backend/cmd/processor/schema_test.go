@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestToNumber(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		want float64
+		ok   bool
+	}{
+		{"2", 2, true},
+		{"99.90", 99.9, true},
+		{"-0.5", -0.5, true},
+		{"0", 0, true},
+		{"0.25", 0.25, true},
+		{"123456789012345", 123456789012345, true}, // 15 integer digits
+		{"1234567890123456", 0, false},             // Longer: an ID
+		{"-1234567890123456.5", 0, false},
+		{"007", 0, false}, // Leading zeros: zip codes, codes
+		{"00.5", 0, false},
+		{"1e3", 0, false},
+		{"1E-2", 0, false},
+		{"+1", 0, false},
+		{".5", 0, false},
+		{"5.", 0, false},
+		{" 5", 0, false},
+		{"1,5", 0, false},
+		{"0x1F", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"", 0, false},
+		{"true", 1, true},
+		{"FALSE", 0, true},
+		{"yes", 0, false},
+		{true, 1, true},
+		{false, 0, true},
+		{float64(1e3), 1000, true}, // JSON numbers are numbers in any notation
+		{float64(-0.5), -0.5, true},
+		{math.NaN(), 0, false},
+		{math.Inf(1), 0, false},
+		{42, 42, true},
+		{nil, 0, false},
+		{[]interface{}{1.0}, 0, false},
+		{map[string]interface{}{"a": 1.0}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := toNumber(tt.val)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("toNumber(%#v) = %v, %v; want %v, %v", tt.val, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseParamsTyping(t *testing.T) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"data": {
+		"amount": 19.99,
+		"big": 1e3,
+		"qty": "3",
+		"discount": "-0.5",
+		"zip": "007",
+		"order_id": "1234567890123456",
+		"sci": "1e3",
+		"gift": true,
+		"newsletter": "FALSE",
+		"trial": "True",
+		"answer": "yes",
+		"empty": null,
+		"tags": ["a", "b"],
+		"cart": {"total": "42.50", "coupon": "SPRING", "paid": false}
+	}}`), &raw); err != nil {
+		t.Fatal(err)
+	}
+	e := &Event{Params: make(map[string]string), ParamsNum: make(map[string]float64)}
+	parseParams(raw, e)
+
+	wantParams := map[string]string{
+		"amount":     "19.99",
+		"big":        "1000",
+		"qty":        "3",
+		"discount":   "-0.5",
+		"zip":        "007",
+		"order_id":   "1234567890123456",
+		"sci":        "1e3",
+		"gift":       "true",
+		"newsletter": "false",
+		"trial":      "true",
+		"answer":     "yes",
+		"cart_total": "42.50",
+		"cart_paid":  "false",
+	}
+	for k, want := range wantParams {
+		if got := e.Params[k]; got != want {
+			t.Errorf("params[%s] = %q, want %q", k, got, want)
+		}
+	}
+	if _, ok := e.Params["empty"]; ok {
+		t.Error("null param stored")
+	}
+
+	wantNum := map[string]float64{
+		"amount":     19.99,
+		"big":        1000,
+		"qty":        3,
+		"discount":   -0.5,
+		"gift":       1,
+		"newsletter": 0,
+		"trial":      1,
+		"cart_total": 42.5,
+		"cart_paid":  0,
+	}
+	if len(e.ParamsNum) != len(wantNum) {
+		t.Errorf("params_num = %v, want %v", e.ParamsNum, wantNum)
+	}
+	for k, want := range wantNum {
+		if got, ok := e.ParamsNum[k]; !ok || got != want {
+			t.Errorf("params_num[%s] = %v, %v; want %v", k, got, ok, want)
+		}
+	}
+
+	// params_num mirrors params: same keys, never a key params lacks
+	for k := range e.ParamsNum {
+		if _, ok := e.Params[k]; !ok {
+			t.Errorf("params_num key %q is not in params", k)
+		}
+	}
+}
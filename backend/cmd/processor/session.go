@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+const (
+	sessionKeyPrefix = "sess/"
+	sessionLockCount = 64
+)
+
+// sessionState is the per-visitor state stored in Badger.
+type sessionState struct {
+	SessionID string    `json:"sid"`
+	ClientSID string    `json:"csid"` // session_id the tracker sent for this session
+	Seq       int       `json:"seq"`  // Session number of the visitor, 1-based
+	Index     int       `json:"idx"`  // Events in the current session
+	Campaign  string    `json:"cmp"`  // source|channel|campaign that started the session
+	Start     time.Time `json:"start"`
+	Last      time.Time `json:"last"`
+}
+
+// SessionEnricher assigns server-side sessions. A visitor's session ends after
+// the inactivity timeout, at midnight (in the configured location) and when
+// the event arrives with a different campaign. The tracker's session_id is
+// kept as long as it agrees with these rules; otherwise it is replaced.
+//
+// Writes ids.session_id, ids.session_seq, ids.is_session_start and
+// ids.event_index_in_session. Registered as "session"; a no-op until
+// created with a Badger DB (replay-dlq -dry-run keeps client sessions).
+type SessionEnricher struct {
+	db       *badger.DB
+	timeout  time.Duration
+	stateTTL time.Duration
+	loc      *time.Location
+
+	locks [sessionLockCount]sync.Mutex // Striped by visitor ID
+}
+
+// NewSessionEnricher creates the session enricher on top of an open BadgerDB.
+// State is kept for stateTTL after the visitor's last event, so session_seq
+// survives between visits.
+func NewSessionEnricher(db *badger.DB, timeout, stateTTL time.Duration, loc *time.Location) *SessionEnricher {
+	return &SessionEnricher{db: db, timeout: timeout, stateTTL: stateTTL, loc: loc}
+}
+
+// Erase deletes the visitors' session state. Returns the number of visitors
+// that had state.
+func (s *SessionEnricher) Erase(visitorIDs []string) (int, error) {
+	if s.db == nil {
+		return 0, nil
+	}
+	erased := 0
+	for _, vid := range visitorIDs {
+		lock := &s.locks[lockIndex(vid)]
+		lock.Lock()
+		err := s.db.Update(func(txn *badger.Txn) error {
+			key := []byte(sessionKeyPrefix + vid)
+			if _, err := txn.Get(key); err != nil {
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					return nil
+				}
+				return err
+			}
+			erased++
+			return txn.Delete(key)
+		})
+		lock.Unlock()
+		if err != nil {
+			return erased, err
+		}
+	}
+	return erased, nil
+}
+
+func (s *SessionEnricher) Name() string { return "session" }
+
+func (s *SessionEnricher) Enrich(in *EnrichInput, e *Event) error {
+	if s.db == nil || !in.Consent.Analytics {
+		return nil
+	}
+	visitorID := e.IDs["visitor_id"]
+	if visitorID == "" {
+		return nil
+	}
+	clientSID := e.IDs["session_id"]
+	campaign := sessionCampaign(e, in.URLParts["url_host"])
+
+	lock := &s.locks[lockIndex(visitorID)]
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := []byte(sessionKeyPrefix + visitorID)
+	var st sessionState
+	found := false
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		found = true
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &st)
+		})
+	})
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		// Keep the tracker's session rather than failing the event
+		log.Printf("Session: failed to read state for %s: %v", visitorID, err)
+		return nil
+	}
+
+	ts := e.Timestamp
+	if !found || s.isNewSession(&st, ts, clientSID, campaign) {
+		sid := clientSID
+		if sid == "" || sid == st.ClientSID {
+			sid = newSessionID(visitorID, ts)
+		}
+		st = sessionState{
+			SessionID: sid,
+			ClientSID: clientSID,
+			Seq:       st.Seq + 1,
+			Campaign:  campaign,
+			Start:     ts,
+			Last:      ts,
+		}
+	}
+	st.Index++
+	if ts.After(st.Last) {
+		st.Last = ts
+	}
+
+	e.IDs["session_id"] = st.SessionID
+	e.IDs["session_seq"] = strconv.Itoa(st.Seq)
+	e.IDs["is_session_start"] = strconv.FormatBool(st.Index == 1)
+	e.IDs["event_index_in_session"] = strconv.Itoa(st.Index)
+
+	data, _ := json.Marshal(st)
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(key, data).WithTTL(s.stateTTL))
+	})
+	if err != nil {
+		log.Printf("Session: failed to save state for %s: %v", visitorID, err)
+	}
+	return nil
+}
+
+// isNewSession applies the split rules to an event of a known visitor.
+// Late events (older than the last one) stay in the current session.
+func (s *SessionEnricher) isNewSession(st *sessionState, ts time.Time, clientSID, campaign string) bool {
+	if clientSID != "" && clientSID != st.ClientSID {
+		return true // The tracker started a new session
+	}
+	if !ts.After(st.Last) {
+		return false
+	}
+	if ts.Sub(st.Last) > s.timeout {
+		return true
+	}
+	if !sameDay(ts.In(s.loc), st.Last.In(s.loc)) {
+		return true
+	}
+	return campaign != "" && campaign != st.Campaign
+}
+
+// sessionCampaign identifies the traffic source of an event for the campaign
+// split. Navigation inside the site (self-referral) and direct hits carry no campaign.
+func sessionCampaign(e *Event, pageHost string) string {
+	source, channel := e.Traffic["source"], e.Traffic["channel"]
+	if source == "" && channel == "" {
+		return ""
+	}
+	if channel == "referral" && source == pageHost {
+		return ""
+	}
+	return source + "|" + channel + "|" + e.Traffic["campaign"]
+}
+
+// newSessionID derives a session ID from the visitor and the session start.
+func newSessionID(visitorID string, start time.Time) string {
+	sum := sha256.Sum256([]byte(visitorID + "/" + strconv.FormatInt(start.UnixNano(), 10)))
+	return hex.EncodeToString(sum[:12])
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+func lockIndex(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % sessionLockCount
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsNewSession(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	s := NewSessionEnricher(nil, 30*time.Minute, time.Hour, loc)
+	at := func(hhmm string) time.Time {
+		ts, err := time.Parse("2006-01-02 15:04", hhmm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	const campaign = "google|organic|"
+	tests := []struct {
+		name      string
+		last, ts  string // UTC
+		clientSID string
+		campaign  string
+		want      bool
+	}{
+		{"within the timeout", "2026-10-16 10:00", "2026-10-16 10:29", "", "", false},
+		{"at the timeout", "2026-10-16 10:00", "2026-10-16 10:30", "", "", false},
+		{"past the timeout", "2026-10-16 10:00", "2026-10-16 10:31", "", "", true},
+		{"midnight in loc", "2026-10-16 20:50", "2026-10-16 21:05", "", "", true},
+		{"midnight in UTC only", "2026-10-16 23:50", "2026-10-17 00:05", "", "", false},
+		{"late event", "2026-10-16 10:00", "2026-10-16 08:00", "", "", false},
+		{"late event across midnight in loc", "2026-10-16 21:05", "2026-10-16 20:50", "", "", false},
+		{"same time", "2026-10-16 10:00", "2026-10-16 10:00", "", "newsletter|email|spring", false},
+		{"campaign change", "2026-10-16 10:00", "2026-10-16 10:05", "", "newsletter|email|spring", true},
+		{"same campaign", "2026-10-16 10:00", "2026-10-16 10:05", "", campaign, false},
+		{"no campaign", "2026-10-16 10:00", "2026-10-16 10:05", "", "", false},
+		{"late event with another campaign", "2026-10-16 10:00", "2026-10-16 09:55", "", "newsletter|email|spring", false},
+		{"same client session_id", "2026-10-16 10:00", "2026-10-16 10:05", "c1", "", false},
+		{"client session_id past the timeout", "2026-10-16 10:00", "2026-10-16 11:00", "c1", "", true},
+		{"new client session_id", "2026-10-16 10:00", "2026-10-16 10:05", "c2", "", true},
+		{"new client session_id on a late event", "2026-10-16 10:00", "2026-10-16 09:00", "c2", "", true},
+	}
+	for _, tt := range tests {
+		st := sessionState{ClientSID: "c1", Campaign: campaign, Last: at(tt.last)}
+		if got := s.isNewSession(&st, at(tt.ts), tt.clientSID, tt.campaign); got != tt.want {
+			t.Errorf("%s: isNewSession = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSessionEnricher(t *testing.T) {
+	db := openScratchBadger("")
+	defer db.Close()
+	s := NewSessionEnricher(db, 30*time.Minute, time.Hour, time.UTC)
+	in := &EnrichInput{Consent: Consent{Analytics: true}, URLParts: map[string]string{"url_host": "example.com"}}
+	start := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		after     time.Duration // Since start
+		clientSID string
+		source    string // Traffic source and channel
+		sid       string // Empty: a server-side ID
+		seq       string
+		index     string
+	}{
+		{"first event keeps the tracker's session", 0, "c1", "", "c1", "1", "1"},
+		{"same session", 5 * time.Minute, "c1", "", "c1", "1", "2"},
+		{"self-referral is no campaign", 6 * time.Minute, "c1", "example.com|referral", "c1", "1", "3"},
+		{"timeout replaces a stale client session_id", 40 * time.Minute, "c1", "", "", "2", "1"},
+		{"new client session_id", 41 * time.Minute, "c2", "", "c2", "3", "1"},
+		{"late event stays", 39 * time.Minute, "c2", "", "c2", "3", "2"},
+		{"campaign change", 45 * time.Minute, "c2", "google|organic", "", "4", "1"},
+		{"no client session_id", 46 * time.Minute, "", "", "", "4", "2"},
+	}
+	var serverSID string
+	for _, tt := range tests {
+		e := &Event{
+			Timestamp: start.Add(tt.after),
+			IDs:       map[string]string{"visitor_id": "v1", "session_id": tt.clientSID},
+			Traffic:   make(map[string]string),
+		}
+		if tt.source != "" {
+			source, channel, _ := strings.Cut(tt.source, "|")
+			e.Traffic["source"], e.Traffic["channel"] = source, channel
+		}
+		if err := s.Enrich(in, e); err != nil {
+			t.Fatal(err)
+		}
+
+		sid := e.IDs["session_id"]
+		if tt.sid != "" && sid != tt.sid {
+			t.Errorf("%s: session_id = %q, want %q", tt.name, sid, tt.sid)
+		}
+		if tt.sid == "" && tt.index == "1" {
+			if sid == "" || sid == serverSID || sid == tt.clientSID {
+				t.Errorf("%s: session_id = %q, want a new server-side ID", tt.name, sid)
+			}
+			serverSID = sid
+		}
+		if tt.sid == "" && tt.index != "1" && sid != serverSID {
+			t.Errorf("%s: session_id = %q, want %q", tt.name, sid, serverSID)
+		}
+		if e.IDs["session_seq"] != tt.seq || e.IDs["event_index_in_session"] != tt.index {
+			t.Errorf("%s: session_seq %s, index %s; want %s, %s", tt.name, e.IDs["session_seq"], e.IDs["event_index_in_session"], tt.seq, tt.index)
+		}
+		if got, want := e.IDs["is_session_start"], tt.index == "1"; got != strconv.FormatBool(want) {
+			t.Errorf("%s: is_session_start = %s", tt.name, got)
+		}
+	}
+
+	// Without analytics consent the tracker's session is kept and no state is stored
+	e := &Event{Timestamp: start, IDs: map[string]string{"visitor_id": "v2", "session_id": "c9"}, Traffic: make(map[string]string)}
+	if err := s.Enrich(&EnrichInput{}, e); err != nil {
+		t.Fatal(err)
+	}
+	if e.IDs["session_id"] != "c9" || e.IDs["session_seq"] != "" {
+		t.Errorf("without consent: ids = %v", e.IDs)
+	}
+	if n, err := s.Erase([]string{"v1", "v2"}); err != nil || n != 1 {
+		t.Errorf("Erase = %d, %v; want 1 visitor", n, err)
+	}
+}
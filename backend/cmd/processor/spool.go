@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt    = ".wal"
+	tmpExt        = ".tmp"       // Segment being rewritten, see Rewrite
+	quarantineDir = "quarantine" // Unreadable segments, under the spool directory
+)
+
+// maxRecordSize caps a record's framed length; a larger length can only
+// come from a corrupt header. Records hold a payload of at most maxLineSize.
+const maxRecordSize = 4 * maxLineSize
+
+// SpoolRecord is one accepted event as stored in the write-ahead spool.
+type SpoolRecord struct {
+	EventID string          `json:"id"`
+	Event   *Event          `json:"e"`
+	Payload json.RawMessage `json:"p"`
+	Link    *IdentityLink   `json:"l,omitempty"`
+}
+
+// Segment is a sealed spool file, ready to be drained.
+type Segment struct {
+	Seq   uint64
+	Path  string
+	Count int // Decodable records
+}
+
+// Spool is a segmented write-ahead log on local disk. Records are appended
+// (and fsynced) to the active segment; sealed segments are handed to the
+// drainer in order and removed once delivered.
+//
+// Record framing: uint32 length | uint32 CRC32 | JSON SpoolRecord.
+// A torn record at the end of a segment (crash during write) is ignored.
+type Spool struct {
+	dir string
+
+	mu          sync.Mutex
+	active      *os.File
+	activeSeq   uint64
+	activeCount int
+	activeSize  int64
+	sealed      []Segment
+	pending     int // Events in sealed segments + active segment
+}
+
+// OpenSpool opens (or creates) the spool directory. Segments left over from
+// a previous run are sealed and queued for draining; segments that cannot be
+// read are moved to the quarantine subdirectory.
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			os.Remove(filepath.Join(dir, name)) // Rewrite interrupted by a crash
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq > s.activeSeq {
+			s.activeSeq = seq // Also past quarantined names
+		}
+		path := filepath.Join(dir, name)
+		records, bad, err := readSegment(path)
+		if err != nil {
+			// Keep the file for inspection and start without it
+			if qerr := s.quarantine(path); qerr != nil {
+				return nil, fmt.Errorf("spool: quarantine %s: %w (read: %v)", name, qerr, err)
+			}
+			log.Printf("Spool: cannot read %s, moved to %s: %v", name, quarantineDir, err)
+			continue
+		}
+		if len(records) == 0 && len(bad) == 0 {
+			os.Remove(path)
+			continue
+		}
+		s.sealed = append(s.sealed, Segment{Seq: seq, Path: path, Count: len(records)})
+		s.pending += len(records)
+	}
+	sort.Slice(s.sealed, func(i, j int) bool { return s.sealed[i].Seq < s.sealed[j].Seq })
+
+	if len(s.sealed) > 0 {
+		log.Printf("Spool: recovered %d segments (%d events)", len(s.sealed), s.pending)
+	}
+
+	if err := s.openActive(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Pending returns the number of events not yet delivered.
+func (s *Spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// ActiveCount returns the number of events in the active (unsealed) segment.
+func (s *Spool) ActiveCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activeCount
+}
+
+// Append durably writes records to the active segment.
+func (s *Spool) Append(records []SpoolRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	buf, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.active.Write(buf); err != nil {
+		// Drop the partial write so later records stay readable
+		s.active.Truncate(s.activeSize)
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		s.active.Truncate(s.activeSize)
+		return err
+	}
+	s.activeSize += int64(len(buf))
+	s.activeCount += len(records)
+	s.pending += len(records)
+	return nil
+}
+
+// Seal closes the active segment (if it has records) and opens a new one.
+func (s *Spool) Seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeCount == 0 {
+		return nil
+	}
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	s.sealed = append(s.sealed, Segment{Seq: s.activeSeq, Path: s.active.Name(), Count: s.activeCount})
+	return s.openActive()
+}
+
+// Oldest returns the oldest sealed segment.
+func (s *Spool) Oldest() (Segment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sealed) == 0 {
+		return Segment{}, false
+	}
+	return s.sealed[0], true
+}
+
+// Sealed returns the sealed segments, oldest first.
+func (s *Spool) Sealed() []Segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Segment(nil), s.sealed...)
+}
+
+// Remove deletes a delivered segment.
+func (s *Spool) Remove(seg Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(seg.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i, sealed := range s.sealed {
+		if sealed.Seq == seg.Seq {
+			s.sealed = append(s.sealed[:i], s.sealed[i+1:]...)
+			s.pending -= seg.Count
+			break
+		}
+	}
+	return nil
+}
+
+// Rewrite replaces the records of a sealed segment, e.g. with those still
+// undelivered after part of it was inserted. The new file is written next to
+// the old one and renamed over it, so a crash leaves either version.
+func (s *Spool) Rewrite(seg Segment, records []SpoolRecord) (Segment, error) {
+	if len(records) == 0 {
+		return seg, s.Remove(seg)
+	}
+	buf, err := encodeRecords(records)
+	if err != nil {
+		return seg, err
+	}
+
+	tmp := seg.Path + tmpExt
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return seg, err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, seg.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return seg, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sealed := range s.sealed {
+		if sealed.Seq == seg.Seq {
+			s.pending += len(records) - sealed.Count
+			s.sealed[i].Count = len(records)
+			break
+		}
+	}
+	seg.Count = len(records)
+	return seg, nil
+}
+
+// Close seals the active segment so it is drained after restart.
+func (s *Spool) Close() error {
+	if err := s.Seal(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.active.Name()
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path) // Fresh active segment is empty
+}
+
+// quarantine moves an unreadable segment out of the way.
+func (s *Spool) quarantine(path string) error {
+	dir := filepath.Join(s.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
+
+// openActive creates the next active segment. Caller holds mu (or owns s).
+func (s *Spool) openActive() error {
+	s.activeSeq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.activeSeq, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.activeCount = 0
+	s.activeSize = 0
+	return nil
+}
+
+// encodeRecords frames records for a segment file.
+func encodeRecords(records []SpoolRecord) ([]byte, error) {
+	var buf []byte
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		var header [8]byte
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(data)))
+		binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data))
+		buf = append(buf, header[:]...)
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// readSegment reads all intact records of a segment file. Records that are
+// intact but cannot be decoded (e.g. written by an incompatible release) are
+// returned raw in bad instead of failing the segment.
+func readSegment(path string) (records []SpoolRecord, bad [][]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err != io.EOF {
+				log.Printf("Spool: truncated record header in %s, ignoring tail", path)
+			}
+			return records, bad, nil
+		}
+		size := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if size > maxRecordSize {
+			log.Printf("Spool: invalid record length in %s, ignoring tail", path)
+			return records, bad, nil
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			log.Printf("Spool: truncated record in %s, ignoring tail", path)
+			return records, bad, nil
+		}
+		if crc32.ChecksumIEEE(data) != sum {
+			log.Printf("Spool: checksum mismatch in %s, ignoring tail", path)
+			return records, bad, nil
+		}
+
+		var rec SpoolRecord
+		if err := json.Unmarshal(data, &rec); err != nil || rec.Event == nil {
+			bad = append(bad, data)
+			continue
+		}
+		records = append(records, rec)
+	}
+}
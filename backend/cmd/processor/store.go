@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// openBadger opens the processor's local BadgerDB and starts its GC loop.
+// The DB is shared by stateful services, each under its own "<name>/" key
+// prefix (fp/, dedup/, sess/, idg/).
+func openBadger(dbPath string) (*badger.DB, error) {
+	opts := badger.DefaultOptions(dbPath)
+	opts.Logger = nil // Disable default logger
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start GC loop to reclaim disk space
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+		again:
+			err := db.RunValueLogGC(0.7)
+			if err == nil {
+				metricBadgerGCRuns.Inc()
+				goto again
+			}
+		}
+	}()
+
+	return db, nil
+}
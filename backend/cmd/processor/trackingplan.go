@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Tracking plan enforcement modes.
+const (
+	PlanModeAnnotate = "annotate" // Keep the event, list violations in tech.tracking_plan_violations
+	PlanModeStrip    = "strip"    // Like annotate, and drop params the plan does not declare
+	PlanModeReject   = "reject"   // Dead-letter events with any violation (map stage)
+)
+
+// Violation rules, used in tech.tracking_plan_violations and as metric labels.
+const (
+	ruleMissing        = "missing"
+	ruleType           = "type"
+	ruleEnum           = "enum"
+	ruleRange          = "range"
+	ruleUnknownParam   = "unknown_param"
+	ruleUnplannedEvent = "unplanned_event"
+)
+
+// planViolationsKey is the tech key violations are written to.
+const planViolationsKey = "tracking_plan_violations"
+
+// ParamRule declares one param of a planned event.
+type ParamRule struct {
+	Type     string   `json:"type"` // string (default), number, integer, boolean
+	Required bool     `json:"required"`
+	Enum     []string `json:"enum"`
+	Min      *float64 `json:"min"` // number / integer only
+	Max      *float64 `json:"max"`
+}
+
+// EventPlan declares the params an event_name may carry.
+// Keys are flattened param names as stored in params (nested keys joined by "_").
+type EventPlan struct {
+	Params map[string]ParamRule `json:"params"`
+}
+
+// TrackingPlan is the tracking-plan file (TRACKING_PLAN):
+//
+//	{
+//	  "allow_unplanned_events": true,
+//	  "events": {
+//	    "purchase": {"params": {
+//	      "order_id": {"type": "string", "required": true},
+//	      "value":    {"type": "number", "min": 0},
+//	      "currency": {"enum": ["USD", "EUR"]}
+//	    }}
+//	  }
+//	}
+type TrackingPlan struct {
+	AllowUnplannedEvents *bool                `json:"allow_unplanned_events"` // Default true
+	Events               map[string]EventPlan `json:"events"`
+}
+
+// PlanViolation is one failed check of an event against the plan.
+type PlanViolation struct {
+	Param string
+	Rule  string
+}
+
+func (v PlanViolation) String() string {
+	if v.Param == "" {
+		return v.Rule
+	}
+	return v.Rule + ":" + v.Param
+}
+
+// LoadTrackingPlan reads and validates a tracking-plan file. Files ending in
+// .yaml or .yml are YAML with the same keys; anything else is JSON.
+func LoadTrackingPlan(path string) (*TrackingPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	var plan TrackingPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for eventName, ev := range plan.Events {
+		for param, rule := range ev.Params {
+			switch rule.Type {
+			case "", "string", "number", "integer", "boolean":
+			default:
+				return nil, fmt.Errorf("event %q param %q: unknown type %q", eventName, param, rule.Type)
+			}
+			if (rule.Min != nil || rule.Max != nil) && rule.Type != "number" && rule.Type != "integer" {
+				return nil, fmt.Errorf("event %q param %q: min/max need type number or integer", eventName, param)
+			}
+		}
+	}
+	return &plan, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so it decodes through the
+// same struct tags as a JSON plan.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// Check validates event params against the plan. Events without a plan are
+// only checked when allow_unplanned_events is false.
+func (p *TrackingPlan) Check(eventName string, params map[string]string) []PlanViolation {
+	ev, ok := p.Events[eventName]
+	if !ok {
+		if p.AllowUnplannedEvents != nil && !*p.AllowUnplannedEvents {
+			return []PlanViolation{{Rule: ruleUnplannedEvent}}
+		}
+		return nil
+	}
+
+	var violations []PlanViolation
+	for param, rule := range ev.Params {
+		val, present := params[param]
+		if !present || val == "" {
+			if rule.Required {
+				violations = append(violations, PlanViolation{Param: param, Rule: ruleMissing})
+			}
+			continue
+		}
+		if r := rule.check(val); r != "" {
+			violations = append(violations, PlanViolation{Param: param, Rule: r})
+		}
+	}
+	for param := range params {
+		if param == "items" && ecommerceEvents[eventName] {
+			continue // Validated and stored by the ecommerce enricher
+		}
+		if _, declared := ev.Params[param]; !declared {
+			violations = append(violations, PlanViolation{Param: param, Rule: ruleUnknownParam})
+		}
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Param != violations[j].Param {
+			return violations[i].Param < violations[j].Param
+		}
+		return violations[i].Rule < violations[j].Rule
+	})
+	return violations
+}
+
+// check returns the failed rule for a present value, or "".
+func (r ParamRule) check(val string) string {
+	var num float64
+	switch r.Type {
+	case "number":
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return ruleType
+		}
+		num = f
+	case "integer":
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return ruleType
+		}
+		num = float64(i)
+	case "boolean":
+		if _, err := strconv.ParseBool(val); err != nil {
+			return ruleType
+		}
+	}
+
+	if len(r.Enum) > 0 {
+		found := false
+		for _, allowed := range r.Enum {
+			if val == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ruleEnum
+		}
+	}
+
+	if (r.Min != nil && num < *r.Min) || (r.Max != nil && num > *r.Max) {
+		return ruleRange
+	}
+	return ""
+}
+
+// TrackingPlanEnricher enforces the tracking plan. It is registered as
+// "tracking_plan" and is a no-op until a plan is configured. It checks the
+// params as sent, so it runs right after params: before ecommerce, redact and
+// canonical rewrite them, and before the stateful enrichers, so a rejected
+// event does not advance session or identity state.
+type TrackingPlanEnricher struct {
+	plan *TrackingPlan
+	mode string
+}
+
+// NewTrackingPlanEnricher creates the enricher for a plan (nil disables
+// enforcement) and a mode.
+func NewTrackingPlanEnricher(plan *TrackingPlan, mode string) (*TrackingPlanEnricher, error) {
+	switch mode {
+	case PlanModeAnnotate, PlanModeStrip, PlanModeReject:
+	default:
+		return nil, fmt.Errorf("unknown tracking plan mode %q", mode)
+	}
+	return &TrackingPlanEnricher{plan: plan, mode: mode}, nil
+}
+
+func (t *TrackingPlanEnricher) Name() string { return "tracking_plan" }
+
+func (t *TrackingPlanEnricher) Enrich(in *EnrichInput, e *Event) error {
+	if t.plan == nil {
+		return nil
+	}
+	violations := t.plan.Check(e.EventName, e.Params)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	eventLabel := e.EventName
+	if _, planned := t.plan.Events[eventLabel]; !planned {
+		eventLabel = "" // Keep label cardinality bounded by the plan
+	}
+	list := make([]string, len(violations))
+	for i, v := range violations {
+		param := v.Param
+		if v.Rule == ruleUnknownParam {
+			param = ""
+		}
+		metricPlanViolations.WithLabelValues(eventLabel, param, v.Rule).Inc()
+		list[i] = v.String()
+	}
+
+	if t.mode == PlanModeReject {
+		return fmt.Errorf("tracking plan violations: %s", strings.Join(list, ", "))
+	}
+
+	if t.mode == PlanModeStrip {
+		for _, v := range violations {
+			if v.Rule == ruleUnknownParam {
+				delete(e.Params, v.Param)
+				delete(e.ParamsNum, v.Param)
+			}
+		}
+	}
+	e.Tech[planViolationsKey] = Validate(strings.Join(list, ","), MaxLength(1000))
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const testPlanJSON = `{
+  "events": {
+    "purchase": {"params": {
+      "order_id": {"type": "string", "required": true},
+      "value":    {"type": "number", "min": 0, "max": 1000},
+      "qty":      {"type": "integer", "min": 1},
+      "gift":     {"type": "boolean"},
+      "currency": {"enum": ["USD", "EUR"]}
+    }}
+  }
+}`
+
+const testPlanYAML = `
+events:
+  purchase:
+    params:
+      order_id: {type: string, required: true}
+      value:    {type: number, min: 0, max: 1000}
+      qty:      {type: integer, min: 1}
+      gift:     {type: boolean}
+      currency: {enum: [USD, EUR]}
+`
+
+func writePlan(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustLoadPlan(t *testing.T, name, content string) *TrackingPlan {
+	t.Helper()
+	plan, err := LoadTrackingPlan(writePlan(t, name, content))
+	if err != nil {
+		t.Fatalf("LoadTrackingPlan(%s): %v", name, err)
+	}
+	return plan
+}
+
+func violationStrings(vs []PlanViolation) []string {
+	out := make([]string, len(vs))
+	for i, v := range vs {
+		out[i] = v.String()
+	}
+	return out
+}
+
+func TestLoadTrackingPlanFormats(t *testing.T) {
+	fromJSON := mustLoadPlan(t, "plan.json", testPlanJSON)
+	for _, name := range []string{"plan.yaml", "plan.YML"} {
+		fromYAML := mustLoadPlan(t, name, testPlanYAML)
+		rules, want := fromYAML.Events["purchase"].Params, fromJSON.Events["purchase"].Params
+		if len(rules) != len(want) {
+			t.Fatalf("%s: %d params, want %d", name, len(rules), len(want))
+		}
+		for param, r := range want {
+			got := rules[param]
+			if got.Type != r.Type || got.Required != r.Required || !slices.Equal(got.Enum, r.Enum) ||
+				(got.Min == nil) != (r.Min == nil) || (got.Max == nil) != (r.Max == nil) {
+				t.Errorf("%s: param %s = %+v, want %+v", name, param, got, r)
+			}
+		}
+	}
+
+	for name, content := range map[string]string{
+		"bad-type.json":  `{"events": {"e": {"params": {"p": {"type": "date"}}}}}`,
+		"bad-range.yaml": "events: {e: {params: {p: {type: string, min: 1}}}}",
+		"broken.yaml":    "events: [",
+		"yaml.json":      testPlanYAML, // Extension decides the format
+	} {
+		if _, err := LoadTrackingPlan(writePlan(t, name, content)); err == nil {
+			t.Errorf("LoadTrackingPlan(%s) accepted an invalid plan", name)
+		}
+	}
+}
+
+func TestTrackingPlanCheck(t *testing.T) {
+	plan := mustLoadPlan(t, "plan.json", testPlanJSON)
+	valid := map[string]string{"order_id": "A1", "value": "99.5", "qty": "2", "gift": "true", "currency": "EUR"}
+
+	tests := []struct {
+		name   string
+		event  string
+		change map[string]string // "" deletes the param
+		want   []string
+	}{
+		{"valid", "purchase", nil, nil},
+		{"missing", "purchase", map[string]string{"order_id": ""}, []string{"missing:order_id"}},
+		{"optional absent", "purchase", map[string]string{"value": "", "qty": "", "gift": "", "currency": ""}, nil},
+		{"number type", "purchase", map[string]string{"value": "lots"}, []string{"type:value"}},
+		{"integer type", "purchase", map[string]string{"qty": "1.5"}, []string{"type:qty"}},
+		{"boolean type", "purchase", map[string]string{"gift": "yes"}, []string{"type:gift"}},
+		{"enum", "purchase", map[string]string{"currency": "usd"}, []string{"enum:currency"}},
+		{"below min", "purchase", map[string]string{"value": "-1"}, []string{"range:value"}},
+		{"above max", "purchase", map[string]string{"value": "1000.01"}, []string{"range:value"}},
+		{"bounds inclusive", "purchase", map[string]string{"value": "1000", "qty": "1"}, nil},
+		{"integer range", "purchase", map[string]string{"qty": "0"}, []string{"range:qty"}},
+		{"unknown param", "purchase", map[string]string{"note": "x"}, []string{"unknown_param:note"}},
+		{"ecommerce items", "purchase", map[string]string{"items": "[]"}, nil},
+		{"sorted", "purchase", map[string]string{"order_id": "", "value": "x", "a": "1"}, []string{"unknown_param:a", "missing:order_id", "type:value"}},
+		{"unplanned allowed", "page_view", map[string]string{"note": "x"}, nil},
+	}
+	for _, tt := range tests {
+		params := make(map[string]string)
+		for k, v := range valid {
+			params[k] = v
+		}
+		for k, v := range tt.change {
+			if v == "" {
+				delete(params, k)
+			} else {
+				params[k] = v
+			}
+		}
+		if got := violationStrings(plan.Check(tt.event, params)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: violations = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	strict := false
+	plan.AllowUnplannedEvents = &strict
+	if got := violationStrings(plan.Check("page_view", nil)); !slices.Equal(got, []string{"unplanned_event"}) {
+		t.Errorf("unplanned event with allow_unplanned_events false: violations = %v", got)
+	}
+}
+
+func TestTrackingPlanEnricherModes(t *testing.T) {
+	plan := mustLoadPlan(t, "plan.json", testPlanJSON)
+	newEvent := func() *Event {
+		return &Event{
+			EventName: "purchase",
+			Params:    map[string]string{"order_id": "A1", "value": "-5", "note": "x"},
+			ParamsNum: map[string]float64{"value": -5},
+			Tech:      make(map[string]string),
+		}
+	}
+	const violations = "unknown_param:note,range:value"
+
+	annotate, err := NewTrackingPlanEnricher(plan, PlanModeAnnotate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newEvent()
+	if err := annotate.Enrich(nil, e); err != nil {
+		t.Fatalf("annotate: %v", err)
+	}
+	if got := e.Tech[planViolationsKey]; got != violations {
+		t.Errorf("annotate: violations = %q, want %q", got, violations)
+	}
+	if e.Params["note"] != "x" || e.Params["value"] != "-5" {
+		t.Errorf("annotate changed params: %v", e.Params)
+	}
+
+	strip, _ := NewTrackingPlanEnricher(plan, PlanModeStrip)
+	e = newEvent()
+	e.ParamsNum["note"] = 1
+	if err := strip.Enrich(nil, e); err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	if got := e.Tech[planViolationsKey]; got != violations {
+		t.Errorf("strip: violations = %q, want %q", got, violations)
+	}
+	if _, ok := e.Params["note"]; ok {
+		t.Error("strip kept the undeclared param")
+	}
+	if _, ok := e.ParamsNum["note"]; ok {
+		t.Error("strip kept the undeclared param in params_num")
+	}
+	if e.Params["value"] != "-5" {
+		t.Error("strip removed a declared param that is out of range")
+	}
+
+	reject, _ := NewTrackingPlanEnricher(plan, PlanModeReject)
+	e = newEvent()
+	if err := reject.Enrich(nil, e); err == nil {
+		t.Error("reject accepted an event with violations")
+	}
+	e.Params = map[string]string{"order_id": "A1"}
+	if err := reject.Enrich(nil, e); err != nil {
+		t.Errorf("reject: valid event: %v", err)
+	}
+	if _, ok := e.Tech[planViolationsKey]; ok {
+		t.Error("valid event annotated")
+	}
+
+	disabled, _ := NewTrackingPlanEnricher(nil, PlanModeReject)
+	if err := disabled.Enrich(nil, newEvent()); err != nil {
+		t.Errorf("no plan: %v", err)
+	}
+	if _, err := NewTrackingPlanEnricher(plan, "warn"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
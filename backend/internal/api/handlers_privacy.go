@@ -0,0 +1,388 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pamnard/pixel/backend/internal/meta"
+)
+
+// privacyErasureTimeout bounds a background erasure (ClickHouse deletes included).
+const privacyErasureTimeout = 30 * time.Minute
+
+// privacyRequestInput is the body of POST /api/privacy/requests.
+type privacyRequestInput struct {
+	Type      string `json:"type"` // access, erasure
+	UserID    string `json:"user_id"`
+	VisitorID string `json:"visitor_id"`
+}
+
+// privacySubject is the set of identifiers a request applies to.
+type privacySubject struct {
+	userID     string
+	visitorIDs []string // Requested visitor_id plus those resolved from the user's events
+}
+
+// handlePrivacyRequests lists requests (GET) and starts one (POST). Access
+// requests answer with the export; erasures run in the background (202) and
+// are followed with GET /api/privacy/requests/{id}.
+func (s *Server) handlePrivacyRequests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.metaStore.GetPrivacyRequests())
+	case http.MethodPost:
+		var in privacyRequestInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", err)
+			return
+		}
+		pr := meta.PrivacyRequest{
+			Type:      in.Type,
+			UserID:    in.UserID,
+			VisitorID: in.VisitorID,
+			Status:    meta.PrivacyPending,
+			Steps:     []meta.PrivacyStep{},
+		}
+		if claims, ok := r.Context().Value("user").(*Claims); ok {
+			pr.RequestedBy = claims.Username
+		}
+		if err := s.metaStore.SavePrivacyRequest(&pr); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "privacy_request_invalid", err)
+			return
+		}
+
+		if pr.Type == meta.PrivacyErasure {
+			go s.runPrivacyErasure(pr)
+			writeJSON(w, http.StatusAccepted, pr)
+			return
+		}
+		export, err := s.runPrivacyAccess(r.Context(), &pr)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "privacy_export_failed", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"request":        pr,
+			"events":         export.Events,
+			"event_items":    export.EventItems,
+			"identity_links": export.IdentityLinks,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePrivacyRequestByID returns one request with its progress.
+func (s *Server) handlePrivacyRequestByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pr, ok := s.metaStore.GetPrivacyRequest(filepath.Base(r.URL.Path))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "privacy_request_not_found", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, pr)
+}
+
+// privacyExport is the answer to an access request: the subject's rows as
+// JSON objects, per table.
+type privacyExport struct {
+	Events        []json.RawMessage
+	EventItems    []json.RawMessage
+	IdentityLinks []json.RawMessage
+}
+
+// runPrivacyAccess exports the subject's events, the items of those events
+// and the fingerprint links of its visitor_ids.
+func (s *Server) runPrivacyAccess(ctx context.Context, pr *meta.PrivacyRequest) (privacyExport, error) {
+	var export privacyExport
+	s.setPrivacyStatus(pr, meta.PrivacyRunning, "")
+
+	subject, err := s.privacyResolve(ctx, pr)
+	if err != nil {
+		s.setPrivacyStatus(pr, meta.PrivacyFailed, err.Error())
+		return export, err
+	}
+
+	where, args := subject.eventsWhere()
+	steps := []struct {
+		name, table, where string
+		args               []any
+		order              string
+		out                *[]json.RawMessage
+	}{
+		{"export", "default.events", where, args, "timestamp", &export.Events},
+		{"export_event_items", "default.event_items",
+			"event_id IN (SELECT ids['event_id'] FROM default.events WHERE " + where + ")", args,
+			"timestamp, event_id, item_index", &export.EventItems},
+		{"export_identity_links", "default.identity_links", "has(?, original_id) OR has(?, linked_id)",
+			[]any{subject.visitorIDs, subject.visitorIDs}, "timestamp", &export.IdentityLinks},
+	}
+	for _, step := range steps {
+		err := s.privacyStep(pr, step.name, func() (string, error) {
+			rows, err := s.privacyExportRows(ctx, step.table, step.where, step.args, step.order)
+			*step.out = rows
+			return fmt.Sprintf("%d rows", len(rows)), err
+		})
+		if err != nil {
+			s.setPrivacyStatus(pr, meta.PrivacyFailed, err.Error())
+			return export, err
+		}
+	}
+	s.setPrivacyStatus(pr, meta.PrivacyCompleted, "")
+	return export, nil
+}
+
+// privacyExportRows reads the matching rows of a table as JSON objects.
+func (s *Server) privacyExportRows(ctx context.Context, table, where string, args []any, order string) ([]json.RawMessage, error) {
+	out := []json.RawMessage{}
+	rows, err := s.ch.Query(ctx, "SELECT formatRowNoNewline('JSONEachRow', *) FROM "+table+" WHERE "+where+" ORDER BY "+order, args...)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return out, err
+		}
+		out = append(out, json.RawMessage(row))
+	}
+	return out, rows.Err()
+}
+
+// runPrivacyErasure deletes the subject's state in the processor and its
+// rows in ClickHouse. Every step runs even if an earlier one failed (except
+// resolving the subject), so a failed request has done as much as it could;
+// a new request retries the rest.
+func (s *Server) runPrivacyErasure(pr meta.PrivacyRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), privacyErasureTimeout)
+	defer cancel()
+	s.setPrivacyStatus(&pr, meta.PrivacyRunning, "")
+
+	subject, err := s.privacyResolve(ctx, &pr)
+	if err != nil {
+		s.setPrivacyStatus(&pr, meta.PrivacyFailed, err.Error())
+		return
+	}
+
+	var failed []string
+	run := func(name string, fn func() (string, error)) {
+		if err := s.privacyStep(&pr, name, fn); err != nil {
+			failed = append(failed, name)
+		}
+	}
+
+	// 1. Processor state and spool first, so new events are not linked to the
+	// subject again and spooled ones do not reach ClickHouse after step 2
+	run("processor", func() (string, error) {
+		var userIDs []string
+		if subject.userID != "" {
+			userIDs = []string{subject.userID}
+		}
+		res, err := s.processor.Erase(ctx, subject.visitorIDs, userIDs)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d fingerprint keys, %d sessions, %d identity nodes, %d spooled events",
+			res.FingerprintKeys, res.Sessions, res.IdentityNodes, res.SpoolEvents), nil
+	})
+
+	// 2. ClickHouse (lightweight deletes); items are found through their events
+	run("event_items", func() (string, error) {
+		where, args := subject.eventsWhere()
+		return s.privacyDelete(ctx, "default.event_items",
+			"event_id IN (SELECT ids['event_id'] FROM default.events WHERE "+where+")", args)
+	})
+	run("events", func() (string, error) {
+		where, args := subject.eventsWhere()
+		return s.privacyDelete(ctx, "default.events", where, args)
+	})
+	run("events_legacy", func() (string, error) {
+		// Old events layout while `migrate events-layout` copies it; rows left
+		// there would be copied back into default.events
+		var exists uint8
+		if err := s.ch.QueryRow(ctx, "EXISTS TABLE default.events_legacy").Scan(&exists); err != nil || exists == 0 {
+			return "no table", err
+		}
+		where, args := subject.eventsWhere()
+		return s.privacyDelete(ctx, "default.events_legacy", where, args)
+	})
+	run("identity_links", func() (string, error) {
+		return s.privacyDelete(ctx, "default.identity_links", "has(?, original_id) OR has(?, linked_id)",
+			[]any{subject.visitorIDs, subject.visitorIDs})
+	})
+	run("events_dlq", func() (string, error) {
+		where, args := subject.dlqWhere()
+		detail, err := s.privacyDelete(ctx, "default.events_dlq", where, args)
+		if err != nil {
+			return detail, err
+		}
+		// Payloads that are not JSON cannot be matched by field; the ones
+		// holding one of the subject's identifiers are left to the operator
+		where, args = subject.dlqUnparsedWhere()
+		var n uint64
+		if err := s.ch.QueryRow(ctx, "SELECT count() FROM default.events_dlq WHERE "+where, args...).Scan(&n); err != nil {
+			return detail, err
+		}
+		if n > 0 {
+			return detail, fmt.Errorf("%s deleted; %d payloads that are not JSON mention the subject and were not erased", detail, n)
+		}
+		return detail, nil
+	})
+
+	if len(failed) > 0 {
+		s.setPrivacyStatus(&pr, meta.PrivacyFailed, fmt.Sprintf("steps failed: %v", failed))
+		return
+	}
+	s.setPrivacyStatus(&pr, meta.PrivacyCompleted, "")
+}
+
+// privacyResolve collects the subject's visitor_ids: the requested one plus
+// every visitor_id (and pre-fingerprint-link original_visitor_id) seen with
+// the requested user_id.
+func (s *Server) privacyResolve(ctx context.Context, pr *meta.PrivacyRequest) (privacySubject, error) {
+	subject := privacySubject{userID: pr.UserID}
+	err := s.privacyStep(pr, "resolve", func() (string, error) {
+		seen := make(map[string]struct{})
+		if pr.VisitorID != "" {
+			seen[pr.VisitorID] = struct{}{}
+		}
+		if pr.UserID != "" {
+			rows, err := s.ch.Query(ctx, `SELECT DISTINCT v FROM default.events
+				ARRAY JOIN [ids['visitor_id'], ids['original_visitor_id']] AS v
+				WHERE ids['user_id'] = ? AND v != ''`, pr.UserID)
+			if err != nil {
+				return "", err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var v string
+				if err := rows.Scan(&v); err != nil {
+					return "", err
+				}
+				seen[v] = struct{}{}
+			}
+			if err := rows.Err(); err != nil {
+				return "", err
+			}
+		}
+		for v := range seen {
+			subject.visitorIDs = append(subject.visitorIDs, v)
+		}
+		sort.Strings(subject.visitorIDs)
+		pr.VisitorIDs = subject.visitorIDs
+		return fmt.Sprintf("%d visitor_ids", len(subject.visitorIDs)), nil
+	})
+	return subject, err
+}
+
+// eventsWhere selects the subject's events. For a user_id, events of its
+// visitor_ids that carry another user_id (shared devices) are left alone.
+func (sub privacySubject) eventsWhere() (string, []any) {
+	visitors := "has(?, ids['visitor_id']) OR has(?, ids['original_visitor_id'])"
+	if sub.userID == "" {
+		return visitors, []any{sub.visitorIDs, sub.visitorIDs}
+	}
+	return "ids['user_id'] = ? OR (ids['user_id'] = '' AND (" + visitors + "))",
+		[]any{sub.userID, sub.visitorIDs, sub.visitorIDs}
+}
+
+// dlqWhere selects the subject's dead letters by the identifiers of the raw
+// event in the payload, as eventsWhere selects events. A payload is a single
+// event or, for a dead-lettered line, an array of them; it matches if any of
+// its events does.
+func (sub privacySubject) dlqWhere() (string, []any) {
+	where, args := sub.dlqEventWhere("payload")
+	elem, elemArgs := sub.dlqEventWhere("e")
+	return "(" + where + ") OR arrayExists(e -> " + elem + ", JSONExtractArrayRaw(payload))",
+		append(args, elemArgs...)
+}
+
+// dlqEventWhere selects a raw event (the JSON in column or lambda argument
+// col) by its visitor_id/device_id and user_id/uid.
+func (sub privacySubject) dlqEventWhere(col string) (string, []any) {
+	visitor := "if(JSONExtractString(" + col + ", 'visitor_id') != '', JSONExtractString(" + col + ", 'visitor_id'), JSONExtractString(" + col + ", 'device_id'))"
+	user := "if(JSONExtractString(" + col + ", 'user_id') != '', JSONExtractString(" + col + ", 'user_id'), JSONExtractString(" + col + ", 'uid'))"
+	visitors := "has(?, " + visitor + ")"
+	if sub.userID == "" {
+		return visitors, []any{sub.visitorIDs}
+	}
+	return user + " = ? OR (" + user + " = '' AND " + visitors + ")",
+		[]any{sub.userID, sub.visitorIDs}
+}
+
+// dlqUnparsedWhere selects dead letters whose payload is not a JSON object or
+// array (such as undecodable lines) but contains one of the subject's
+// identifiers.
+func (sub privacySubject) dlqUnparsedWhere() (string, []any) {
+	ids := append([]string(nil), sub.visitorIDs...)
+	if sub.userID != "" {
+		ids = append(ids, sub.userID)
+	}
+	return "NOT (isValidJSON(payload) AND JSONType(payload) IN ('Object', 'Array')) AND arrayExists(id -> position(payload, id) > 0, ?)",
+		[]any{ids}
+}
+
+// privacyDelete counts and deletes the matching rows of a table.
+func (s *Server) privacyDelete(ctx context.Context, table, where string, args []any) (string, error) {
+	var n uint64
+	if err := s.ch.QueryRow(ctx, "SELECT count() FROM "+table+" WHERE "+where, args...).Scan(&n); err != nil {
+		return "", err
+	}
+	if n > 0 {
+		if err := s.ch.Exec(ctx, "DELETE FROM "+table+" WHERE "+where, args...); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d rows", n), nil
+}
+
+// privacyStep runs one step of a request and records its progress.
+func (s *Server) privacyStep(pr *meta.PrivacyRequest, name string, fn func() (string, error)) error {
+	pr.Steps = append(pr.Steps, meta.PrivacyStep{Name: name, Status: meta.PrivacyRunning, At: time.Now().UTC()})
+	s.savePrivacyRequest(pr)
+
+	detail, err := fn()
+	step := &pr.Steps[len(pr.Steps)-1]
+	step.At = time.Now().UTC()
+	step.Status = meta.PrivacyCompleted
+	step.Detail = detail
+	if err != nil {
+		step.Status = meta.PrivacyFailed
+		step.Detail = err.Error()
+		log.Printf("privacy request %s: %s failed: %v", pr.ID, name, err)
+	}
+	s.savePrivacyRequest(pr)
+	return err
+}
+
+func (s *Server) setPrivacyStatus(pr *meta.PrivacyRequest, status, errMsg string) {
+	pr.Status = status
+	pr.Error = errMsg
+	s.savePrivacyRequest(pr)
+}
+
+func (s *Server) savePrivacyRequest(pr *meta.PrivacyRequest) {
+	if err := s.metaStore.SavePrivacyRequest(pr); err != nil {
+		log.Printf("privacy request %s: save failed: %v", pr.ID, err)
+	}
+}
+
+// failInterruptedPrivacyRequests marks requests left unfinished by a restart
+// as failed; they have to be submitted again.
+func (s *Server) failInterruptedPrivacyRequests() {
+	for _, pr := range s.metaStore.GetPrivacyRequests() {
+		if pr.Status == meta.PrivacyPending || pr.Status == meta.PrivacyRunning {
+			s.setPrivacyStatus(&pr, meta.PrivacyFailed, "interrupted by a backend restart")
+		}
+	}
+}
@@ -14,19 +14,21 @@ import (
 // virtualSchema defines known keys for Map columns to expose them as fields in UI.
 var virtualSchema = map[string][]string{
 	"ids": {
-		"user_id", "visitor_id", "session_id",
+		"user_id", "visitor_id", "original_visitor_id", "person_id", "session_id", "event_id",
+		"session_seq", "is_session_start", "event_index_in_session",
 	},
 	"page": {
-		"url", "host", "path", "query",
+		"url", "host", "path", "query", "url_canonical", "host_canonical", "path_canonical",
 	},
 	"device": {
 		"user_agent","platform", "screen_width", "screen_height", "viewport_width", "viewport_height",
 		"color_depth", "pixel_ratio", "orientation", "timezone", "gpu_renderer", "language",
 		"model", "os_name", "os_version", "browser_name", "browser_version", "device_type",
 		"architecture", "platform_version", "is_webview", "webview",
+		"is_bot", "bot_score", "bot_reasons",
 	},
 	"geo": {
-		"ip_hash", "country", "region", "city", "postal_code", "latitude", "longitude", "continent", "metro_code", "timezone",
+		"ip_hash", "country", "region", "city", "postal_code", "latitude", "longitude", "continent", "metro_code", "timezone", "asn",
 	},
 	"tech": {
 		"ad_block", "pdf_viewer",
@@ -37,8 +39,28 @@ var virtualSchema = map[string][]string{
 	},
 	"traffic": {
 		"referrer", "referrer_host", "referrer_path", "referrer_query",
-		"source", "channel", "campaign", "term", "content",
+		"source", "channel", "campaign", "term", "content", "channel_group", "traffic_type",
 	},
+	"consent": {
+		"analytics", "fingerprinting", "geo", "source",
+	},
+	// Typed copies (Map(String, Float64)); params_num has dynamic keys like params
+	"tech_num": {
+		"ad_block", "pdf_viewer", "ttfb", "domLoad", "fullLoad", "downlink", "rtt", "saveData",
+	},
+}
+
+// mapValueType returns the value type of a ClickHouse Map column type
+// ("Map(String, Float64)" → "Float64").
+func mapValueType(colType string) string {
+	inner, ok := strings.CutPrefix(colType, "Map(")
+	if !ok {
+		return "String"
+	}
+	if _, value, ok := strings.Cut(strings.TrimSuffix(inner, ")"), ","); ok {
+		return strings.TrimSpace(value)
+	}
+	return "String"
 }
 
 // handleSchema returns available tables and columns from ClickHouse.
@@ -81,7 +103,7 @@ func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
 			for _, field := range vFields {
 				tableMap[tableName] = append(tableMap[tableName], Column{
 					Name: colName + "." + field,
-					Type: "String", // In Map(String, String) values are strings
+					Type: mapValueType(colType),
 				})
 			}
 		}
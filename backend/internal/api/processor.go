@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProcessorAdmin calls the processor's admin API (/admin/*), authenticated
+// with PROCESSOR_ADMIN_TOKEN.
+type ProcessorAdmin struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewProcessorAdmin creates a client for the processor at baseURL
+// (e.g. http://processor:8080). Calls fail when token is empty.
+func NewProcessorAdmin(baseURL, token string) *ProcessorAdmin {
+	return &ProcessorAdmin{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// EraseResult is what the processor deleted for an erasure.
+type EraseResult struct {
+	FingerprintKeys int `json:"fingerprint_keys"`
+	Sessions        int `json:"sessions"`
+	IdentityNodes   int `json:"identity_nodes"`
+	SpoolEvents     int `json:"spool_events"` // Events purged before they reached ClickHouse
+}
+
+// Erase purges the fingerprint, session and identity-graph state of the
+// given visitor_ids and user_ids, and their events still in the spool.
+func (p *ProcessorAdmin) Erase(ctx context.Context, visitorIDs, userIDs []string) (EraseResult, error) {
+	var res EraseResult
+	err := p.post(ctx, "/admin/erase", map[string][]string{
+		"visitor_ids": visitorIDs,
+		"user_ids":    userIDs,
+	}, &res)
+	return res, err
+}
+
+func (p *ProcessorAdmin) post(ctx context.Context, path string, body, out any) error {
+	if p.token == "" {
+		return fmt.Errorf("PROCESSOR_ADMIN_TOKEN is not set")
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("processor %s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -14,15 +14,18 @@ import (
 type Server struct {
 	ch        clickhouse.Conn
 	metaStore *meta.Store
+	processor *ProcessorAdmin
 }
 
 // NewServer wires dependencies for HTTP handlers.
-func NewServer(ch clickhouse.Conn, metaStore *meta.Store) *Server {
+func NewServer(ch clickhouse.Conn, metaStore *meta.Store, processor *ProcessorAdmin) *Server {
 	s := &Server{
 		ch:        ch,
 		metaStore: metaStore,
+		processor: processor,
 	}
 	s.EnsureAdminUser()
+	s.failInterruptedPrivacyRequests()
 	return s
 }
 
@@ -56,6 +59,8 @@ func NewMux(s *Server) *http.ServeMux {
 		}
 	}))))
 	mux.Handle("/api/schema/views/", s.AuthMiddleware(s.RequireAdmin(http.HandlerFunc(s.handleViewByID))))
+	mux.Handle("/api/privacy/requests", s.AuthMiddleware(s.RequireAdmin(http.HandlerFunc(s.handlePrivacyRequests))))
+	mux.Handle("/api/privacy/requests/", s.AuthMiddleware(s.RequireAdmin(http.HandlerFunc(s.handlePrivacyRequestByID))))
 
 	return mux
 }
@@ -0,0 +1,125 @@
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Privacy request types and statuses.
+const (
+	PrivacyAccess  = "access"
+	PrivacyErasure = "erasure"
+
+	PrivacyPending   = "pending"
+	PrivacyRunning   = "running"
+	PrivacyCompleted = "completed"
+	PrivacyFailed    = "failed"
+)
+
+// PrivacyRequest is the audit record of a data-subject request (GDPR/CCPA
+// access or erasure). Records are kept after the data is gone.
+type PrivacyRequest struct {
+	ID          string        `json:"id"`
+	Type        string        `json:"type"` // access, erasure
+	UserID      string        `json:"user_id,omitempty"`
+	VisitorID   string        `json:"visitor_id,omitempty"`
+	Status      string        `json:"status"` // pending, running, completed, failed
+	RequestedBy string        `json:"requested_by"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	VisitorIDs  []string      `json:"visitor_ids,omitempty"` // All visitor_ids resolved for the subject
+	Steps       []PrivacyStep `json:"steps"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// PrivacyStep is the progress of one step of a request (e.g. "events").
+type PrivacyStep struct {
+	Name   string    `json:"name"`
+	Status string    `json:"status"` // running, completed, failed
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+func loadPrivacyRequests(db *bolt.DB) map[string]PrivacyRequest {
+	out := make(map[string]PrivacyRequest)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(privacyBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var pr PrivacyRequest
+			if err := json.Unmarshal(v, &pr); err != nil {
+				return err
+			}
+			out[pr.ID] = pr
+			return nil
+		})
+	})
+	if err != nil {
+		panic(fmt.Sprintf("bolt load privacy requests failed: %v", err))
+	}
+	return out
+}
+
+// GetPrivacyRequests returns all privacy requests, newest first.
+func (s *Store) GetPrivacyRequests() []PrivacyRequest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]PrivacyRequest, 0, len(s.PrivacyRequests))
+	for _, pr := range s.PrivacyRequests {
+		list = append(list, pr)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// GetPrivacyRequest returns a privacy request by ID.
+func (s *Store) GetPrivacyRequest(id string) (PrivacyRequest, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pr, ok := s.PrivacyRequests[id]
+	return pr, ok
+}
+
+// SavePrivacyRequest upserts a privacy request. If ID is empty, it generates
+// a new sequence ID. UpdatedAt is set to now.
+func (s *Store) SavePrivacyRequest(pr *PrivacyRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pr.Type != PrivacyAccess && pr.Type != PrivacyErasure {
+		return fmt.Errorf("privacy request type must be %q or %q", PrivacyAccess, PrivacyErasure)
+	}
+	if pr.UserID == "" && pr.VisitorID == "" {
+		return fmt.Errorf("user_id or visitor_id required")
+	}
+
+	pr.UpdatedAt = time.Now().UTC()
+	if pr.CreatedAt.IsZero() {
+		pr.CreatedAt = pr.UpdatedAt
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(privacyBucket))
+		if pr.ID == "" {
+			seq, _ := b.NextSequence()
+			pr.ID = strconv.FormatUint(seq, 10)
+		}
+		payload, err := json.Marshal(pr)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(pr.ID), payload)
+	})
+	if err != nil {
+		return err
+	}
+	// The caller keeps updating its copy: do not share slices with it
+	stored := *pr
+	stored.VisitorIDs = append([]string(nil), pr.VisitorIDs...)
+	stored.Steps = append([]PrivacyStep(nil), pr.Steps...)
+	s.PrivacyRequests[pr.ID] = stored
+	return nil
+}
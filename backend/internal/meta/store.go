@@ -51,15 +51,16 @@ type PixelSettings struct {
 }
 
 // Store keeps report/widget metadata in a Bolt DB.
-// Data is stored in buckets: widgets, reports, settings, users, views.
+// Data is stored in buckets: widgets, reports, settings, users, views, privacy_requests.
 type Store struct {
-	mu       sync.RWMutex
-	db       *bolt.DB
-	Widgets  map[string]Widget
-	Reports  map[string]Report
-	Settings PixelSettings
-	Users    map[string]User
-	Views    map[string]ViewMeta // ID -> Name mapping
+	mu              sync.RWMutex
+	db              *bolt.DB
+	Widgets         map[string]Widget
+	Reports         map[string]Report
+	Settings        PixelSettings
+	Users           map[string]User
+	Views           map[string]ViewMeta // ID -> Name mapping
+	PrivacyRequests map[string]PrivacyRequest
 }
 
 const (
@@ -68,6 +69,7 @@ const (
 	settingsBucket = "settings"
 	usersBucket    = "users"
 	viewsBucket    = "views"
+	privacyBucket  = "privacy_requests"
 	settingsKey    = "pixel"
 )
 
@@ -83,6 +85,8 @@ func NewStore(dbPath string) *Store {
 		Settings: loadSettings(db),
 		Users:    loadUsers(db),
 		Views:    loadViews(db),
+
+		PrivacyRequests: loadPrivacyRequests(db),
 	}
 }
 
@@ -101,7 +105,7 @@ func mustOpenBolt(path string) *bolt.DB {
 
 func ensureBuckets(db *bolt.DB) {
 	err := db.Update(func(tx *bolt.Tx) error {
-		buckets := []string{widgetsBucket, reportsBucket, settingsBucket, usersBucket, viewsBucket}
+		buckets := []string{widgetsBucket, reportsBucket, settingsBucket, usersBucket, viewsBucket, privacyBucket}
 		for _, bucket := range buckets {
 			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
 				return err
@@ -0,0 +1,139 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Run applies every pending bundled migration. Called by both binaries at
+// startup (unless MIGRATE_ON_START=false).
+func Run(ctx context.Context, ch clickhouse.Conn) error {
+	migrations, err := Bundled()
+	if err != nil {
+		return err
+	}
+	m := New(ch, migrations, Options{})
+	if _, err := m.Up(ctx, 0); err != nil {
+		return err
+	}
+	return m.swapEmptyEvents(ctx)
+}
+
+// Command implements the `migrate` subcommand of both binaries:
+//
+//	migrate [-dry-run] [-lock-timeout 5m] up [VERSION]
+//	migrate [-dry-run] [-lock-timeout 5m] down [-allow-data-loss] [STEPS]   (default 1)
+//	migrate status
+//	migrate [-dry-run] [-lock-timeout 5m] events-layout [-settle 1m] [-drop-legacy]
+func Command(ch clickhouse.Conn, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the statements that would run without changing anything")
+	lockTimeout := fs.Duration("lock-timeout", DefaultLockTimeout, "how long to wait for another instance holding the migration lock")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: migrate [flags] up [VERSION] | down [-allow-data-loss] [STEPS] | status | events-layout [-settle D] [-drop-legacy]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	migrations, err := Bundled()
+	if err != nil {
+		return err
+	}
+	m := New(ch, migrations, Options{DryRun: *dryRun, LockTimeout: *lockTimeout})
+	ctx := context.Background()
+
+	action, arg := fs.Arg(0), fs.Arg(1)
+	switch action {
+	case "up":
+		var target uint64
+		if arg != "" {
+			if _, err := fmt.Sscan(arg, &target); err != nil {
+				return fmt.Errorf("invalid version %q", arg)
+			}
+		}
+		done, err := m.Up(ctx, uint32(target))
+		report(os.Stdout, "applied", done, *dryRun)
+		return err
+	case "down":
+		dfs := flag.NewFlagSet("migrate down", flag.ExitOnError)
+		allowDataLoss := dfs.Bool("allow-data-loss", false, "allow reverting the initial migration, which drops every table with its data")
+		dfs.Parse(fs.Args()[1:])
+		steps := 1
+		if arg := dfs.Arg(0); arg != "" {
+			if _, err := fmt.Sscan(arg, &steps); err != nil || steps <= 0 {
+				return fmt.Errorf("invalid steps %q", arg)
+			}
+		}
+		m.opts.AllowDataLoss = *allowDataLoss
+		done, err := m.Down(ctx, steps)
+		report(os.Stdout, "reverted", done, *dryRun)
+		return err
+	case "events-layout":
+		lfs := flag.NewFlagSet("migrate events-layout", flag.ExitOnError)
+		settle := lfs.Duration("settle", DefaultLayoutSettle, "wait after the swap for inserts still writing to the old table")
+		dropLegacy := lfs.Bool("drop-legacy", false, "drop default.events_legacy once every partition is copied and verified")
+		lfs.Parse(fs.Args()[1:])
+		res, err := m.EventsLayout(ctx, LayoutOptions{Settle: *settle, DropLegacy: *dropLegacy})
+		switch {
+		case res.Swapped && *dryRun:
+			fmt.Println("default.events would be swapped to the new layout")
+		case res.Swapped:
+			fmt.Println("default.events swapped to the new layout")
+		}
+		if len(res.Copied) == 0 {
+			fmt.Println("No partitions to copy")
+		} else if *dryRun {
+			fmt.Printf("Partitions to copy: %v\n", res.Copied)
+		} else {
+			fmt.Printf("Partitions copied: %v\n", res.Copied)
+		}
+		if len(res.Mismatched) > 0 {
+			fmt.Printf("Partitions changed after they were copied (legacy table kept): %v\n", res.Mismatched)
+		}
+		if res.Dropped {
+			fmt.Println("default.events_legacy dropped")
+		}
+		return err
+	case "status", "":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tUPDATED")
+		for _, st := range statuses {
+			state, updated := "pending", ""
+			if st.Applied {
+				state = "applied"
+			} else if !st.UpdatedAt.IsZero() {
+				state = "reverted"
+			}
+			if !st.UpdatedAt.IsZero() {
+				updated = st.UpdatedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", st.Version, st.Name, state, updated)
+		}
+		return w.Flush()
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate action %q", action)
+	}
+}
+
+func report(w io.Writer, verb string, versions []uint32, dryRun bool) {
+	if dryRun {
+		verb = "would be " + verb
+	}
+	if len(versions) == 0 {
+		fmt.Fprintf(w, "No migrations %s\n", verb)
+		return
+	}
+	fmt.Fprintf(w, "Migrations %s: %v\n", verb, versions)
+}
@@ -0,0 +1,386 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Tables of the events layout change (migration 0002).
+const (
+	eventsTable       = "default.events"
+	eventsNextTable   = "default.events_v2"           // New layout until swapped in
+	eventsLegacyTable = "default.events_legacy"       // Old layout after the swap
+	eventsStageTable  = "default.events_layout_stage" // One partition being copied
+	layoutCopyTable   = "default.events_layout_copy"  // Copied partitions
+)
+
+// eventsColumns are the columns both layouts share (and the processor inserts).
+const eventsColumns = "timestamp, event_name, ids, page, device, geo, traffic, tech, params, consent, params_num, tech_num"
+
+// eventsDedupSetting keeps the insert_deduplication_token of the latest
+// inserts, as migrations 0001, 0002 and 0004 set it.
+const eventsDedupSetting = "non_replicated_deduplication_window = 1000"
+
+// layoutMarkerColumn exists only in the new layout.
+const layoutMarkerColumn = "visitor_id"
+
+// LayoutOptions configure EventsLayout.
+type LayoutOptions struct {
+	Settle     time.Duration // Wait after the swap for inserts still writing to the old table
+	DropLegacy bool          // Drop default.events_legacy once every partition is copied and verified
+}
+
+// DefaultLayoutSettle is the default LayoutOptions.Settle.
+const DefaultLayoutSettle = time.Minute
+
+// LayoutResult summarizes an EventsLayout run.
+type LayoutResult struct {
+	Swapped    bool     // default.events was swapped to the new layout by this run
+	Copied     []uint32 // Partitions copied by this run (in dry-run mode: to copy)
+	Mismatched []uint32 // Legacy partitions whose row count changed after they were copied
+	Dropped    bool     // default.events_legacy was dropped
+}
+
+// EventsLayout moves default.events to the layout of migration 0002 while
+// ingestion continues:
+//
+//  1. EXCHANGE TABLES swaps the empty new layout in; inserts from then on go
+//     to it, and the old table is renamed to default.events_legacy.
+//  2. After Settle (inserts that started before the swap finish), each month
+//     of the legacy table is copied into a staging table with the new layout,
+//     recorded in default.events_layout_copy and moved to default.events
+//     (MOVE PARTITION TO TABLE, which takes the parts out of the staging
+//     table). A month recorded but still staged was interrupted before the
+//     move and is moved on resume; other unrecorded months are copied again
+//     from scratch, so no month is attached twice.
+//  3. Row counts of the legacy months are compared with the copies; with
+//     DropLegacy and no mismatch, the legacy table is dropped.
+//
+// Queries over the copied history are incomplete until step 2 ends.
+func (m *Migrator) EventsLayout(ctx context.Context, opts LayoutOptions) (LayoutResult, error) {
+	var res LayoutResult
+	err := m.withLock(ctx, func() error {
+		if err := m.requireMigrated(ctx); err != nil {
+			return err
+		}
+		swapped, err := m.swapEvents(ctx)
+		if err != nil {
+			return err
+		}
+		res.Swapped = swapped
+
+		// A dry run does not swap: the rows to copy are still in default.events
+		source := eventsLegacyTable
+		if swapped && m.opts.DryRun {
+			source = eventsTable
+		}
+		if exists, err := m.tableExists(ctx, source); err != nil || !exists {
+			return err // Nothing to copy: new install, or already finished
+		}
+		if swapped && opts.Settle > 0 && !m.opts.DryRun {
+			m.opts.Logf("Events layout: waiting %s for in-flight inserts into the old table", opts.Settle)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(opts.Settle):
+			}
+		}
+
+		if res.Copied, err = m.copyLegacyPartitions(ctx, source); err != nil {
+			return err
+		}
+		if m.opts.DryRun {
+			return nil
+		}
+		if res.Mismatched, err = m.verifyLegacyCopy(ctx); err != nil {
+			return err
+		}
+		if opts.DropLegacy {
+			if len(res.Mismatched) > 0 {
+				return fmt.Errorf("not dropping %s: partitions %v changed after they were copied", eventsLegacyTable, res.Mismatched)
+			}
+			for _, table := range []string{eventsLegacyTable, eventsStageTable} {
+				if err := m.ch.Exec(ctx, "DROP TABLE IF EXISTS "+table); err != nil {
+					return err
+				}
+			}
+			res.Dropped = true
+			m.opts.Logf("Events layout: dropped %s", eventsLegacyTable)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// swapEmptyEvents swaps the new layout in at startup when default.events is
+// still empty (new installs), so no copy is needed.
+func (m *Migrator) swapEmptyEvents(ctx context.Context) error {
+	return m.withLock(ctx, func() error {
+		oldLayout, err := m.isOldLayout(ctx)
+		if err != nil || !oldLayout {
+			return err
+		}
+		var rows uint64
+		if err := m.ch.QueryRow(ctx, "SELECT count() FROM "+eventsTable).Scan(&rows); err != nil {
+			return err
+		}
+		if rows > 0 {
+			m.opts.Logf("Events layout: %s uses the old layout; run `migrate events-layout` to move its %d rows", eventsTable, rows)
+			return nil
+		}
+		if _, err := m.swapEvents(ctx); err != nil {
+			return err
+		}
+		return m.ch.Exec(ctx, "DROP TABLE IF EXISTS "+eventsLegacyTable)
+	})
+}
+
+// requireMigrated checks that every known migration has run: the copy needs
+// the tables of 0002 and the columns 0003 adds to the old layout.
+func (m *Migrator) requireMigrated(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, mig := range m.migrations {
+		if !applied[mig.Version].Applied {
+			return fmt.Errorf("migration %d (%s) is pending: apply it first (migrate up)", mig.Version, mig.Name)
+		}
+	}
+	return nil
+}
+
+// isOldLayout reports whether default.events still has the old layout and
+// the new one is waiting in default.events_v2.
+func (m *Migrator) isOldLayout(ctx context.Context) (bool, error) {
+	eventsNew, err := m.hasColumn(ctx, eventsTable, layoutMarkerColumn)
+	if err != nil || eventsNew {
+		return false, err
+	}
+	return m.hasColumn(ctx, eventsNextTable, layoutMarkerColumn)
+}
+
+// swapEvents exchanges default.events and default.events_v2 and renames the
+// old layout to default.events_legacy. It picks up a swap interrupted before
+// the rename. Returns whether this call exchanged the tables.
+func (m *Migrator) swapEvents(ctx context.Context) (bool, error) {
+	oldLayout, err := m.isOldLayout(ctx)
+	if err != nil {
+		return false, err
+	}
+	if oldLayout {
+		if m.opts.DryRun {
+			m.opts.Logf("Events layout [dry run]: would exchange %s and %s", eventsTable, eventsNextTable)
+			return true, nil
+		}
+		// events_v2 may predate the setting in 0002
+		if err := m.ch.Exec(ctx, "ALTER TABLE "+eventsNextTable+" MODIFY SETTING "+eventsDedupSetting); err != nil {
+			return false, fmt.Errorf("prepare %s: %w", eventsNextTable, err)
+		}
+		if err := m.ch.Exec(ctx, "EXCHANGE TABLES "+eventsTable+" AND "+eventsNextTable); err != nil {
+			return false, fmt.Errorf("swap %s: %w", eventsTable, err)
+		}
+		m.opts.Logf("Events layout: %s now uses the new layout", eventsTable)
+	}
+
+	// After the exchange (now or in an interrupted run) events_v2 holds the old layout
+	exists, err := m.tableExists(ctx, eventsNextTable)
+	if err != nil || !exists {
+		return oldLayout, err
+	}
+	if nextNew, err := m.hasColumn(ctx, eventsNextTable, layoutMarkerColumn); err != nil || nextNew {
+		return oldLayout, err
+	}
+	if m.opts.DryRun {
+		return oldLayout, nil
+	}
+	if err := m.ch.Exec(ctx, "RENAME TABLE "+eventsNextTable+" TO "+eventsLegacyTable); err != nil {
+		return oldLayout, fmt.Errorf("rename old events table: %w", err)
+	}
+	return oldLayout, nil
+}
+
+// copyLegacyPartitions copies the months of source (the legacy table) not
+// yet recorded in events_layout_copy, oldest first.
+func (m *Migrator) copyLegacyPartitions(ctx context.Context, source string) ([]uint32, error) {
+	counts, err := m.countPartitions(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	copied, err := m.copiedPartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []uint32
+	if !m.opts.DryRun {
+		if err := m.ch.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+eventsStageTable+" AS "+eventsTable); err != nil {
+			return nil, fmt.Errorf("create staging table: %w", err)
+		}
+		if err := m.moveStaged(ctx, copied); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range counts {
+		if _, ok := copied[p.partition]; ok {
+			continue
+		}
+		if m.opts.DryRun {
+			m.opts.Logf("Events layout [dry run]: would copy partition %d (%d rows)", p.partition, p.rows)
+			done = append(done, p.partition)
+			continue
+		}
+		if err := m.copyPartition(ctx, p.partition, p.rows); err != nil {
+			return done, err
+		}
+		done = append(done, p.partition)
+	}
+	return done, nil
+}
+
+// moveStaged finishes a month an interrupted run recorded but did not move:
+// its rows are still in the staging table. Staged months that were not
+// recorded are left to copyPartition, which starts over.
+func (m *Migrator) moveStaged(ctx context.Context, copied map[uint32]uint64) error {
+	staged, err := m.countPartitions(ctx, eventsStageTable)
+	if err != nil {
+		return err
+	}
+	for _, p := range staged {
+		if _, ok := copied[p.partition]; !ok {
+			continue
+		}
+		if err := m.movePartition(ctx, p.partition); err != nil {
+			return err
+		}
+		m.opts.Logf("Events layout: moved partition %d (%d rows) staged by an interrupted run", p.partition, p.rows)
+	}
+	return nil
+}
+
+// copyPartition copies one month through the staging table, so a failed copy
+// leaves default.events untouched. The month is recorded before it is moved:
+// once recorded, its rows are either still staged (see moveStaged) or in
+// default.events, never in both.
+func (m *Migrator) copyPartition(ctx context.Context, partition uint32, want uint64) error {
+	start := time.Now()
+	if err := m.ch.Exec(ctx, "TRUNCATE TABLE "+eventsStageTable); err != nil {
+		return err
+	}
+	// The staging table inherits the deduplication window: a month copied
+	// again after a failed attempt must not be dropped as a repeat
+	copyCtx := clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{"insert_deduplicate": 0}))
+	if err := m.ch.Exec(copyCtx, "INSERT INTO "+eventsStageTable+" ("+eventsColumns+") SELECT "+eventsColumns+
+		" FROM "+eventsLegacyTable+" WHERE toYYYYMM(timestamp) = ?", partition); err != nil {
+		return fmt.Errorf("copy partition %d: %w", partition, err)
+	}
+	var got uint64
+	if err := m.ch.QueryRow(ctx, "SELECT count() FROM "+eventsStageTable).Scan(&got); err != nil {
+		return err
+	}
+	if got < want {
+		return fmt.Errorf("copy partition %d: staged %d of %d rows", partition, got, want)
+	}
+	if err := m.ch.Exec(ctx, "INSERT INTO "+layoutCopyTable+" (partition, rows) VALUES (?, ?)", partition, got); err != nil {
+		return fmt.Errorf("record partition %d: %w", partition, err)
+	}
+	if err := m.movePartition(ctx, partition); err != nil {
+		return err
+	}
+	m.opts.Logf("Events layout: copied partition %d (%d rows) in %s", partition, got, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// movePartition moves a staged month to default.events.
+func (m *Migrator) movePartition(ctx context.Context, partition uint32) error {
+	if err := m.ch.Exec(ctx, fmt.Sprintf("ALTER TABLE %s MOVE PARTITION %d TO TABLE %s", eventsStageTable, partition, eventsTable)); err != nil {
+		return fmt.Errorf("move partition %d: %w", partition, err)
+	}
+	return nil
+}
+
+// verifyLegacyCopy returns the legacy months whose row count differs from
+// the count recorded when they were copied.
+func (m *Migrator) verifyLegacyCopy(ctx context.Context) ([]uint32, error) {
+	counts, err := m.countPartitions(ctx, eventsLegacyTable)
+	if err != nil {
+		return nil, err
+	}
+	copied, err := m.copiedPartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var mismatched []uint32
+	for _, p := range counts {
+		if rows, ok := copied[p.partition]; !ok || rows != p.rows {
+			mismatched = append(mismatched, p.partition)
+			m.opts.Logf("Events layout: partition %d has %d legacy rows, %d copied", p.partition, p.rows, rows)
+		}
+	}
+	return mismatched, nil
+}
+
+type partitionCount struct {
+	partition uint32
+	rows      uint64
+}
+
+// countPartitions counts the rows of each month of an events table.
+func (m *Migrator) countPartitions(ctx context.Context, table string) ([]partitionCount, error) {
+	rows, err := m.ch.Query(ctx, "SELECT toYYYYMM(timestamp) AS p, count() FROM "+table+" GROUP BY p ORDER BY p")
+	if err != nil {
+		return nil, fmt.Errorf("count partitions of %s: %w", table, err)
+	}
+	defer rows.Close()
+	var out []partitionCount
+	for rows.Next() {
+		var p partitionCount
+		if err := rows.Scan(&p.partition, &p.rows); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// copiedPartitions reads events_layout_copy: rows copied per month.
+func (m *Migrator) copiedPartitions(ctx context.Context) (map[uint32]uint64, error) {
+	rows, err := m.ch.Query(ctx, "SELECT partition, rows FROM "+layoutCopyTable+" FINAL")
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", layoutCopyTable, err)
+	}
+	defer rows.Close()
+	copied := make(map[uint32]uint64)
+	for rows.Next() {
+		var p partitionCount
+		if err := rows.Scan(&p.partition, &p.rows); err != nil {
+			return nil, err
+		}
+		copied[p.partition] = p.rows
+	}
+	return copied, rows.Err()
+}
+
+// tableExists reports whether a "database.table" exists.
+func (m *Migrator) tableExists(ctx context.Context, table string) (bool, error) {
+	var exists uint8
+	if err := m.ch.QueryRow(ctx, "EXISTS TABLE "+table).Scan(&exists); err != nil {
+		return false, fmt.Errorf("check %s: %w", table, err)
+	}
+	return exists == 1, nil
+}
+
+// hasColumn reports whether a "database.table" exists and has the column.
+func (m *Migrator) hasColumn(ctx context.Context, table, column string) (bool, error) {
+	database, name, _ := strings.Cut(table, ".")
+	var n uint64
+	if err := m.ch.QueryRow(ctx, "SELECT count() FROM system.columns WHERE database = ? AND table = ? AND name = ?",
+		database, name, column).Scan(&n); err != nil {
+		return false, fmt.Errorf("check %s.%s: %w", table, column, err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var legacyRows = map[uint32]uint64{202608: 5, 202609: 7, 202610: 3}
+
+// newOldLayoutConn returns a migrated server whose default.events still has
+// the old layout, with rows in three months.
+func newOldLayoutConn(t *testing.T) *fakeConn {
+	c := newFakeConn()
+	if _, err := newTestMigrator(t, c, Options{}).Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	c.tables[eventsTable], c.tables[eventsNextTable], c.tables[layoutCopyTable] = true, true, true
+	c.newLayout[eventsNextTable] = true
+	c.parts[eventsTable] = maps.Clone(legacyRows)
+	return c
+}
+
+// checkCopied fails unless default.events holds every legacy month once.
+func checkCopied(t *testing.T, c *fakeConn) {
+	t.Helper()
+	if !c.newLayout[eventsTable] || c.newLayout[eventsLegacyTable] || c.tables[eventsNextTable] {
+		t.Errorf("tables %v, new layout %v", c.tables, c.newLayout)
+	}
+	if !maps.Equal(c.parts[eventsTable], legacyRows) || !maps.Equal(c.copied, legacyRows) {
+		t.Errorf("events %v, copied %v; want %v", c.parts[eventsTable], c.copied, legacyRows)
+	}
+	if len(c.parts[eventsStageTable]) != 0 {
+		t.Errorf("rows left in the staging table: %v", c.parts[eventsStageTable])
+	}
+}
+
+func TestEventsLayout(t *testing.T) {
+	ctx := context.Background()
+	c := newOldLayoutConn(t)
+
+	res, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{DropLegacy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Swapped || !slices.Equal(res.Copied, []uint32{202608, 202609, 202610}) || len(res.Mismatched) != 0 || !res.Dropped {
+		t.Errorf("result = %+v", res)
+	}
+	checkCopied(t, c)
+	if c.tables[eventsLegacyTable] || c.tables[eventsStageTable] {
+		t.Errorf("legacy or staging table kept: %v", c.tables)
+	}
+
+	// Finished: nothing to do
+	if res, err = newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{}); err != nil || res.Swapped || len(res.Copied) != 0 {
+		t.Errorf("second run = %+v, %v", res, err)
+	}
+}
+
+func TestEventsLayoutDryRun(t *testing.T) {
+	c := newOldLayoutConn(t)
+	ran := len(c.execs)
+	res, err := newTestMigrator(t, c, Options{DryRun: true}).EventsLayout(context.Background(), LayoutOptions{DropLegacy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Swapped || !slices.Equal(res.Copied, []uint32{202608, 202609, 202610}) || res.Dropped {
+		t.Errorf("result = %+v", res)
+	}
+	if len(c.execs) != ran || c.newLayout[eventsTable] {
+		t.Errorf("dry run changed the server: ran %q", c.execs[ran:])
+	}
+}
+
+func TestEventsLayoutNeedsMigrations(t *testing.T) {
+	c := newOldLayoutConn(t)
+	delete(c.migrations, 3)
+	if _, err := newTestMigrator(t, c, Options{}).EventsLayout(context.Background(), LayoutOptions{}); err == nil || !strings.Contains(err.Error(), "migration 3") {
+		t.Errorf("err = %v, want migration 3 pending", err)
+	}
+	if c.newLayout[eventsTable] {
+		t.Error("swapped with a pending migration")
+	}
+}
+
+// TestEventsLayoutResumeAfterRename interrupts the swap between the exchange
+// and the rename.
+func TestEventsLayoutResumeAfterRename(t *testing.T) {
+	ctx := context.Background()
+	c := newOldLayoutConn(t)
+	c.failOn = "RENAME TABLE"
+	if _, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{}); err == nil {
+		t.Fatal("interrupted run succeeded")
+	}
+	if !c.newLayout[eventsTable] || c.newLayout[eventsNextTable] || c.tables[eventsLegacyTable] {
+		t.Fatalf("after the exchange: tables %v, new layout %v", c.tables, c.newLayout)
+	}
+
+	c.failOn = ""
+	res, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Swapped || !slices.Equal(res.Copied, []uint32{202608, 202609, 202610}) {
+		t.Errorf("resumed run = %+v, want the copy without a second exchange", res)
+	}
+	if n := strings.Count(strings.Join(c.execs, "\n"), "EXCHANGE TABLES"); n != 1 {
+		t.Errorf("tables exchanged %d times, want once", n)
+	}
+	checkCopied(t, c)
+	if !maps.Equal(c.parts[eventsLegacyTable], legacyRows) {
+		t.Errorf("legacy rows = %v", c.parts[eventsLegacyTable])
+	}
+}
+
+// TestEventsLayoutResumeAfterRecord interrupts the copy between recording a
+// month and moving it: the resumed run moves the staged rows instead of
+// copying the month again.
+func TestEventsLayoutResumeAfterRecord(t *testing.T) {
+	ctx := context.Background()
+	c := newOldLayoutConn(t)
+	c.failOn = "MOVE PARTITION 202609"
+	res, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{})
+	if err == nil || !slices.Equal(res.Copied, []uint32{202608}) {
+		t.Fatalf("interrupted run = %+v, %v", res, err)
+	}
+	if c.copied[202609] != 7 || c.parts[eventsStageTable][202609] != 7 || c.parts[eventsTable][202609] != 0 {
+		t.Fatalf("202609: recorded %d, staged %d, moved %d", c.copied[202609], c.parts[eventsStageTable][202609], c.parts[eventsTable][202609])
+	}
+
+	c.failOn = ""
+	res, err = newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{DropLegacy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Copied, []uint32{202610}) || !res.Dropped {
+		t.Errorf("resumed run = %+v, want only 202610 copied", res)
+	}
+	checkCopied(t, c)
+}
+
+// TestEventsLayoutResumeUnrecorded leaves rows staged by a copy interrupted
+// before the record: the month is copied again from scratch.
+func TestEventsLayoutResumeUnrecorded(t *testing.T) {
+	ctx := context.Background()
+	c := newOldLayoutConn(t)
+	c.failOn = "INSERT INTO " + layoutCopyTable
+	if _, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{}); err == nil {
+		t.Fatal("interrupted run succeeded")
+	}
+	if c.parts[eventsStageTable][202608] != 5 || len(c.copied) != 0 {
+		t.Fatalf("staged %v, recorded %v", c.parts[eventsStageTable], c.copied)
+	}
+
+	c.failOn = ""
+	res, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{})
+	if err != nil || !slices.Equal(res.Copied, []uint32{202608, 202609, 202610}) {
+		t.Fatalf("resumed run = %+v, %v", res, err)
+	}
+	checkCopied(t, c)
+}
+
+func TestEventsLayoutMismatch(t *testing.T) {
+	ctx := context.Background()
+	c := newOldLayoutConn(t)
+	if _, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A late insert into the legacy table after its month was copied
+	c.parts[eventsLegacyTable][202610]++
+	res, err := newTestMigrator(t, c, Options{}).EventsLayout(ctx, LayoutOptions{DropLegacy: true})
+	if err == nil || res.Dropped {
+		t.Fatalf("drop with a mismatch = %+v, %v", res, err)
+	}
+	if !slices.Equal(res.Mismatched, []uint32{202610}) || len(res.Copied) != 0 {
+		t.Errorf("result = %+v, want 202610 mismatched and nothing copied", res)
+	}
+	if !c.tables[eventsLegacyTable] {
+		t.Error("legacy table dropped")
+	}
+}
+
+func TestSwapEmptyEvents(t *testing.T) {
+	ctx := context.Background()
+	c := newOldLayoutConn(t)
+	if err := newTestMigrator(t, c, Options{}).swapEmptyEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c.newLayout[eventsTable] {
+		t.Error("swapped a table with rows")
+	}
+
+	delete(c.parts, eventsTable)
+	if err := newTestMigrator(t, c, Options{}).swapEmptyEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.newLayout[eventsTable] || c.tables[eventsNextTable] || c.tables[eventsLegacyTable] {
+		t.Errorf("after the swap: tables %v, new layout %v", c.tables, c.newLayout)
+	}
+}
@@ -0,0 +1,316 @@
+// Package migrate applies versioned ClickHouse schema migrations. Both the
+// backend and the processor run it at startup and as a `migrate` subcommand;
+// a lock table keeps concurrent instances from applying the same migration.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const (
+	migrationsTable = "default.schema_migrations"
+	lockTable       = "default.schema_migrations_lock"
+)
+
+// bookkeepingDDL creates the tables the migrator itself needs. schema_migrations
+// keeps the latest row per version (applied 1 = up, 0 = reverted);
+// schema_migrations_lock is a queue of lock holders, the oldest unexpired row
+// holds the lock.
+var bookkeepingDDL = []string{
+	`CREATE TABLE IF NOT EXISTS ` + migrationsTable + `
+(
+    version UInt32,
+    name String,
+    applied UInt8,
+    updated_at DateTime64(6) DEFAULT now64(6)
+)
+ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY version`,
+	`CREATE TABLE IF NOT EXISTS ` + lockTable + `
+(
+    owner String,
+    acquired_at DateTime64(6) DEFAULT now64(6),
+    expires_at DateTime64(6)
+)
+ENGINE = MergeTree
+ORDER BY acquired_at
+TTL toDateTime(expires_at) + INTERVAL 1 DAY`,
+}
+
+// Defaults for Options.
+const (
+	DefaultLockTTL     = 15 * time.Minute
+	DefaultLockTimeout = 5 * time.Minute
+)
+
+// lockPollInterval is how often a waiting instance checks the lock.
+const lockPollInterval = time.Second
+
+// ErrDataLoss is returned by Down when it would revert the first migration
+// (dropping the tables with their data) without Options.AllowDataLoss.
+var ErrDataLoss = errors.New("reverting the initial migration drops every table with its data")
+
+// ErrLockTimeout is returned when another instance holds the lock longer than
+// Options.LockTimeout.
+var ErrLockTimeout = errors.New("timed out waiting for the migration lock")
+
+// Options configure a Migrator.
+type Options struct {
+	DryRun        bool          // Print pending statements instead of running them
+	AllowDataLoss bool          // Let Down revert the first migration, which drops every table
+	LockTTL       time.Duration // A crashed holder's lock expires after this (default 15m)
+	LockTimeout   time.Duration // How long to wait for another instance (default 5m)
+	Logf          func(format string, args ...any)
+}
+
+// Status is the state of one known migration.
+type Status struct {
+	Version   uint32    `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"` // Zero when never run
+}
+
+// Migrator applies migrations to one ClickHouse server. Migration statements
+// should be idempotent (IF NOT EXISTS / IF EXISTS): ClickHouse has no
+// transactional DDL, and a migration that fails halfway is run again from its
+// first statement.
+type Migrator struct {
+	ch         clickhouse.Conn
+	migrations []Migration
+	opts       Options
+	owner      string
+}
+
+// New creates a migrator for the given migrations (see Bundled).
+func New(ch clickhouse.Conn, migrations []Migration, opts Options) *Migrator {
+	if opts.LockTTL <= 0 {
+		opts.LockTTL = DefaultLockTTL
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultLockTimeout
+	}
+	if opts.Logf == nil {
+		opts.Logf = log.Printf
+	}
+	host, _ := os.Hostname()
+	return &Migrator{
+		ch:         ch,
+		migrations: migrations,
+		opts:       opts,
+		owner:      fmt.Sprintf("%s/%d/%d", host, os.Getpid(), time.Now().UnixNano()),
+	}
+}
+
+// Up applies pending migrations up to and including version target (0: all)
+// and returns the versions applied (in dry-run mode: those that would be).
+func (m *Migrator) Up(ctx context.Context, target uint32) ([]uint32, error) {
+	var done []uint32
+	err := m.locked(ctx, func(applied map[uint32]Status) error {
+		for _, mig := range m.migrations {
+			if target != 0 && mig.Version > target {
+				break
+			}
+			if applied[mig.Version].Applied {
+				continue
+			}
+			if err := m.run(ctx, mig, "up", mig.Up, 1); err != nil {
+				return err
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the latest steps applied migrations and returns the versions
+// reverted (in dry-run mode: those that would be). Nothing is reverted if one
+// of them has no down file, or is the first migration and
+// Options.AllowDataLoss is not set.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]uint32, error) {
+	var done []uint32
+	err := m.locked(ctx, func(applied map[uint32]Status) error {
+		var plan []Migration
+		for i := len(m.migrations) - 1; i >= 0 && len(plan) < steps; i-- {
+			mig := m.migrations[i]
+			if !applied[mig.Version].Applied {
+				continue
+			}
+			if mig.Down == nil {
+				return fmt.Errorf("migration %d (%s) cannot be reverted: no down file", mig.Version, mig.Name)
+			}
+			if i == 0 && !m.opts.AllowDataLoss {
+				return fmt.Errorf("migration %d (%s): %w; pass -allow-data-loss to revert it", mig.Version, mig.Name, ErrDataLoss)
+			}
+			plan = append(plan, mig)
+		}
+		for _, mig := range plan {
+			if err := m.run(ctx, mig, "down", mig.Down, 0); err != nil {
+				return err
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists the known migrations with their state, plus applied versions
+// this binary does not know (from a newer release).
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Status, 0, len(m.migrations))
+	known := make(map[uint32]bool, len(m.migrations))
+	for _, mig := range m.migrations {
+		st := applied[mig.Version]
+		st.Version, st.Name = mig.Version, mig.Name
+		out = append(out, st)
+		known[mig.Version] = true
+	}
+	for version, st := range applied {
+		if !known[version] && st.Applied {
+			out = append(out, st)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// run executes one migration's statements and records its new state.
+func (m *Migrator) run(ctx context.Context, mig Migration, direction string, statements []string, applied uint8) error {
+	if m.opts.DryRun {
+		m.opts.Logf("Migration %d (%s) %s [dry run]:", mig.Version, mig.Name, direction)
+		for _, stmt := range statements {
+			m.opts.Logf("%s;", stmt)
+		}
+		return nil
+	}
+
+	start := time.Now()
+	for i, stmt := range statements {
+		if err := m.ch.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d (%s) %s, statement %d: %w", mig.Version, mig.Name, direction, i+1, err)
+		}
+	}
+	if err := m.ch.Exec(ctx, "INSERT INTO "+migrationsTable+" (version, name, applied) VALUES (?, ?, ?)",
+		mig.Version, mig.Name, applied); err != nil {
+		return fmt.Errorf("record migration %d: %w", mig.Version, err)
+	}
+	m.opts.Logf("Migration %d (%s) %s in %s", mig.Version, mig.Name, direction, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// locked takes the lock and calls fn with the applied state read under it.
+func (m *Migrator) locked(ctx context.Context, fn func(applied map[uint32]Status) error) error {
+	return m.withLock(ctx, func() error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		return fn(applied)
+	})
+}
+
+// withLock creates the bookkeeping tables and calls fn holding the lock. Dry
+// runs only read: they neither create tables nor lock.
+func (m *Migrator) withLock(ctx context.Context, fn func() error) error {
+	if m.opts.DryRun {
+		return fn()
+	}
+
+	for _, ddl := range bookkeepingDDL {
+		if err := m.ch.Exec(ctx, ddl); err != nil {
+			return fmt.Errorf("create migration tables: %w", err)
+		}
+	}
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.unlock()
+	return fn()
+}
+
+// applied reads the latest state of every version. A missing
+// schema_migrations table means nothing was applied.
+func (m *Migrator) applied(ctx context.Context) (map[uint32]Status, error) {
+	applied := make(map[uint32]Status)
+	exists, err := m.tableExists(ctx, migrationsTable)
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := m.ch.Query(ctx, "SELECT version, name, applied, updated_at FROM "+migrationsTable+" FINAL")
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", migrationsTable, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var st Status
+		var flag uint8
+		if err := rows.Scan(&st.Version, &st.Name, &flag, &st.UpdatedAt); err != nil {
+			return nil, err
+		}
+		st.Applied = flag == 1
+		applied[st.Version] = st
+	}
+	return applied, rows.Err()
+}
+
+// lock queues this instance in the lock table and waits until its row is the
+// oldest unexpired one. Timestamps come from the ClickHouse server, so the
+// queue order is the order of the inserts.
+func (m *Migrator) lock(ctx context.Context) error {
+	if err := m.ch.Exec(ctx, "INSERT INTO "+lockTable+" (owner, expires_at) VALUES (?, now64(6) + toIntervalSecond(?))",
+		m.owner, int64(m.opts.LockTTL/time.Second)); err != nil {
+		return fmt.Errorf("queue for migration lock: %w", err)
+	}
+
+	deadline := time.Now().Add(m.opts.LockTimeout)
+	logged := false
+	for {
+		var holder string
+		err := m.ch.QueryRow(ctx, "SELECT owner FROM "+lockTable+" WHERE expires_at > now64(6) ORDER BY acquired_at, owner LIMIT 1").Scan(&holder)
+		if err != nil {
+			m.unlock()
+			return fmt.Errorf("read migration lock: %w", err)
+		}
+		if holder == m.owner {
+			return nil
+		}
+		if !logged {
+			m.opts.Logf("Migrations: waiting for the lock held by %s", holder)
+			logged = true
+		}
+		if time.Now().After(deadline) {
+			m.unlock()
+			return fmt.Errorf("%w (held by %s)", ErrLockTimeout, holder)
+		}
+		select {
+		case <-ctx.Done():
+			m.unlock()
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// unlock removes this instance's lock row.
+func (m *Migrator) unlock() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := m.ch.Exec(ctx, "DELETE FROM "+lockTable+" WHERE owner = ?", m.owner); err != nil {
+		m.opts.Logf("Migrations: failed to release the lock (it expires in %s): %v", m.opts.LockTTL, err)
+	}
+}
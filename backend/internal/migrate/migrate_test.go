@@ -0,0 +1,451 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// fakeConn is an in-memory ClickHouse that understands the statements of the
+// migrator and of the events layout change. Other statements are only
+// recorded.
+type fakeConn struct {
+	driver.Conn
+
+	mu         sync.Mutex
+	tables     map[string]bool
+	newLayout  map[string]bool              // Tables with layoutMarkerColumn
+	parts      map[string]map[uint32]uint64 // Rows per month of the events tables
+	copied     map[uint32]uint64            // events_layout_copy
+	migrations map[uint32]Status
+	locks      []fakeLock // In insert order
+	execs      []string   // Every statement run
+	failOn     string     // Exec fails, changing nothing, for statements containing it
+}
+
+type fakeLock struct {
+	owner   string
+	expires time.Time
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		tables:     make(map[string]bool),
+		newLayout:  make(map[string]bool),
+		parts:      make(map[string]map[uint32]uint64),
+		copied:     make(map[uint32]uint64),
+		migrations: make(map[uint32]Status),
+	}
+}
+
+func (c *fakeConn) Exec(ctx context.Context, query string, args ...any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.execs = append(c.execs, query)
+	if c.failOn != "" && strings.Contains(query, c.failOn) {
+		return fmt.Errorf("fake: %s failed", c.failOn)
+	}
+	f := strings.Fields(query)
+	switch {
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS "):
+		c.tables[f[5]] = true
+		if len(f) == 8 && f[6] == "AS" {
+			c.newLayout[f[5]] = c.newLayout[f[7]]
+		}
+	case strings.HasPrefix(query, "EXCHANGE TABLES "):
+		c.tables[f[2]], c.tables[f[4]] = c.tables[f[4]], c.tables[f[2]]
+		c.newLayout[f[2]], c.newLayout[f[4]] = c.newLayout[f[4]], c.newLayout[f[2]]
+		c.parts[f[2]], c.parts[f[4]] = c.parts[f[4]], c.parts[f[2]]
+	case strings.HasPrefix(query, "RENAME TABLE "):
+		c.tables[f[4]], c.newLayout[f[4]], c.parts[f[4]] = true, c.newLayout[f[2]], c.parts[f[2]]
+		c.dropTable(f[2])
+	case strings.HasPrefix(query, "DROP TABLE IF EXISTS "):
+		c.dropTable(f[4])
+	case strings.HasPrefix(query, "TRUNCATE TABLE "):
+		delete(c.parts, f[2])
+	case strings.HasPrefix(query, "INSERT INTO "+eventsStageTable+" "):
+		_, from, _ := strings.Cut(query, " FROM ")
+		p := args[0].(uint32)
+		c.addRows(eventsStageTable, p, c.parts[strings.Fields(from)[0]][p])
+	case strings.HasPrefix(query, "INSERT INTO "+layoutCopyTable+" "):
+		c.copied[args[0].(uint32)] = args[1].(uint64)
+	case strings.Contains(query, " MOVE PARTITION "):
+		p64, _ := strconv.ParseUint(f[5], 10, 32)
+		p := uint32(p64)
+		c.addRows(f[8], p, c.parts[f[2]][p])
+		delete(c.parts[f[2]], p)
+	case strings.HasPrefix(query, "INSERT INTO "+migrationsTable+" "):
+		c.migrations[args[0].(uint32)] = Status{
+			Version: args[0].(uint32), Name: args[1].(string), Applied: args[2].(uint8) == 1, UpdatedAt: time.Now(),
+		}
+	case strings.HasPrefix(query, "INSERT INTO "+lockTable+" "):
+		c.locks = append(c.locks, fakeLock{args[0].(string), time.Now().Add(time.Duration(args[1].(int64)) * time.Second)})
+	case strings.HasPrefix(query, "DELETE FROM "+lockTable+" "):
+		c.locks = slices.DeleteFunc(c.locks, func(l fakeLock) bool { return l.owner == args[0] })
+	}
+	return nil
+}
+
+func (c *fakeConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT count() FROM system.columns "):
+		var n uint64
+		if table := args[0].(string) + "." + args[1].(string); c.tables[table] && c.newLayout[table] && args[2] == layoutMarkerColumn {
+			n = 1
+		}
+		return fakeRow{vals: []any{n}}
+	case strings.HasPrefix(query, "SELECT count() FROM "):
+		var n uint64
+		for _, rows := range c.parts[strings.TrimPrefix(query, "SELECT count() FROM ")] {
+			n += rows
+		}
+		return fakeRow{vals: []any{n}}
+	case strings.HasPrefix(query, "EXISTS TABLE "):
+		var exists uint8
+		if c.tables[strings.TrimPrefix(query, "EXISTS TABLE ")] {
+			exists = 1
+		}
+		return fakeRow{vals: []any{exists}}
+	case strings.HasPrefix(query, "SELECT owner FROM "+lockTable+" "):
+		for _, l := range c.locks {
+			if l.expires.After(time.Now()) {
+				return fakeRow{vals: []any{l.owner}}
+			}
+		}
+		return fakeRow{err: errors.New("no lock rows")}
+	}
+	return fakeRow{err: fmt.Errorf("fake: unexpected query %q", query)}
+}
+
+func (c *fakeConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var rows [][]any
+	switch {
+	case strings.HasPrefix(query, "SELECT version, name, applied, updated_at FROM "+migrationsTable):
+		for _, st := range c.migrations {
+			var flag uint8
+			if st.Applied {
+				flag = 1
+			}
+			rows = append(rows, []any{st.Version, st.Name, flag, st.UpdatedAt})
+		}
+	case strings.HasPrefix(query, "SELECT toYYYYMM(timestamp) AS p, count() FROM "):
+		for p, n := range c.parts[strings.Fields(query)[6]] {
+			rows = append(rows, []any{p, n})
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i][0].(uint32) < rows[j][0].(uint32) })
+	case strings.HasPrefix(query, "SELECT partition, rows FROM "+layoutCopyTable):
+		for p, n := range c.copied {
+			rows = append(rows, []any{p, n})
+		}
+	default:
+		return nil, fmt.Errorf("fake: unexpected query %q", query)
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+func (c *fakeConn) dropTable(table string) {
+	delete(c.tables, table)
+	delete(c.newLayout, table)
+	delete(c.parts, table)
+}
+
+func (c *fakeConn) addRows(table string, partition uint32, rows uint64) {
+	if rows == 0 {
+		return
+	}
+	if c.parts[table] == nil {
+		c.parts[table] = make(map[uint32]uint64)
+	}
+	c.parts[table][partition] += rows
+}
+
+// ran reports whether a statement was run.
+func (c *fakeConn) ran(stmt string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Contains(c.execs, stmt)
+}
+
+// applied returns the applied versions in order.
+func (c *fakeConn) applied() []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []uint32
+	for v, st := range c.migrations {
+		if st.Applied {
+			out = append(out, v)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func (c *fakeConn) lockOwners() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for _, l := range c.locks {
+		out = append(out, l.owner)
+	}
+	return out
+}
+
+type fakeRow struct {
+	vals []any
+	err  error
+}
+
+func (r fakeRow) Err() error                { return r.err }
+func (r fakeRow) ScanStruct(dest any) error { return errors.New("fake: ScanStruct") }
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(r.vals[i]))
+	}
+	return nil
+}
+
+type fakeRows struct {
+	driver.Rows
+	rows [][]any
+	next int
+}
+
+func (r *fakeRows) Next() bool             { r.next++; return r.next <= len(r.rows) }
+func (r *fakeRows) Scan(dest ...any) error { return fakeRow{vals: r.rows[r.next-1]}.Scan(dest...) }
+func (r *fakeRows) Close() error           { return nil }
+func (r *fakeRows) Err() error             { return nil }
+
+func testMigrations() []Migration {
+	return []Migration{
+		{Version: 1, Name: "initial", Up: []string{"CREATE TABLE a", "CREATE TABLE b"}, Down: []string{"DROP TABLE b", "DROP TABLE a"}},
+		{Version: 2, Name: "columns", Up: []string{"ALTER TABLE a ADD COLUMN c"}, Down: []string{"ALTER TABLE a DROP COLUMN c"}},
+		{Version: 3, Name: "settings", Up: []string{"ALTER TABLE a MODIFY SETTING s = 1"}, Down: []string{}},
+	}
+}
+
+func newTestMigrator(t *testing.T, c *fakeConn, opts Options) *Migrator {
+	if opts.Logf == nil {
+		opts.Logf = t.Logf
+	}
+	return New(c, testMigrations(), opts)
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name, sql string
+		want      []string
+	}{
+		{"one per line", "CREATE TABLE a (x UInt8);\nDROP TABLE b;\n", []string{"CREATE TABLE a (x UInt8)", "DROP TABLE b"}},
+		{"two on a line", "SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"no final semicolon", "SELECT 1\n", []string{"SELECT 1"}},
+		{"CRLF", "SELECT 1;\r\nSELECT 2;\r\n", []string{"SELECT 1", "SELECT 2"}},
+		{"in strings", "INSERT INTO t VALUES ('a;b', 'it''s;');\nSELECT 'x\\';y';", []string{"INSERT INTO t VALUES ('a;b', 'it''s;')", "SELECT 'x\\';y'"}},
+		{"string across lines", "INSERT INTO t VALUES ('a;\nb');", []string{"INSERT INTO t VALUES ('a;\nb')"}},
+		{"in identifiers", "SELECT `a;b`, \"c;d\" FROM t;", []string{"SELECT `a;b`, \"c;d\" FROM t"}},
+		{"in comments", "-- header; it's here\nCREATE TABLE a\n(\n    x UInt8, -- first;\n    y UInt8 /* second; */\n);\n-- trailing;\n",
+			[]string{"CREATE TABLE a\n(\n    x UInt8,\n    y UInt8\n)"}},
+		{"unclosed block comment", "SELECT 1; /* ;", []string{"SELECT 1"}},
+		{"comments only", "-- nothing to revert;\n\n", nil},
+	}
+	for _, tt := range tests {
+		if got := SplitStatements(tt.sql); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: SplitStatements(%q) = %q, want %q", tt.name, tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(fstest.MapFS{
+		"0002_second.up.sql":    {Data: []byte("ALTER TABLE a ADD COLUMN c;")},
+		"0001_initial.up.sql":   {Data: []byte("CREATE TABLE a;\nCREATE TABLE b;")},
+		"0001_initial.down.sql": {Data: []byte("-- keeps the data;")},
+		"README.md":             {Data: []byte("ignored")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Version != 2 {
+		t.Fatalf("migrations = %+v", migrations)
+	}
+	if migrations[0].Down == nil || len(migrations[0].Down) != 0 || migrations[1].Down != nil {
+		t.Errorf("down = %q, %q; want a no-op for 1 and none for 2", migrations[0].Down, migrations[1].Down)
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"no up file":    {"0001_initial.down.sql": {Data: []byte("DROP TABLE a;")}},
+		"version 0":     {"0000_initial.up.sql": {Data: []byte("CREATE TABLE a;")}},
+		"two names":     {"0001_a.up.sql": {Data: []byte("SELECT 1;")}, "0001_b.down.sql": {Data: []byte("SELECT 1;")}},
+		"comments only": {"0001_initial.up.sql": {Data: []byte("-- later;")}},
+	} {
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("%s: Load accepted it", name)
+		}
+	}
+
+	bundled, err := Bundled()
+	if err != nil || len(bundled) == 0 || bundled[0].Version != 1 {
+		t.Fatalf("Bundled() = %d migrations, %v", len(bundled), err)
+	}
+}
+
+func TestUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeConn()
+	m := newTestMigrator(t, c, Options{})
+
+	done, err := m.Up(ctx, 2)
+	if err != nil || !slices.Equal(done, []uint32{1, 2}) {
+		t.Fatalf("Up(2) = %v, %v", done, err)
+	}
+	if !c.ran("CREATE TABLE b") || c.ran("ALTER TABLE a MODIFY SETTING s = 1") {
+		t.Errorf("Up(2) ran %q", c.execs)
+	}
+	if done, err = m.Up(ctx, 0); err != nil || !slices.Equal(done, []uint32{3}) {
+		t.Fatalf("Up(0) = %v, %v; want only the pending 3", done, err)
+	}
+	if done, err = m.Up(ctx, 0); err != nil || len(done) != 0 {
+		t.Fatalf("Up(0) again = %v, %v", done, err)
+	}
+
+	if done, err = m.Down(ctx, 2); err != nil || !slices.Equal(done, []uint32{3, 2}) {
+		t.Fatalf("Down(2) = %v, %v", done, err)
+	}
+	if !c.ran("ALTER TABLE a DROP COLUMN c") || !slices.Equal(c.applied(), []uint32{1}) {
+		t.Errorf("after Down(2) applied %v", c.applied())
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil || len(statuses) != 3 {
+		t.Fatalf("Status = %+v, %v", statuses, err)
+	}
+	if st := statuses[2]; st.Version != 3 || st.Applied || st.UpdatedAt.IsZero() {
+		t.Errorf("status of 3 = %+v, want reverted", st)
+	}
+	if owners := c.lockOwners(); len(owners) != 0 {
+		t.Errorf("lock rows left: %v", owners)
+	}
+
+	// A migration without a down file stops Down before anything runs
+	m.migrations[1].Down = nil
+	if _, err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if done, err = m.Down(ctx, 2); err == nil || len(done) != 0 || !slices.Equal(c.applied(), []uint32{1, 2, 3}) {
+		t.Errorf("Down over a migration without down file = %v, %v; applied %v", done, err, c.applied())
+	}
+}
+
+func TestDownInitialNeedsAllowDataLoss(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeConn()
+	if _, err := newTestMigrator(t, c, Options{}).Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := newTestMigrator(t, c, Options{}).Down(ctx, 3)
+	if !errors.Is(err, ErrDataLoss) || len(done) != 0 {
+		t.Fatalf("Down(3) = %v, %v; want ErrDataLoss", done, err)
+	}
+	if c.ran("ALTER TABLE a DROP COLUMN c") || !slices.Equal(c.applied(), []uint32{1, 2, 3}) {
+		t.Errorf("refused Down reverted migrations: applied %v", c.applied())
+	}
+
+	done, err = newTestMigrator(t, c, Options{AllowDataLoss: true}).Down(ctx, 3)
+	if err != nil || !slices.Equal(done, []uint32{3, 2, 1}) {
+		t.Fatalf("Down(3) with AllowDataLoss = %v, %v", done, err)
+	}
+	if !c.ran("DROP TABLE a") || len(c.applied()) != 0 {
+		t.Errorf("after Down(3) applied %v", c.applied())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeConn()
+	var logged []string
+	logf := func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) }
+
+	done, err := newTestMigrator(t, c, Options{DryRun: true, Logf: logf}).Up(ctx, 0)
+	if err != nil || !slices.Equal(done, []uint32{1, 2, 3}) {
+		t.Fatalf("dry-run Up = %v, %v", done, err)
+	}
+	if len(c.execs) != 0 {
+		t.Errorf("dry-run Up ran %q", c.execs)
+	}
+	if !slices.Contains(logged, "CREATE TABLE b;") {
+		t.Errorf("dry-run Up printed %q", logged)
+	}
+
+	if _, err := newTestMigrator(t, c, Options{}).Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	ran := len(c.execs)
+	if _, err := newTestMigrator(t, c, Options{DryRun: true, Logf: logf}).Down(ctx, 3); !errors.Is(err, ErrDataLoss) {
+		t.Errorf("dry-run Down(3) err = %v, want ErrDataLoss", err)
+	}
+	done, err = newTestMigrator(t, c, Options{DryRun: true, AllowDataLoss: true, Logf: logf}).Down(ctx, 3)
+	if err != nil || !slices.Equal(done, []uint32{3, 2, 1}) {
+		t.Fatalf("dry-run Down(3) = %v, %v", done, err)
+	}
+	if len(c.execs) != ran || !slices.Equal(c.applied(), []uint32{1, 2, 3}) {
+		t.Errorf("dry-run Down changed the server: ran %q", c.execs[ran:])
+	}
+}
+
+func TestLockQueue(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeConn()
+	holder := newTestMigrator(t, c, Options{})
+	if err := holder.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance waits, gives up and leaves the queue
+	waiter := newTestMigrator(t, c, Options{LockTimeout: time.Millisecond})
+	if _, err := waiter.Up(ctx, 0); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Up while locked = %v, want ErrLockTimeout", err)
+	}
+	if owners := c.lockOwners(); !slices.Equal(owners, []string{holder.owner}) || len(c.applied()) != 0 {
+		t.Errorf("after the timeout: lock rows %v, applied %v", owners, c.applied())
+	}
+
+	// It gets the lock once the holder releases it
+	waiter = newTestMigrator(t, c, Options{LockTimeout: time.Minute})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := waiter.Up(ctx, 0)
+		errc <- err
+	}()
+	for len(c.lockOwners()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	holder.unlock()
+	if err := <-errc; err != nil || !slices.Equal(c.applied(), []uint32{1, 2, 3}) {
+		t.Fatalf("Up after the release = %v, applied %v", err, c.applied())
+	}
+
+	// The row of a crashed holder expires
+	c.locks = []fakeLock{{"crashed", time.Now().Add(-time.Second)}}
+	m := newTestMigrator(t, c, Options{LockTimeout: time.Millisecond})
+	if _, err := m.Down(ctx, 1); err != nil {
+		t.Fatalf("Down behind an expired lock: %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+-- Drops every table of the initial schema, with its data.
+DROP TABLE IF EXISTS default.event_items;
+DROP TABLE IF EXISTS default.identity_links;
+DROP TABLE IF EXISTS default.events_dlq;
+DROP TABLE IF EXISTS default.events;
@@ -0,0 +1,77 @@
+-- Schema as of the first versioned release. Idempotent, so databases created
+-- earlier from config/clickhouse/schema.sql are adopted without changes; the
+-- events columns they lack are added by 0003_events_columns.
+
+CREATE TABLE IF NOT EXISTS default.events
+(
+    `timestamp` DateTime DEFAULT now(),
+    `event_name` String,
+    
+    `ids` Map(String, String),     -- user_id, visitor_id, original_visitor_id, person_id, session_id, event_id, session_seq, is_session_start, event_index_in_session
+    `page` Map(String, String),    -- url, host, path, query, *_canonical
+    `device` Map(String, String),  -- platform, user_agent, screen_*, language, timezone, is_bot
+    `geo` Map(String, String),     -- ip_hash, country, city, region, postal_code...
+    `traffic` Map(String, String), -- referrer_*, source, channel, campaign, term, content
+    `tech` Map(String, String),    -- performance metrics, connection info, ad_block
+    `params` Map(String, String),  -- custom event parameters
+    `consent` Map(String, String), -- analytics, fingerprinting, geo (granted/denied), source (event/default)
+    `params_num` Map(String, Float64), -- numeric/boolean (1/0) params, same keys as params
+    `tech_num` Map(String, Float64)    -- numeric/boolean (1/0) tech values, same keys as tech
+)
+ENGINE = MergeTree
+ORDER BY (event_name, timestamp)
+-- The processor tags each insert with insert_deduplication_token: a retried
+-- insert that was already committed is dropped
+SETTINGS index_granularity = 8192, non_replicated_deduplication_window = 1000;
+
+-- Dead-letter queue: payloads the processor (or collector) could not ingest.
+-- Replayed with `processor replay-dlq`, which deletes entries once inserted.
+CREATE TABLE IF NOT EXISTS default.events_dlq
+(
+    `id` String DEFAULT toString(generateUUIDv4()),
+    `timestamp` DateTime DEFAULT now(),
+    `stage` LowCardinality(String), -- collector, decode, map, append
+    `error` String,
+    `payload` String                -- original JSON line / array element
+)
+ENGINE = MergeTree
+ORDER BY (stage, timestamp)
+SETTINGS index_granularity = 8192;
+
+-- Fingerprint links: one row per event whose visitor_id the processor swapped.
+-- original_id is the visitor_id the event arrived with (kept in ids.original_visitor_id).
+CREATE TABLE IF NOT EXISTS default.identity_links
+(
+    `timestamp` DateTime64(3),
+    `event_id` String,
+    `original_id` String,
+    `linked_id` String,
+    `bucket_key` String,
+    `signal_scores` Map(String, Float64), -- per-signal Jaccard similarity: tls, canvas, webgl, audio
+    `score` Float64
+)
+ENGINE = ReplacingMergeTree
+ORDER BY (original_id, linked_id, event_id)
+SETTINGS index_granularity = 8192;
+
+-- Ecommerce items: one row per valid entry of data.items of view_item,
+-- add_to_cart, purchase, refund, ... Joined to events on event_id.
+CREATE TABLE IF NOT EXISTS default.event_items
+(
+    `timestamp` DateTime,
+    `event_id` String,
+    `event_name` LowCardinality(String),
+    `item_index` UInt16,                 -- position in data.items
+    `item_id` String,
+    `item_name` String,
+    `item_brand` String,
+    `item_category` String,
+    `item_variant` String,
+    `price` Float64,
+    `quantity` Float64,
+    `currency` LowCardinality(String),   -- item currency, else the event's params.currency
+    `params` Map(String, String)         -- other item fields: item_category2, coupon, discount...
+)
+ENGINE = ReplacingMergeTree
+ORDER BY (event_name, event_id, item_index)
+SETTINGS index_granularity = 8192;
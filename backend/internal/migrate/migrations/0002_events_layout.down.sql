@@ -0,0 +1,9 @@
+-- Only possible before `migrate events-layout` swapped the tables: afterwards
+-- default.events has the new layout (and default.events_v2 is gone), so
+-- dropping the tables below would not restore the old one. Refuse before
+-- changing anything; reverting then takes a manual copy back.
+SELECT throwIf(count() > 0, 'default.events already uses the layout of 0002 (migrate events-layout ran): cannot revert')
+FROM system.columns
+WHERE database = 'default' AND table = 'events' AND name = 'visitor_id';
+DROP TABLE IF EXISTS default.events_layout_copy;
+DROP TABLE IF EXISTS default.events_v2;
@@ -0,0 +1,61 @@
+-- Query-optimized layout of default.events, created as default.events_v2.
+-- `migrate events-layout` swaps it in (EXCHANGE TABLES) and copies the old
+-- rows across partition by partition; on an empty database the swap happens
+-- at startup. Inserts keep the column list of the old layout: host and
+-- visitor_id are materialized from the maps.
+CREATE TABLE IF NOT EXISTS default.events_v2
+(
+    `timestamp` DateTime DEFAULT now(),
+    `event_name` LowCardinality(String),
+
+    `ids` Map(LowCardinality(String), String),
+    `page` Map(LowCardinality(String), String),
+    `device` Map(LowCardinality(String), String),
+    `geo` Map(LowCardinality(String), String),
+    `traffic` Map(LowCardinality(String), String),
+    `tech` Map(LowCardinality(String), String),
+    `params` Map(LowCardinality(String), String),
+    `consent` Map(LowCardinality(String), LowCardinality(String)),
+    `params_num` Map(LowCardinality(String), Float64),
+    `tech_num` Map(LowCardinality(String), Float64),
+
+    -- Site: canonical host (lowercase, without www.), else the raw host
+    `host` LowCardinality(String) MATERIALIZED if(page['host_canonical'] != '', page['host_canonical'], lower(page['host'])),
+    `visitor_id` String MATERIALIZED ids['visitor_id'],
+
+    INDEX idx_visitor_id visitor_id TYPE bloom_filter(0.01) GRANULARITY 4,
+    INDEX idx_ids_values mapValues(ids) TYPE bloom_filter(0.01) GRANULARITY 4,
+    INDEX idx_params_keys mapKeys(params) TYPE bloom_filter(0.01) GRANULARITY 4,
+    INDEX idx_params_values mapValues(params) TYPE bloom_filter(0.01) GRANULARITY 4,
+    INDEX idx_traffic_values mapValues(traffic) TYPE bloom_filter(0.01) GRANULARITY 4,
+
+    -- Daily events and visitors per site and event
+    PROJECTION daily_events
+    (
+        SELECT host, event_name, toDate(timestamp), count(), uniq(visitor_id)
+        GROUP BY host, event_name, toDate(timestamp)
+    ),
+    -- Daily events and visitors per site and channel group
+    PROJECTION daily_channels
+    (
+        SELECT host, toDate(timestamp), traffic['channel_group'], count(), uniq(visitor_id)
+        GROUP BY host, toDate(timestamp), traffic['channel_group']
+    )
+)
+ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (host, event_name, toDate(timestamp), visitor_id, timestamp)
+-- Privacy erasure uses lightweight deletes, which must rebuild the projections;
+-- retried inserts are deduplicated by their insert_deduplication_token
+SETTINGS index_granularity = 8192, lightweight_mutation_projection_mode = 'rebuild',
+    non_replicated_deduplication_window = 1000;
+
+-- Partitions of the old layout copied by `migrate events-layout`.
+CREATE TABLE IF NOT EXISTS default.events_layout_copy
+(
+    `partition` UInt32, -- toYYYYMM(timestamp)
+    `rows` UInt64,
+    `copied_at` DateTime DEFAULT now()
+)
+ENGINE = ReplacingMergeTree(copied_at)
+ORDER BY partition;
@@ -0,0 +1,2 @@
+-- Nothing to revert: on installs created by 0001_initial the columns belong to
+-- it, and the processor writes them on every insert.
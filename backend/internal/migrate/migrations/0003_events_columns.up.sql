@@ -0,0 +1,6 @@
+-- Columns of default.events that databases adopted by 0001_initial (created
+-- from config/clickhouse/schema.sql) do not have. No-op on installs created by
+-- 0001, and after `migrate events-layout`: both layouts already have them.
+ALTER TABLE default.events ADD COLUMN IF NOT EXISTS `consent` Map(String, String);
+ALTER TABLE default.events ADD COLUMN IF NOT EXISTS `params_num` Map(String, Float64);
+ALTER TABLE default.events ADD COLUMN IF NOT EXISTS `tech_num` Map(String, Float64);
@@ -0,0 +1 @@
+ALTER TABLE default.events RESET SETTING non_replicated_deduplication_window;
@@ -0,0 +1,4 @@
+-- Deduplication of retried inserts (insert_deduplication_token) for
+-- default.events created before 0001 and 0002 set it. default.events_v2
+-- gets it when `migrate events-layout` swaps it in.
+ALTER TABLE default.events MODIFY SETTING non_replicated_deduplication_window = 1000;
@@ -0,0 +1,156 @@
+package migrate
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// embedded holds the bundled migrations, shared by the backend and the processor.
+//
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+// Migration is one schema version: the statements that apply it (up) and
+// revert it (down).
+type Migration struct {
+	Version uint32
+	Name    string
+	Up      []string
+	Down    []string // Nil without a down file (cannot be reverted); empty for a no-op revert
+}
+
+// fileNamePattern matches migration files: 0002_add_items.up.sql.
+var fileNamePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Bundled returns the migrations embedded in the binary, in version order.
+func Bundled() ([]Migration, error) {
+	sub, err := fs.Sub(embedded, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return Load(sub)
+}
+
+// Load reads the migration files at the root of fsys. Every version needs an
+// up file; the down file is optional and may hold only comments (nothing to
+// revert). Files that do not match the naming
+// scheme are ignored.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint32]*Migration)
+	for _, entry := range entries {
+		m := fileNamePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("%s: invalid version", entry.Name())
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[uint32(version)]
+		if mig == nil {
+			mig = &Migration{Version: uint32(version), Name: m[2]}
+			byVersion[uint32(version)] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("version %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		statements := SplitStatements(string(data))
+		if m[3] == "up" {
+			mig.Up = statements
+		} else {
+			mig.Down = append([]string{}, statements...) // Non-nil: the file exists
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if len(mig.Up) == 0 {
+			return nil, fmt.Errorf("version %d (%s) has no up statements", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// SplitStatements splits a SQL file into statements on semicolons (ClickHouse
+// runs one statement per query). Semicolons in string literals, quoted
+// identifiers and comments do not split; comments and blank lines are dropped.
+func SplitStatements(sql string) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		var lines []string
+		for _, line := range strings.Split(current.String(), "\n") {
+			if line = strings.TrimRight(line, " \t\r"); strings.TrimSpace(line) != "" {
+				lines = append(lines, line)
+			}
+		}
+		if stmt := strings.TrimSpace(strings.Join(lines, "\n")); stmt != "" {
+			statements = append(statements, stmt)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(sql); i++ {
+		switch rest := sql[i:]; {
+		case sql[i] == '\'' || sql[i] == '"' || sql[i] == '`':
+			end := quoteEnd(sql, i)
+			current.WriteString(sql[i:end])
+			i = end - 1
+		case strings.HasPrefix(rest, "--"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			i += end - 1 // Keep the newline
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				end = len(rest) - 4
+			}
+			current.WriteByte(' ')
+			i += end + 3
+		case sql[i] == ';':
+			flush()
+		default:
+			current.WriteByte(sql[i])
+		}
+	}
+	flush()
+	return statements
+}
+
+// quoteEnd returns the index just past the string literal or identifier whose
+// opening quote is at sql[start], or len(sql) if it is not closed. A
+// backslash or a doubled quote escapes the quote.
+func quoteEnd(sql string, start int) int {
+	quote := sql[start]
+	for i := start + 1; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
@@ -7,12 +7,14 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
 
 	"github.com/pamnard/pixel/backend/internal/api"
 	"github.com/pamnard/pixel/backend/internal/meta"
+	"github.com/pamnard/pixel/backend/internal/migrate"
 )
 
 func main() {
@@ -29,11 +31,25 @@ func main() {
 
 	ch := mustConnectClickHouse(chHost, chUser, chPass)
 
+	// `backend migrate ...` manages the ClickHouse schema instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(ch, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+	mustMigrate(ch)
+
 	metaPath := getenv("REPORT_DB_PATH", filepath.Join(".", "config", "reports.db"))
 	metaStore := meta.NewStore(metaPath)
 	defer metaStore.Close()
 
-	srv := api.NewServer(ch, metaStore)
+	processor := api.NewProcessorAdmin(
+		getenv("PROCESSOR_URL", "http://processor:8080"),
+		getenv("PROCESSOR_ADMIN_TOKEN", ""),
+	)
+
+	srv := api.NewServer(ch, metaStore, processor)
 	mux := api.NewMux(srv)
 
 	server := &http.Server{
@@ -76,6 +92,18 @@ func mustConnectClickHouse(host, user, pass string) clickhouse.Conn {
 	return conn
 }
 
+// mustMigrate applies pending schema migrations unless MIGRATE_ON_START=false.
+func mustMigrate(ch clickhouse.Conn) {
+	if on, err := strconv.ParseBool(getenv("MIGRATE_ON_START", "true")); err != nil {
+		log.Fatalf("invalid MIGRATE_ON_START: %v", err)
+	} else if !on {
+		return
+	}
+	if err := migrate.Run(context.Background(), ch); err != nil {
+		log.Fatalf("migrations failed: %v", err)
+	}
+}
+
 // getenv returns the value of an environment variable or a fallback if empty.
 func getenv(key, fallback string) string {
 	v := os.Getenv(key)
@@ -108,6 +108,7 @@ export function CreateWidgetForm({ onCreate, onUpdate, onCancelEdit, initialData
     const groupColumns = (columns: { name: string; type: string }[]) => {
         const root: { name: string; type: string }[] = [];
         const groups: Record<string, { name: string; type: string }[]> = {};
+        const groupTypes: Record<string, string> = {};
 
         columns.forEach((col) => {
             if (col.name.includes('.')) {
@@ -117,11 +118,12 @@ export function CreateWidgetForm({ onCreate, onUpdate, onCancelEdit, initialData
             } else if (col.type.startsWith('Map(')) {
                 // Treat top-level Maps as groups even if they have no expanded children yet
                 if (!groups[col.name]) groups[col.name] = [];
+                groupTypes[col.name] = col.type.replace(/,\s*/g, ',');
             } else {
                 root.push(col);
             }
         });
-        return { root, groups };
+        return { root, groups, groupTypes };
     };
 
     return (
@@ -211,7 +213,7 @@ export function CreateWidgetForm({ onCreate, onUpdate, onCancelEdit, initialData
                     ) : (
                         <div className="grid gap-3 sm:grid-cols-2">
                             {schema.map((table) => {
-                                const { root, groups } = groupColumns(table.columns);
+                                const { root, groups, groupTypes } = groupColumns(table.columns);
                                 // Hide root columns that are already displayed as groups
                                 const visibleRoot = root.filter(col => !groups[col.name]);
 
@@ -234,7 +236,7 @@ export function CreateWidgetForm({ onCreate, onUpdate, onCancelEdit, initialData
                                                 <details key={groupName} className="group">
                                                     <summary className="flex cursor-pointer select-none items-center justify-between py-0.5 font-mono text-text">
                                                         <span>{groupName}</span>
-                                                        <span className="border-b border-dashed border-text/40 text-xs opacity-50 hover:border-text/80">Map(String,String)</span>
+                                                        <span className="border-b border-dashed border-text/40 text-xs opacity-50 hover:border-text/80">{groupTypes[groupName] || 'Map(String,String)'}</span>
                                                     </summary>
                                                     <div className="ml-1 mt-2 flex flex-col gap-2 border-l border-border pl-3">
                                                         {cols.length === 0 && (
@@ -3,7 +3,8 @@ local _M = {}
 function _M.get_settings()
     return {
         endpoint = os.getenv("PIXEL_ENDPOINT") or "/track",
-        fileName = os.getenv("PIXEL_FILENAME") or "pixel.js"
+        fileName = os.getenv("PIXEL_FILENAME") or "pixel.js",
+        internalCookie = os.getenv("PIXEL_INTERNAL_COOKIE") or "pixel_internal"
     }
 end
 
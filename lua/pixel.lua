@@ -2,6 +2,7 @@
 local cjson = require "cjson"
 -- Load MaxMind library explicitly
 local mmdb = require "resty.maxminddb"
+local settings = require("config").get_settings()
 
 -- Add CORS headers
 ngx.header["Access-Control-Allow-Origin"] = "*"
@@ -121,6 +122,12 @@ local function enrich_event(event)
         -- TLS/JA3 Fingerprint
         tls_fingerprint = tls_fp,
 
+        -- Network ASN for bot scoring: set by a Cloudflare Worker / transform rule
+        asn = headers["x-asn"] or headers["cf-asn"],
+
+        -- Internal-traffic marker cookie (filtered or tagged by the processor)
+        internal = ngx.var["cookie_" .. settings.internalCookie],
+
         -- Geolocation: Cloudflare Headers (Priority) -> MaxMind (Fallback) -> Unknown
         country = headers["cf-ipcountry"] or geo.country,
         country_name = headers["cf-ipcountry-name"] or geo.country_name,
@@ -0,0 +1,86 @@
+"""Synthetic labeled events for `processor eval-fingerprint`.
+
+Identities live in a few popular device buckets. TLS, WebGL and audio hashes
+come from small pools (browser builds, GPUs, audio stacks are shared by many
+people), 40% of canvas hashes come from a pool of renders identical across
+devices of the same model. An identity returns under new visitor_ids (cookie
+resets, private mode); on each return its canvas changes with 25% probability,
+its TLS hash with 10% and its audio hash with 5%.
+
+    python3 scripts/generate_fingerprint_eval.py > labeled.ndjson
+    processor eval-fingerprint -input labeled.ndjson
+"""
+import datetime
+import json
+import random
+import sys
+
+IDENTITIES = 3000
+SEED = 7
+
+random.seed(SEED)
+
+
+def rand_hash():
+    return "".join(random.choice("0123456789abcdef") for _ in range(64))
+
+
+# timezone, platform, language, screen width/height, cores, pixel ratio, color depth
+BUCKETS = [
+    ("Europe/Berlin", "iPhone", "de-DE", 390, 844, 6, 3, 24),
+    ("Europe/Berlin", "Win32", "de-DE", 1920, 1080, 8, 1, 24),
+    ("America/New_York", "MacIntel", "en-US", 1440, 900, 8, 2, 30),
+    ("America/New_York", "iPhone", "en-US", 393, 852, 6, 3, 24),
+    ("Europe/London", "Linux armv8l", "en-GB", 412, 915, 8, 2.625, 24),
+]
+TLS = [rand_hash() for _ in range(8)]
+WEBGL = [rand_hash() for _ in range(25)]
+AUDIO = [rand_hash() for _ in range(15)]
+POPULAR_CANVAS = [rand_hash() for _ in range(40)]
+
+START = datetime.datetime(2026, 10, 1)
+
+
+def main():
+    events = []
+    for ident in range(IDENTITIES):
+        b = random.choice(BUCKETS)
+        fp = {
+            "tls": random.choice(TLS),
+            "webgl": random.choice(WEBGL),
+            "audio": random.choice(AUDIO),
+            "canvas": random.choice(POPULAR_CANVAS) if random.random() < 0.4 else rand_hash(),
+        }
+        t = START + datetime.timedelta(minutes=random.randint(0, 7 * 24 * 60))
+        for visit in range(random.choice([1, 1, 2, 2, 3, 4])):
+            if visit > 0:
+                t += datetime.timedelta(hours=random.uniform(1, 48))
+                if random.random() < 0.25:
+                    fp["canvas"] = rand_hash()
+                if random.random() < 0.1:
+                    fp["tls"] = random.choice(TLS)
+                if random.random() < 0.05:
+                    fp["audio"] = random.choice(AUDIO)
+            for n in range(random.randint(1, 3)):
+                ts = t + datetime.timedelta(minutes=5 * n)
+                events.append((ts, {
+                    "event_name": "page_view",
+                    "visitor_id": "v%d_%d" % (ident, visit),
+                    "true_id": "p%d" % ident,
+                    "timestamp": ts.strftime("%Y-%m-%dT%H:%M:%SZ"),
+                    "device": {
+                        "timezone": b[0], "platform": b[1], "language": b[2],
+                        "screenWidth": b[3], "screenHeight": b[4],
+                        "hardwareConcurrency": b[5], "pixelRatio": b[6], "colorDepth": b[7],
+                        "fingerprint": {"canvas": fp["canvas"], "webgl": fp["webgl"], "audio": fp["audio"]},
+                    },
+                    "server": {"tls_fingerprint": fp["tls"]},
+                }))
+
+    events.sort(key=lambda e: e[0])
+    for _, e in events:
+        sys.stdout.write(json.dumps(e) + "\n")
+
+
+if __name__ == "__main__":
+    main()
@@ -67,7 +67,8 @@ export class PixelConfig {
             endpoint: v => typeof v === 'string' && v.startsWith('/'),
             batchSize: v => typeof v === 'number' && v >= 1,
             debug: v => typeof v === 'boolean',
-            traffic: v => typeof v === 'object' && v !== null && !Array.isArray(v)
+            traffic: v => typeof v === 'object' && v !== null && !Array.isArray(v),
+            consent: v => typeof v === 'object' && v !== null && !Array.isArray(v)
         };
 
         if (validators[key] && !validators[key](value)) {
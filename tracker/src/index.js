@@ -81,7 +81,18 @@ class Pixel {
 
         const deviceInfo = this.device.getInfo();
 
+        // Consent state (e.g. { analytics: true, fingerprinting: false }),
+        // applied by the processor; denied fingerprinting is not even sent
+        const consent = this.config.get('consent');
+        if (consent && consent.fingerprinting === false) {
+            delete deviceInfo.fingerprint;
+            delete deviceInfo.gpuRenderer;
+        }
+
         const payload = {
+            // Stable per event: retries from the offline queue reuse it, so the
+            // processor can drop duplicates
+            event_id: Utils.generateUUID(),
             event_name: eventName,
             timestamp: Date.now() / 1000,
 
@@ -98,6 +109,7 @@ class Pixel {
             // Objects
             device: deviceInfo,
             traffic: this.config.get('traffic') || {},
+            consent: consent || {},
             data: data
         };
 